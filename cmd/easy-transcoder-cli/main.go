@@ -0,0 +1,544 @@
+// Command easy-transcoder-cli is a command-line client for the JSON API of
+// an easy-transcoder main node, for enqueueing and resolving tasks from
+// shell scripts and cron.
+//
+// Usage:
+//
+//	easy-transcoder-cli [flags] <command> [args]
+//
+//	add <path>... --profile <name>     Queue a task for every file
+//	batch <dir> --profile <name>       Queue a task for every video file in a directory
+//	ls                                 List tasks
+//	watch [id]...                      Follow tasks until they finish
+//	cancel <id>...                     Cancel tasks
+//	resolve <id>... --accept|--reject  Resolve tasks waiting for resolution
+//	profiles                           List the profiles
+//	workers                            List the remote workers
+//
+// Paths are paths on the server. The server URL and the API token are read
+// from the flags or the environment variables:
+//
+//	EASY_TRANSCODER_SERVER_URL=http://host:8080
+//	EASY_TRANSCODER_API_TOKEN=<token>  # only when api.token is configured
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/royalcat/easy-transcoder/internal/api"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+)
+
+var (
+	serverURL  = flag.String("server-url", "", "URL of the easy-transcoder main node (e.g. http://host:8080)")
+	apiToken   = flag.String("api-token", "", "API token, when the server has api.token configured")
+	jsonOutput = flag.Bool("json", false, "Print JSON instead of tables")
+)
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// stdout is where the results of the commands are printed.
+var stdout io.Writer = os.Stdout
+
+// command is a subcommand of the CLI.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// Assigned in init, the commands refer to it for their usage
+	commands = map[string]command{
+		"add":      {"add <path>... --profile <name> [--priority <n>]", runAdd},
+		"batch":    {"batch <dir> --profile <name> [--priority <n>]", runBatch},
+		"ls":       {"ls [--status <status,...>] [--profile <name>] [--input <substring>]", runList},
+		"watch":    {"watch [id]... [--interval <duration>]", runWatch},
+		"cancel":   {"cancel <id>...", runCancel},
+		"resolve":  {"resolve <id>... | --all  --accept|--reject|--keep-both [--force]", runResolve},
+		"profiles": {"profiles", runProfiles},
+		"workers":  {"workers", runWorkers},
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *serverURL == "" {
+		*serverURL = os.Getenv("EASY_TRANSCODER_SERVER_URL")
+	}
+	if *apiToken == "" {
+		*apiToken = os.Getenv("EASY_TRANSCODER_API_TOKEN")
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: easy-transcoder-cli [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// newFlagSet creates the flag set of a command. The global flags are
+// accepted after the command as well.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: easy-transcoder-cli "+commands[name].usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(serverURL, "server-url", *serverURL, "URL of the easy-transcoder main node")
+	fs.StringVar(apiToken, "api-token", *apiToken, "API token")
+	fs.BoolVar(jsonOutput, "json", *jsonOutput, "Print JSON instead of tables")
+	return fs
+}
+
+// parseArgs parses flags mixed with positional arguments, so that
+// "add movie.mkv --profile x265" works, and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		if rest := len(args) - fs.NArg(); rest > 0 && args[rest-1] == "--" {
+			// Everything after "--" is positional
+			return append(positional, fs.Args()...)
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseIDs parses task IDs given as arguments.
+func parseIDs(args []string) ([]uint64, error) {
+	ids := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid task id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func runAdd(args []string) error {
+	fs := newFlagSet("add")
+	profile := fs.String("profile", "", "Transcoding profile")
+	priority := fs.Int("priority", 0, "Priority, higher is queued first")
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 || *profile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var tasks []api.Task
+	var errs []error
+	for _, path := range paths {
+		var task api.Task
+		err := doJSON("POST", "/api/v1/tasks", api.CreateTaskRequest{Input: path, Profile: *profile, Priority: *priority}, &task)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	printTasks(tasks)
+	return errors.Join(errs...)
+}
+
+func runBatch(args []string) error {
+	fs := newFlagSet("batch")
+	profile := fs.String("profile", "", "Transcoding profile")
+	priority := fs.Int("priority", 0, "Priority, higher is queued first")
+	dirs := parseArgs(fs, args)
+	if len(dirs) != 1 || *profile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var list api.TaskList
+	err := doJSON("POST", "/api/v1/tasks/batch", api.CreateBatchRequest{Dir: dirs[0], Profile: *profile, Priority: *priority}, &list)
+	if err != nil {
+		return err
+	}
+	printTasks(list.Tasks)
+	return nil
+}
+
+func runList(args []string) error {
+	fs := newFlagSet("ls")
+	status := fs.String("status", "", "Only tasks with these comma separated statuses")
+	profile := fs.String("profile", "", "Only tasks with this profile")
+	input := fs.String("input", "", "Only tasks whose input contains this string")
+	if len(parseArgs(fs, args)) > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	for key, value := range map[string]string{"status": *status, "profile": *profile, "input": *input} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	var list api.TaskList
+	if err := doJSON("GET", "/api/v1/tasks?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+	printTasks(list.Tasks)
+	return nil
+}
+
+// runWatch follows the given tasks, or all unfinished ones, until they are
+// finished or wait for resolution. In table mode the table is redrawn, in
+// JSON mode every change of a task is printed as a line. It fails when a
+// watched task failed.
+func runWatch(args []string) error {
+	fs := newFlagSet("watch")
+	interval := fs.Duration("interval", 2*time.Second, "Polling interval")
+	ids, err := parseIDs(parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	last := map[uint64]api.Task{}
+	for {
+		var list api.TaskList
+		if err := doJSON("GET", "/api/v1/tasks", nil, &list); err != nil {
+			return err
+		}
+
+		var watched []api.Task
+		for _, task := range list.Tasks {
+			if len(ids) > 0 && slices.Contains(ids, task.ID) || len(ids) == 0 && !isDone(task.Status) {
+				watched = append(watched, task)
+			}
+		}
+		for _, id := range ids {
+			if !slices.ContainsFunc(watched, func(task api.Task) bool { return task.ID == id }) {
+				return fmt.Errorf("task %d not found", id)
+			}
+		}
+
+		if *jsonOutput {
+			encoder := json.NewEncoder(stdout)
+			for _, task := range watched {
+				prev, ok := last[task.ID]
+				if !ok || prev.Status != task.Status || prev.Progress != task.Progress {
+					encoder.Encode(task)
+				}
+				last[task.ID] = task
+			}
+		} else {
+			// Clear the screen and redraw
+			fmt.Fprint(stdout, "\033[H\033[2J")
+			fmt.Fprintf(stdout, "Every %s: %s\n\n", *interval, time.Now().Format(time.DateTime))
+			printTaskTable(watched)
+		}
+
+		if len(ids) > 0 && !slices.ContainsFunc(watched, func(task api.Task) bool { return !isDone(task.Status) }) {
+			for _, task := range watched {
+				if task.Status == processor.TaskStatusFailed {
+					return fmt.Errorf("task %d failed: %s", task.ID, task.Error)
+				}
+			}
+			return nil
+		}
+
+		select {
+		case <-sigCh:
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// isDone reports whether a task needs no further processing, it is
+// finished or waits for resolution.
+func isDone(status processor.TaskStatus) bool {
+	switch status {
+	case processor.TaskStatusWaitingForResolution, processor.TaskStatusCompleted,
+		processor.TaskStatusCancelled, processor.TaskStatusFailed:
+		return true
+	}
+	return false
+}
+
+func runCancel(args []string) error {
+	fs := newFlagSet("cancel")
+	ids, err := parseIDs(parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var tasks []api.Task
+	var errs []error
+	for _, id := range ids {
+		var task api.Task
+		if err := doJSON("POST", fmt.Sprintf("/api/v1/tasks/%d/cancel", id), nil, &task); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	printTasks(tasks)
+	return errors.Join(errs...)
+}
+
+func runResolve(args []string) error {
+	fs := newFlagSet("resolve")
+	accept := fs.Bool("accept", false, "Replace the originals with the outputs")
+	reject := fs.Bool("reject", false, "Keep the originals and discard the outputs")
+	keepBoth := fs.Bool("keep-both", false, "Keep the originals and save the outputs as new files")
+	force := fs.Bool("force", false, "Skip the sanity checks of a replacement")
+	all := fs.Bool("all", false, "Resolve every task waiting for resolution")
+	ids, err := parseIDs(parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+
+	var resolutions []processor.Resolution
+	for resolution, set := range map[processor.Resolution]bool{
+		processor.ResolutionReplace:  *accept,
+		processor.ResolutionReject:   *reject,
+		processor.ResolutionKeepBoth: *keepBoth,
+	} {
+		if set {
+			resolutions = append(resolutions, resolution)
+		}
+	}
+	if len(resolutions) != 1 || (len(ids) == 0) == !*all {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *all {
+		var list api.TaskList
+		if err := doJSON("GET", "/api/v1/tasks?status="+string(processor.TaskStatusWaitingForResolution), nil, &list); err != nil {
+			return err
+		}
+		for _, task := range list.Tasks {
+			ids = append(ids, task.ID)
+		}
+	}
+
+	var tasks []api.Task
+	var errs []error
+	for _, id := range ids {
+		var task api.Task
+		req := api.ResolveRequest{Resolution: resolutions[0], Force: *force}
+		if err := doJSON("POST", fmt.Sprintf("/api/v1/tasks/%d/resolve", id), req, &task); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	printTasks(tasks)
+	return errors.Join(errs...)
+}
+
+func runProfiles(args []string) error {
+	fs := newFlagSet("profiles")
+	if len(parseArgs(fs, args)) > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var list api.ProfileList
+	if err := doJSON("GET", "/api/v1/profiles", nil, &list); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(list.Profiles)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tEXTENSION\tTWO-PASS\tPARAMS")
+	for _, profile := range list.Profiles {
+		params := make([]string, 0, len(profile.Params))
+		for key, value := range profile.Params {
+			params = append(params, key+"="+value)
+		}
+		slices.Sort(params)
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", profile.Name, orDash(profile.Extension), profile.TwoPass, strings.Join(params, " "))
+	}
+	return tw.Flush()
+}
+
+func runWorkers(args []string) error {
+	fs := newFlagSet("workers")
+	if len(parseArgs(fs, args)) > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var list api.WorkerList
+	if err := doJSON("GET", "/api/v1/workers", nil, &list); err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(list.Workers)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOSTNAME\tALIVE\tTASK\tCPU\tFFMPEG\tLAST HEARTBEAT")
+	for _, w := range list.Workers {
+		task := "-"
+		if w.HasTask {
+			task = strconv.FormatUint(w.CurrentTaskID, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%d cores\t%s\t%s\n",
+			w.ID, w.Hostname, w.Alive, task, w.CPUCores, orDash(w.FFmpegVersion), humanize.Time(w.LastHeartbeat))
+	}
+	return tw.Flush()
+}
+
+// printTasks prints tasks as a table or JSON. No table is printed without tasks.
+func printTasks(tasks []api.Task) {
+	if *jsonOutput {
+		if tasks == nil {
+			tasks = []api.Task{}
+		}
+		printJSON(tasks)
+		return
+	}
+	if len(tasks) > 0 {
+		printTaskTable(tasks)
+	}
+}
+
+func printTaskTable(tasks []api.Task) {
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tPROGRESS\tPROFILE\tPRIORITY\tWORKER\tINPUT")
+	for _, task := range tasks {
+		progress := "-"
+		if task.Status == processor.TaskStatusProcessing || task.Status == processor.TaskStatusPaused {
+			progress = fmt.Sprintf("%.1f%%", task.Progress*100)
+			if task.ETA > 0 {
+				progress += " (" + (time.Duration(task.ETA) * time.Second).String() + ")"
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			task.ID, task.Status, progress, task.Profile, task.Priority, orDash(task.WorkerName), task.Input)
+	}
+	tw.Flush()
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// doJSON sends a JSON-encoded request and decodes the response into out.
+// Error responses are returned as errors carrying the API's message.
+func doJSON(method, path string, body, out any) error {
+	if *serverURL == "" {
+		return errors.New("--server-url is required, set via flag or environment variable EASY_TRANSCODER_SERVER_URL")
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(*serverURL, "/")+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	if *apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*apiToken)
+	}
+	if bodyReader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		var apiErr api.Error
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("server returned %d: %s", resp.StatusCode, apiErr.Error)
+		}
+		return fmt.Errorf("server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/royalcat/easy-transcoder/internal/api"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantArgs     []string
+		wantProfile  string
+		wantPriority int
+	}{
+		{"flags first", []string{"--profile", "x265", "a.mkv", "b.mkv"}, []string{"a.mkv", "b.mkv"}, "x265", 0},
+		{"flags last", []string{"a.mkv", "b.mkv", "--profile", "x265"}, []string{"a.mkv", "b.mkv"}, "x265", 0},
+		{"flags between", []string{"a.mkv", "--priority=3", "b.mkv", "--profile", "x265"}, []string{"a.mkv", "b.mkv"}, "x265", 3},
+		{"after dashes", []string{"--profile", "x265", "a.mkv", "--", "--priority", "b.mkv"}, []string{"a.mkv", "--priority", "b.mkv"}, "x265", 0},
+		{"no args", nil, nil, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("add", flag.ContinueOnError)
+			profile := fs.String("profile", "", "")
+			priority := fs.Int("priority", 0, "")
+
+			args := parseArgs(fs, tt.args)
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("parseArgs() = %q, want %q", args, tt.wantArgs)
+			}
+			if *profile != tt.wantProfile || *priority != tt.wantPriority {
+				t.Errorf("profile, priority = %q, %d, want %q, %d", *profile, *priority, tt.wantProfile, tt.wantPriority)
+			}
+		})
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    []uint64
+		wantErr bool
+	}{
+		{[]string{"1", "20", "3"}, []uint64{1, 20, 3}, false},
+		{nil, []uint64{}, false},
+		{[]string{"1", "two"}, nil, true},
+		{[]string{"-1"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIDs(tt.args)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseIDs(%q) = %v, %v, want %v, error %v", tt.args, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPrintTaskTable(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+	t.Cleanup(func() { stdout = os.Stdout })
+
+	printTaskTable([]api.Task{
+		{ID: 1, Status: processor.TaskStatusProcessing, Progress: 0.425, ETA: 90, Profile: "x265", WorkerName: "gpu-box", Input: "/media/a.mkv"},
+		{ID: 12, Status: processor.TaskStatusPending, Profile: "av1", Priority: 5, Input: "/media/b.mkv"},
+	})
+
+	want := "" +
+		"ID  STATUS      PROGRESS       PROFILE  PRIORITY  WORKER   INPUT\n" +
+		"1   processing  42.5% (1m30s)  x265     0         gpu-box  /media/a.mkv\n" +
+		"12  pending     -              av1      5         -        /media/b.mkv\n"
+	if out.String() != want {
+		t.Errorf("printTaskTable() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// testServer fakes the task API, it knows task 1 and refuses to cancel
+// task 2. Every request is recorded as "METHOD path?query".
+func testServer(t *testing.T) *[]string {
+	t.Helper()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(api.Error{Error: "unauthorized"})
+			return
+		}
+
+		task := api.Task{ID: 1, Status: processor.TaskStatusPending, Profile: "x265", Input: "/media/a.mkv"}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/tasks":
+			json.NewEncoder(w).Encode(api.TaskList{Tasks: []api.Task{task}})
+		case "POST /api/v1/tasks/1/cancel":
+			task.Status = processor.TaskStatusCancelled
+			json.NewEncoder(w).Encode(task)
+		case "POST /api/v1/tasks/2/cancel":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.Error{Error: "task 2 is already completed"})
+		case "POST /api/v1/tasks":
+			var req api.CreateTaskRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			task.Input, task.Profile, task.Priority = req.Input, req.Profile, req.Priority
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(task)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	*serverURL, *apiToken, *jsonOutput = srv.URL, "token", false
+	t.Cleanup(func() { *serverURL, *apiToken, *jsonOutput = "", "", false })
+	return &requests
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name         string
+		run          func([]string) error
+		args         []string
+		wantRequests []string
+		wantOutput   []string // Substrings of the output
+		wantErr      string
+	}{
+		{
+			name:         "ls",
+			run:          runList,
+			args:         []string{"--status", "pending,failed"},
+			wantRequests: []string{"GET /api/v1/tasks?status=pending%2Cfailed"},
+			wantOutput:   []string{"ID  STATUS", "1   pending", "/media/a.mkv"},
+		},
+		{
+			name:         "ls as json",
+			run:          runList,
+			args:         []string{"--json"},
+			wantRequests: []string{"GET /api/v1/tasks?"},
+			wantOutput:   []string{`"id": 1`, `"status": "pending"`},
+		},
+		{
+			name:         "add",
+			run:          runAdd,
+			args:         []string{"/media/b.mkv", "--profile", "av1", "--priority", "2"},
+			wantRequests: []string{"POST /api/v1/tasks"},
+			wantOutput:   []string{"1   pending  -         av1      2         -       /media/b.mkv"},
+		},
+		{
+			name:         "cancel",
+			run:          runCancel,
+			args:         []string{"1", "2"},
+			wantRequests: []string{"POST /api/v1/tasks/1/cancel", "POST /api/v1/tasks/2/cancel"},
+			wantOutput:   []string{"1   cancelled"},
+			wantErr:      "server returned 409: task 2 is already completed",
+		},
+		{
+			name:    "invalid id",
+			run:     runCancel,
+			args:    []string{"one"},
+			wantErr: `invalid task id "one"`,
+		},
+		{
+			name:         "wrong token",
+			run:          runList,
+			args:         []string{"--api-token", "guess"},
+			wantRequests: []string{"GET /api/v1/tasks?"},
+			wantErr:      "server returned 401: unauthorized",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := testServer(t)
+			var out bytes.Buffer
+			stdout = &out
+			t.Cleanup(func() { stdout = os.Stdout })
+
+			err := tt.run(tt.args)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+			if !slices.Equal(*requests, tt.wantRequests) {
+				t.Errorf("requests = %q, want %q", *requests, tt.wantRequests)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/royalcat/easy-transcoder/internal/events"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+	"github.com/royalcat/easy-transcoder/ui/elements"
+)
+
+const (
+	// Events are coalesced and sent at most this often, so a running task
+	// reporting progress many times a second costs one card render per flush
+	eventsFlushInterval = 500 * time.Millisecond
+	// The navbar status (CPU, disk space) has no events, it is sent this often
+	statusEventInterval = 3 * time.Second
+	// A running task's log is sent at most this often
+	taskLogEventInterval = 2 * time.Second
+)
+
+// getEvents streams the UI updates as server-sent events for the htmx SSE
+// extension. Every event carries the HTML of the element it replaces:
+//   - queue: the queue changed in a way a single card can't show (a task
+//     was added, moved to another section or the pending order changed),
+//     the queue element reloads itself on it
+//   - task-<id>: the card of a task that changed within its section
+//   - status, workers: the navbar elements
+//
+// With ?tasklog=<id> only the log of that task is streamed instead.
+func (s *server) getEvents(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("tasklog"); id != "" {
+		taskId, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.streamTaskLog(w, r, taskId)
+		return
+	}
+
+	tasks := s.Processor.Subscribe(256)
+	defer tasks.Close()
+	workers := s.workerManager.Subscribe(16)
+	defer workers.Close()
+
+	flush := time.NewTicker(eventsFlushInterval)
+	defer flush.Stop()
+	status := time.NewTicker(statusEventInterval)
+	defer status.Stop()
+
+	s.streamEvents(newEventStream(w, r, s.logger), tasks, workers, flush.C, status.C)
+}
+
+// streamEvents sends the UI updates of the subscribed events until the
+// client is gone. Events are coalesced and sent on every tick of flush,
+// the navbar status is sent again on every tick of status.
+func (s *server) streamEvents(stream *eventStream, tasks *events.Subscription[processor.Event], workers *events.Subscription[worker.Event], flush, status <-chan time.Time) {
+	// Everything is sent on connect, the page may be stale after a reconnect
+	queueDirty, statusDirty, workersDirty := true, true, true
+	dirtyTasks := map[uint64]struct{}{}
+
+	for {
+		if queueDirty {
+			clear(dirtyTasks)
+			stream.send("queue", nil)
+			queueDirty = false
+		}
+		for id := range dirtyTasks {
+			task := s.Processor.GetTask(id)
+			if task.ID == 0 {
+				continue
+			}
+			stream.render("task-"+strconv.FormatUint(id, 10), elements.TaskCard(s.mapTaskState(task)))
+		}
+		clear(dirtyTasks)
+		if statusDirty {
+			if data, err := s.statusCache.get(statusEventInterval, s.status); err != nil {
+				s.logger.Error("event render error", "event", "status", "error", err)
+			} else {
+				stream.send("status", data)
+			}
+			statusDirty = false
+		}
+		if workersDirty {
+			stream.render("workers", s.workersStatus())
+			workersDirty = false
+		}
+		if err := stream.flush(); err != nil {
+			return
+		}
+
+		// Collect events until the next flush
+	collect:
+		for {
+			select {
+			case <-stream.ctx.Done():
+				return
+			case event := <-tasks.C:
+				switch event.Kind {
+				case processor.EventQueueChanged:
+					queueDirty = true
+				case processor.EventTaskChanged, processor.EventTaskProgress:
+					if event.Kind == processor.EventTaskChanged && queueSection(event.PrevStatus) != queueSection(event.Task.Status) ||
+						event.Task.Status == processor.TaskStatusPending {
+						// Pending cards are ordered by priority, a change may move them
+						queueDirty = true
+					} else {
+						dirtyTasks[event.TaskID] = struct{}{}
+					}
+				}
+			case <-workers.C:
+				workersDirty = true
+			case <-status:
+				statusDirty = true
+			case <-flush:
+				break collect
+			}
+		}
+
+		// Dropped events can't be told apart, the whole page is resent
+		if tasks.Lagged() {
+			queueDirty = true
+		}
+		if workers.Lagged() {
+			workersDirty = true
+		}
+	}
+}
+
+// streamTaskLog streams the log of a task as "tasklog" events, sent on
+// connect and after the log or the task changed.
+func (s *server) streamTaskLog(w http.ResponseWriter, r *http.Request, taskId uint64) {
+	if _, err := s.Processor.TaskLog(taskId); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	tasks := s.Processor.Subscribe(64)
+	defer tasks.Close()
+
+	stream := newEventStream(w, r, s.logger)
+
+	ticker := time.NewTicker(taskLogEventInterval)
+	defer ticker.Stop()
+
+	dirty := true
+	for {
+		if dirty || tasks.Lagged() {
+			task, content, err := s.readTaskLog(taskId)
+			if err != nil {
+				s.logger.Error("task log read error", "task_id", taskId, "error", err)
+				return
+			}
+			stream.render("tasklog", elements.TaskLog(task, content))
+			if err := stream.flush(); err != nil {
+				return
+			}
+			dirty = false
+		}
+
+	collect:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-tasks.C:
+				if event.TaskID == taskId && event.Kind != processor.EventTaskProgress {
+					dirty = true
+				}
+			case <-ticker.C:
+				break collect
+			}
+		}
+	}
+}
+
+// queueSection returns the section of the queue a task with the given
+// status is shown in, see elements.Queue.
+func queueSection(status processor.TaskStatus) string {
+	switch status {
+	case processor.TaskStatusWaitingForResolution, processor.TaskStatusReplacing:
+		return "waiting"
+	case processor.TaskStatusProcessing, processor.TaskStatusPaused:
+		return "processing"
+	case processor.TaskStatusPending:
+		return "pending"
+	case processor.TaskStatusCompleted, processor.TaskStatusCancelled, processor.TaskStatusFailed:
+		return "completed"
+	}
+	return ""
+}
+
+// renderCache shares a rendered component between the event streams, so an
+// expensive one (e.g. the status, which runs ffmpeg and lists the
+// partitions) is rendered once per interval instead of once per client.
+type renderCache struct {
+	mu         sync.Mutex
+	data       []byte
+	renderedAt time.Time
+}
+
+// get returns the cached render if it is younger than maxAge, or renders
+// the component again. Concurrent callers wait for a single render.
+func (c *renderCache) get(maxAge time.Duration, component func() templ.Component) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.data != nil && time.Since(c.renderedAt) < maxAge {
+		return c.data, nil
+	}
+	var data bytes.Buffer
+	if err := component().Render(context.Background(), &data); err != nil {
+		return nil, err
+	}
+	c.data, c.renderedAt = data.Bytes(), time.Now()
+	return c.data, nil
+}
+
+// eventStream buffers server-sent events until they are flushed to the client.
+type eventStream struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	ctx    context.Context
+	logger *slog.Logger
+	buf    bytes.Buffer
+}
+
+func newEventStream(w http.ResponseWriter, r *http.Request, logger *slog.Logger) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	return &eventStream{w: w, rc: http.NewResponseController(w), ctx: r.Context(), logger: logger}
+}
+
+// send buffers an event. Every line of data is sent as its own data field,
+// an event without data carries the event name, browsers drop empty events.
+func (s *eventStream) send(event string, data []byte) {
+	if len(data) == 0 {
+		data = []byte(event)
+	}
+	fmt.Fprintf(&s.buf, "event: %s\n", event)
+	for line := range bytes.Lines(data) {
+		fmt.Fprintf(&s.buf, "data: %s\n", bytes.TrimRight(line, "\r\n"))
+	}
+	s.buf.WriteString("\n")
+}
+
+// render buffers an event carrying the rendered component.
+func (s *eventStream) render(event string, component templ.Component) {
+	var data bytes.Buffer
+	if err := component.Render(s.ctx, &data); err != nil {
+		s.logger.Error("event render error", "event", event, "error", err)
+		return
+	}
+	s.send(event, data.Bytes())
+}
+
+// flush writes the buffered events to the client.
+func (s *eventStream) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	s.buf.Reset()
+	return s.rc.Flush()
+}
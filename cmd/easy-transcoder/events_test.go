@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+)
+
+// flushRecorder is a response writer handing every flushed write to the test.
+type flushRecorder struct {
+	header  http.Header
+	buf     bytes.Buffer
+	flushes chan string
+}
+
+func (r *flushRecorder) Header() http.Header            { return r.header }
+func (r *flushRecorder) WriteHeader(int)                {}
+func (r *flushRecorder) Write(data []byte) (int, error) { return r.buf.Write(data) }
+
+func (r *flushRecorder) Flush() {
+	r.flushes <- r.buf.String()
+	r.buf.Reset()
+}
+
+// newTestServer returns a server without remote workers whose tasks are
+// never run. The navbar status is cached, rendering it runs ffmpeg.
+func newTestServer(t *testing.T, cfg config.Config) *server {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	cfg.DBPath = filepath.Join(t.TempDir(), "tasks.db")
+	cfg.TempDir = t.TempDir()
+	p, err := processor.NewProcessor(cfg, logger)
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return &server{
+		Config:        cfg,
+		Processor:     p,
+		logger:        logger,
+		workerManager: worker.NewManager(cfg.Worker, p, logger),
+		statusCache:   renderCache{data: []byte("<div>status</div>"), renderedAt: time.Now()},
+	}
+}
+
+// eventNames returns the names of the events in a flushed write.
+func eventNames(data string) []string {
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestStreamEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		buffer    int  // Of the task subscription
+		lag       bool // Events are dropped before the stream starts
+		wantQueue bool // Instead of the card
+	}{
+		// A burst of progress is one render of the card
+		{"burst", 256, false, false},
+		// Dropped events can't be told apart, the whole queue is resent
+		{"lagged", 1, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, config.Config{})
+			// Cancelled, so its progress updates its card and not the pending order
+			id := s.Processor.AddTask("/media/movie.mkv", "x265", 0)
+			if err := s.Processor.CancelTask(id); err != nil {
+				t.Fatal(err)
+			}
+
+			tasks := s.Processor.Subscribe(tt.buffer)
+			defer tasks.Close()
+			workers := s.workerManager.Subscribe(16)
+			defer workers.Close()
+			if tt.lag {
+				s.Processor.UpdateProgress(id, 0.1, nil)
+				s.Processor.UpdateProgress(id, 0.2, nil)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			r := httptest.NewRequestWithContext(ctx, "GET", "/events", nil)
+			w := &flushRecorder{header: http.Header{}, flushes: make(chan string, 1)}
+			flush := make(chan time.Time)
+			done := make(chan struct{})
+			go func() {
+				s.streamEvents(newEventStream(w, r, s.logger), tasks, workers, flush, nil)
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			// Everything is sent on connect
+			if got := eventNames(<-w.flushes); !slices.Equal(got, []string{"queue", "status", "workers"}) {
+				t.Errorf("events on connect = %v", got)
+			}
+
+			for i := range 100 {
+				s.Processor.UpdateProgress(id, float64(i)/100, nil)
+			}
+			// Flushed once the stream collected the events
+			for deadline := time.Now().Add(5 * time.Second); len(tasks.C) > 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("events not collected")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			flush <- time.Now()
+
+			want := []string{"task-" + strconv.FormatUint(id, 10)}
+			if tt.wantQueue {
+				want = []string{"queue"}
+			}
+			if got := eventNames(<-w.flushes); !slices.Equal(got, want) {
+				t.Errorf("events = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamTaskLog(t *testing.T) {
+	s := newTestServer(t, config.Config{TaskLogs: config.TaskLogConfig{Dir: t.TempDir(), MaxSize: 1 << 20}})
+	id := s.Processor.AddTask("/media/movie.mkv", "x265", 0)
+	if err := s.Processor.AppendTaskLog(id, []byte("frame=100\n")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.getEvents))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"tasklog=first", http.StatusBadRequest},
+		{"tasklog=99", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/events?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s status = %d, want %d", tt.query, resp.StatusCode, tt.want)
+		}
+	}
+
+	// The log is sent on connect
+	resp, err := http.Get(srv.URL + "/events?tasklog=" + strconv.FormatUint(id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var event bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		event.WriteString(scanner.Text() + "\n")
+	}
+	if !strings.HasPrefix(event.String(), "event: tasklog\n") || !strings.Contains(event.String(), "frame=100") {
+		t.Errorf("first event = %q, want the task log", event.String())
+	}
+}
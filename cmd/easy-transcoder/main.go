@@ -2,22 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/a-h/templ"
 
 	"github.com/royalcat/easy-transcoder/assets"
+	"github.com/royalcat/easy-transcoder/internal/api"
 	"github.com/royalcat/easy-transcoder/internal/config"
 	"github.com/royalcat/easy-transcoder/internal/processor"
 	"github.com/royalcat/easy-transcoder/internal/transcoding"
@@ -41,7 +44,23 @@ func main() {
 
 	slog.Info("starting easy-transcoder")
 
-	q := processor.NewProcessor(cfg, logger)
+	q, err := processor.NewProcessor(cfg, logger)
+	if err != nil {
+		slog.Error("failed to create processor", "error", err)
+		os.Exit(1)
+	}
+
+	// Create worker manager and API handlers
+	wm := worker.NewManager(cfg.Worker, q, logger)
+	wh := worker.NewAPIHandlers(wm, logger)
+
+	// Webhooks are started before any task, so they see every task start
+	webhooks, err := api.NewWebhooks(cfg.Webhooks, q, wm, logger)
+	if err != nil {
+		slog.Error("failed to set up webhooks", "error", err)
+		os.Exit(1)
+	}
+	webhooks.Start()
 
 	// Start local worker only if not disabled (worker-only mode)
 	if cfg.Worker.DisableLocalProcessing {
@@ -50,10 +69,6 @@ func main() {
 		q.StartWorker()
 	}
 
-	// Create worker manager and API handlers
-	wm := worker.NewManager(cfg.Worker, q, logger)
-	wh := worker.NewAPIHandlers(wm, logger)
-
 	s := &server{
 		Config:        cfg,
 		Processor:     q,
@@ -62,12 +77,6 @@ func main() {
 		workerAPI:     wh,
 	}
 
-	// Set up auto-reject callback
-	q.SetOnWaitingForResolutionCallback(s.handleTaskWaitingForResolution)
-
-	// Start periodic auto-reject scanner
-	go s.startPeriodicAutoRejectScanner()
-
 	// Start worker disconnection scanner if enabled
 	if wm.Enabled() {
 		wm.StartDisconnectionScanner()
@@ -94,6 +103,7 @@ func main() {
 
 	mux.Handle("GET /", http.HandlerFunc(s.pageRoot))
 	mux.Handle("GET /resolver", http.HandlerFunc(s.pageResolver))
+	mux.Handle("GET /tasklog", http.HandlerFunc(s.pageTaskLog))
 	mux.Handle("GET /create-task", templHandler(pages.TaskCreation(q.FFmpegBinary(), cfg.Profiles, s.queue())))
 
 	mux.Handle("GET /elements/filepicker", http.HandlerFunc(s.getfilebrowser))
@@ -101,6 +111,8 @@ func main() {
 	mux.Handle("GET /elements/queue", http.HandlerFunc(s.getqueue))
 	mux.Handle("GET /elements/status", http.HandlerFunc(s.getstatus))
 	mux.Handle("GET /elements/workers", http.HandlerFunc(s.getWorkersStatus))
+	mux.Handle("GET /elements/tasklog", http.HandlerFunc(s.getTaskLog))
+	mux.Handle("GET /events", http.HandlerFunc(s.getEvents))
 
 	// Replaced the single VMAF endpoint with three separate metric endpoints
 	mux.Handle("GET /metrics/vmaf", http.HandlerFunc(s.getVMAF))
@@ -112,9 +124,37 @@ func main() {
 	mux.Handle("POST /submit/task", http.HandlerFunc(s.submitTask))
 	mux.Handle("POST /submit/task-batch", http.HandlerFunc(s.submitTaskBatch))
 	mux.Handle("POST /submit/resolve", http.HandlerFunc(s.submitTaskResolution))
+	mux.Handle("POST /submit/resolve-batch", http.HandlerFunc(s.submitTaskResolutionBatch))
 	mux.Handle("POST /submit/cancel", http.HandlerFunc(s.submitTaskCancellation))
+	mux.Handle("POST /submit/retry", http.HandlerFunc(s.submitTaskRetry))
+	mux.Handle("POST /submit/pause", http.HandlerFunc(s.submitTaskPause))
+	mux.Handle("POST /submit/resume", http.HandlerFunc(s.submitTaskResume))
+	mux.Handle("POST /submit/undo", http.HandlerFunc(s.submitTaskUndo))
+	mux.Handle("POST /submit/recovery-dismiss", http.HandlerFunc(s.submitRecoveryDismiss))
+	mux.Handle("POST /submit/queue-pause", http.HandlerFunc(s.submitQueuePause))
+	mux.Handle("POST /submit/priority", http.HandlerFunc(s.submitTaskPriority))
+	mux.Handle("POST /submit/move", http.HandlerFunc(s.submitTaskMove))
+	mux.Handle("POST /submit/reorder", http.HandlerFunc(s.submitQueueReorder))
+
+	// Task API routes (protected when api.token is configured)
+	ah := api.NewHandlers(q, wm, webhooks, cfg, logger)
+	apiAuth := func(h http.HandlerFunc) http.Handler {
+		return ah.AuthMiddleware(h)
+	}
 
-	mux.Handle("POST /settings/auto-reject-larger", http.HandlerFunc(s.submitAutoRejectSetting))
+	mux.Handle("GET /api/v1/openapi.yaml", http.HandlerFunc(ah.HandleOpenAPI))
+	mux.Handle("GET /api/v1/tasks", apiAuth(ah.HandleListTasks))
+	mux.Handle("POST /api/v1/tasks", apiAuth(ah.HandleCreateTask))
+	mux.Handle("POST /api/v1/tasks/batch", apiAuth(ah.HandleCreateBatch))
+	mux.Handle("POST /api/v1/tasks/reorder", apiAuth(ah.HandleReorderTasks))
+	mux.Handle("GET /api/v1/tasks/{id}", apiAuth(ah.HandleGetTask))
+	mux.Handle("POST /api/v1/tasks/{id}/cancel", apiAuth(ah.HandleCancelTask))
+	mux.Handle("POST /api/v1/tasks/{id}/resolve", apiAuth(ah.HandleResolveTask))
+	mux.Handle("POST /api/v1/tasks/{id}/retry", apiAuth(ah.HandleRetryTask))
+	mux.Handle("POST /api/v1/tasks/{id}/move", apiAuth(ah.HandleMoveTask))
+	mux.Handle("GET /api/v1/profiles", apiAuth(ah.HandleListProfiles))
+	mux.Handle("GET /api/v1/workers", apiAuth(ah.HandleListWorkers))
+	mux.Handle("GET /api/v1/webhooks/deliveries", apiAuth(ah.HandleListWebhookDeliveries))
 
 	// Worker API routes (only accessible when api_token is configured)
 	if wm.Enabled() {
@@ -131,6 +171,7 @@ func main() {
 		// FFmpeg uses the URL extension to auto-detect the container format.
 		mux.Handle("GET /api/v1/worker/task/input/{taskID}/{file}", auth(wh.HandleTaskInput))
 		mux.Handle("POST /api/v1/worker/task/progress", auth(wh.HandleTaskProgress))
+		mux.Handle("POST /api/v1/worker/task/log", auth(wh.HandleTaskLog))
 		mux.Handle("POST /api/v1/worker/task/complete", auth(wh.HandleTaskComplete))
 	}
 
@@ -143,17 +184,38 @@ func main() {
 	address := ":8080"
 	slog.Info("server starting", "address", address)
 
+	// Cancelled on shutdown to end the event streams, which never complete on their own
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	srv := &http.Server{
 		Addr:         address,
 		Handler:      loggingMiddleware(mux, logger),
 		WriteTimeout: 0,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
 
+	// Flush the task database on shutdown
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+
+		slog.Info("shutting down")
+		cancelBase()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
 	err = srv.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		slog.Error("server failed", "error", err)
 		os.Exit(1)
 	}
+
+	if err := q.Close(); err != nil {
+		slog.Error("failed to close processor", "error", err)
+		os.Exit(1)
+	}
 }
 
 // setupLogger creates a logger based on the provided configuration
@@ -210,6 +272,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap returns the wrapped writer, so http.ResponseController can flush
+// event streams through the wrapper.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 type server struct {
 	Config    config.Config
 	Processor *processor.Processor
@@ -218,9 +286,8 @@ type server struct {
 	workerManager *worker.Manager
 	workerAPI     *worker.APIHandlers
 
-	// Auto-reject setting and mutex for thread safety
-	autoRejectMu     sync.RWMutex
-	autoRejectLarger bool
+	// The navbar status sent to every event stream, rendered once per interval
+	statusCache renderCache
 }
 
 func (s *server) getfilebrowser(w http.ResponseWriter, r *http.Request) {
@@ -256,7 +323,7 @@ func (s *server) getfileinfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) getstatus(w http.ResponseWriter, r *http.Request) {
-	err := elements.Status(s.Processor.FFmpegBinary()).Render(r.Context(), w)
+	err := s.status().Render(r.Context(), w)
 	if err != nil {
 		s.logger.Error("cpu monitor render error", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -264,12 +331,28 @@ func (s *server) getstatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// status renders the navbar server status.
+func (s *server) status() templ.Component {
+	busy, total := s.Processor.LocalSlots()
+	return elements.Status(s.Processor.FFmpegBinary(), busy, total, s.Processor.DiskUsage())
+}
+
 func (s *server) getWorkersStatus(w http.ResponseWriter, r *http.Request) {
 	if s.workerManager == nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	err := s.workersStatus().Render(r.Context(), w)
+	if err != nil {
+		s.logger.Error("workers status render error", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// workersStatus renders the navbar remote workers.
+func (s *server) workersStatus() templ.Component {
 	workerStates := s.workerManager.GetWorkers()
 	workers := make([]elements.WorkerInfo, len(workerStates))
 	for i, ws := range workerStates {
@@ -280,13 +363,7 @@ func (s *server) getWorkersStatus(w http.ResponseWriter, r *http.Request) {
 			Alive:         ws.Alive,
 		}
 	}
-
-	err := elements.WorkersStatus(workers).Render(r.Context(), w)
-	if err != nil {
-		s.logger.Error("workers status render error", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	return elements.WorkersStatus(workers)
 }
 
 func (s *server) queue() []elements.TaskState {
@@ -303,12 +380,16 @@ func (s *server) mapTaskState(task processor.TaskState) elements.TaskState {
 		errorMessage = task.Error.Error()
 	}
 
+	// Sizes are only shown for finished transcodes, skip the stat calls
+	// for the (potentially thousands of) other tasks.
 	var inputSize, tempSize int64
-	if info, err := os.Stat(task.Input); err == nil {
-		inputSize = info.Size()
-	}
-	if info, err := os.Stat(task.TempFile); err == nil {
-		tempSize = info.Size()
+	if task.Status == processor.TaskStatusWaitingForResolution {
+		if info, err := os.Stat(task.Input); err == nil {
+			inputSize = info.Size()
+		}
+		if info, err := os.Stat(task.TempFile); err == nil {
+			tempSize = info.Size()
+		}
 	}
 
 	workerName := ""
@@ -316,7 +397,7 @@ func (s *server) mapTaskState(task processor.TaskState) elements.TaskState {
 		workerName = s.workerManager.GetWorkerName(task.WorkerID)
 	}
 
-	return elements.TaskState{
+	state := elements.TaskState{
 		ID:            strconv.Itoa(int(task.ID)),
 		Preset:        task.Preset,
 		FileName:      path.Base(task.Input),
@@ -327,9 +408,33 @@ func (s *server) mapTaskState(task processor.TaskState) elements.TaskState {
 		InputFileSize: inputSize,
 		TempFileSize:  tempSize,
 		CreatedAt:     task.CreateAt,
+		Priority:      task.Priority,
+		QueuePosition: task.QueuePosition,
 		Error:         errorMessage,
 		WorkerName:    workerName,
 	}
+	state.Stats = task.Stats
+	state.ETA = task.ETA
+	state.Metrics = task.Metrics
+	state.Attempts = len(task.Attempts)
+	state.MaxAttempts = s.Config.Retry.MaxAttempts
+	state.RetryAt = task.RetryAt
+	for _, attempt := range task.Attempts {
+		if attempt.Error != "" {
+			state.AttemptErrors = append(state.AttemptErrors, attempt.Error)
+		}
+	}
+	state.AutoResolution = task.AutoResolution
+	state.Output = task.Output
+	state.Backup = task.Backup != ""
+	state.Restored = task.Restored
+	state.Warnings = task.Warnings
+	if task.CRFSearch != nil {
+		state.TargetVMAF = task.CRFSearch.TargetVMAF
+		state.CRF = task.CRFSearch.CRF
+		state.VMAFScores = task.CRFSearch.Scores
+	}
+	return state
 }
 
 func (s *server) getqueue(w http.ResponseWriter, r *http.Request) {
@@ -337,7 +442,7 @@ func (s *server) getqueue(w http.ResponseWriter, r *http.Request) {
 	slices.Reverse(queue)
 
 	s.logger.Debug("queue request", "queue_length", len(queue))
-	err := elements.Queue(queue).Render(r.Context(), w)
+	err := elements.Queue(queue, s.Processor.QueuePaused(), s.Processor.ScheduleHold(), s.Processor.DiskSpaceHold()).Render(r.Context(), w)
 	if err != nil {
 		s.logger.Error("queue render error", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -365,7 +470,7 @@ func (s *server) getVMAF(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Calculate VMAF score
-	vmafScore, err := transcoding.CalculateVMAF(r.Context(), reference, distorted)
+	vmafScore, err := s.calculateMetric(r, transcoding.MetricVMAF, reference, distorted)
 	if err != nil {
 		s.logger.Error("vmaf calculation failed",
 			"reference", reference,
@@ -411,7 +516,7 @@ func (s *server) getPSNR(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Calculate PSNR score
-	psnrScore, err := transcoding.CalculatePSNR(r.Context(), reference, distorted)
+	psnrScore, err := s.calculateMetric(r, transcoding.MetricPSNR, reference, distorted)
 	if err != nil {
 		s.logger.Error("psnr calculation failed",
 			"reference", reference,
@@ -457,7 +562,7 @@ func (s *server) getSSIM(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Calculate SSIM score
-	ssimScore, err := transcoding.CalculateSSIM(r.Context(), reference, distorted)
+	ssimScore, err := s.calculateMetric(r, transcoding.MetricSSIM, reference, distorted)
 	if err != nil {
 		s.logger.Error("ssim calculation failed",
 			"reference", reference,
@@ -483,6 +588,21 @@ func (s *server) getSSIM(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// calculateMetric calculates a quality metric for the metric endpoints.
+// When the request names a task, the score cached on the task is used.
+func (s *server) calculateMetric(r *http.Request, metric, reference, distorted string) (float64, error) {
+	taskIdS := r.URL.Query().Get("taskid")
+	if taskIdS == "" {
+		return transcoding.CalculateMetric(r.Context(), metric, reference, distorted)
+	}
+
+	taskId, err := strconv.ParseUint(taskIdS, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid task id: %w", err)
+	}
+	return s.Processor.TaskMetric(r.Context(), taskId, metric)
+}
+
 func (s *server) pageResolver(w http.ResponseWriter, r *http.Request) {
 	taskIdS := r.URL.Query().Get("taskid")
 	taskId, err := strconv.Atoi(taskIdS)
@@ -508,6 +628,15 @@ func (s *server) pageResolver(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	taskState.KeepBothPath, taskState.KeepBothExists, err = s.Processor.KeepBothPath(uint64(taskId))
+	if err != nil {
+		taskState.KeepBothError = err.Error()
+	}
+	taskState.ReplacePath, taskState.ReplaceExists, err = s.Processor.ReplacePath(uint64(taskId))
+	if err != nil {
+		s.logger.Warn("failed to get replace path", "task_id", taskId, "error", err)
+	}
+
 	s.logger.Info("task resolver", "task_id", taskId, "status", taskState.Status)
 
 	err = pages.Resolver(s.Processor.FFmpegBinary(), taskState).Render(r.Context(), w)
@@ -518,6 +647,59 @@ func (s *server) pageResolver(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// taskLog reads the task and its log for the taskid query parameter.
+func (s *server) taskLog(r *http.Request) (elements.TaskState, string, int, error) {
+	taskId, err := strconv.ParseUint(r.URL.Query().Get("taskid"), 10, 64)
+	if err != nil {
+		return elements.TaskState{}, "", http.StatusBadRequest, err
+	}
+
+	task, content, err := s.readTaskLog(taskId)
+	if err != nil {
+		return elements.TaskState{}, "", http.StatusNotFound, err
+	}
+	return task, content, http.StatusOK, nil
+}
+
+// readTaskLog reads the task and its log.
+func (s *server) readTaskLog(taskId uint64) (elements.TaskState, string, error) {
+	content, err := s.Processor.TaskLog(taskId)
+	if err != nil {
+		return elements.TaskState{}, "", err
+	}
+	return s.mapTaskState(s.Processor.GetTask(taskId)), content, nil
+}
+
+func (s *server) pageTaskLog(w http.ResponseWriter, r *http.Request) {
+	task, content, status, err := s.taskLog(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = pages.TaskLog(s.Processor.FFmpegBinary(), task, content).Render(r.Context(), w)
+	if err != nil {
+		s.logger.Error("task log page render error", "task_id", task.ID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *server) getTaskLog(w http.ResponseWriter, r *http.Request) {
+	task, content, status, err := s.taskLog(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = elements.TaskLog(task, content).Render(r.Context(), w)
+	if err != nil {
+		s.logger.Error("task log render error", "task_id", task.ID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *server) submitTask(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -529,9 +711,16 @@ func (s *server) submitTask(w http.ResponseWriter, r *http.Request) {
 	filepath := r.FormValue("filepath")
 	profileName := r.FormValue("profile")
 
-	s.logger.Info("task submission", "filepath", filepath, "profile", profileName)
+	priority, err := formPriority(r)
+	if err != nil {
+		s.logger.Error("invalid priority", "priority", r.FormValue("priority"), "error", err)
+		http.Error(w, "Invalid value for 'priority' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Info("task submission", "filepath", filepath, "profile", profileName, "priority", priority)
 
-	s.Processor.AddTask(filepath, profileName)
+	s.Processor.AddTask(filepath, profileName, priority)
 }
 
 func (s *server) submitTaskBatch(w http.ResponseWriter, r *http.Request) {
@@ -554,48 +743,25 @@ func (s *server) submitTaskBatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	priority, err := formPriority(r)
+	if err != nil {
+		log.Error("invalid priority", "priority", r.FormValue("priority"), "error", err)
+		http.Error(w, "Invalid value for 'priority' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	go func() {
 		log.Info("processing batch task submission", "dir", dir, "profile", profileName)
 
-		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-			ext := strings.ToLower(filepath.Ext(path))
-
-			if !slices.Contains(transcoding.VideoExtensions, ext) {
-				return nil
-			}
-
-			if profile.BatchExcludeFilter != nil {
-				matches, err := profile.BatchExcludeFilter.Matches(path)
-				if err != nil {
-					log.Error("error applying filter", "file", path, "error", err)
-					return nil
-				}
-				if matches {
-					log.Info("skipping file due to filter", "file", path)
-					return nil
-				}
-			}
-
-			if s.Processor.HasTask(path, profileName) {
-				log.Info("skipping file, task already exists", "file", path, "profile", profileName)
-				return nil
-			}
-
-			log.Info("adding file to queue", "file", path, "profile", profileName)
-			s.Processor.AddTask(path, profileName)
-
-			return nil
-		})
+		added, err := s.Processor.AddDirectory(dir, profileName, priority)
 		if err != nil {
 			log.Error("error processing batch task", "error", err)
 		}
-
+		log.Info("batch task submission processed", "dir", dir, "added", len(added))
 	}()
 }
 
 func (s *server) submitTaskResolution(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
 	err := r.ParseForm()
 	if err != nil {
 		s.logger.Error("parse form error", "error", err)
@@ -611,23 +777,78 @@ func (s *server) submitTaskResolution(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	replaceS := r.FormValue("replace")
-	replace, err := strconv.ParseBool(replaceS)
-	if err != nil {
-		s.logger.Error("invalid replace value", "replace", replaceS, "error", err)
-		http.Error(w, "Invalid value for 'replace' parameter: "+err.Error(), http.StatusBadRequest)
-		return
+	// A forced replacement skips the sanity checks of the output
+	force := r.FormValue("force") == "true"
+
+	resolution := processor.ResolutionReplace
+	if !force {
+		resolution, err = formResolution(r)
+		if err != nil {
+			s.logger.Error("invalid resolution", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	s.logger.Info("resolving task", "task_id", taskID, "replace", replace)
+	s.logger.Info("resolving task", "task_id", taskID, "resolution", resolution, "force", force)
 
-	s.Processor.ResolveTask(ctx, uint64(taskID), replace)
+	err = s.Processor.ResolveTask(uint64(taskID), resolution, force)
+	if err != nil {
+		http.Error(w, "Failed to resolve task: "+err.Error(), http.StatusConflict)
+		return
+	}
 
 	w.Header().Set("HX-Redirect", "/")
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *server) submitTaskCancellation(w http.ResponseWriter, r *http.Request) {
+// formResolution parses the "resolution" form value. The older boolean
+// "replace" value is still accepted.
+func formResolution(r *http.Request) (processor.Resolution, error) {
+	if resolutionS := r.FormValue("resolution"); resolutionS != "" {
+		return processor.ParseResolution(resolutionS)
+	}
+
+	replace, err := strconv.ParseBool(r.FormValue("replace"))
+	if err != nil {
+		return "", fmt.Errorf("invalid value for 'replace' parameter: %w", err)
+	}
+	if replace {
+		return processor.ResolutionReplace, nil
+	}
+	return processor.ResolutionReject, nil
+}
+
+// submitTaskResolutionBatch resolves every task waiting for resolution the same way.
+func (s *server) submitTaskResolutionBatch(w http.ResponseWriter, r *http.Request) {
+	resolution, err := processor.ParseResolution(r.FormValue("resolution"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A task may have been resolved meanwhile, the others are resolved all the same
+	count := 0
+	var errs []error
+	for _, task := range s.Processor.GetQueue() {
+		if task.Status != processor.TaskStatusWaitingForResolution {
+			continue
+		}
+		if err := s.Processor.ResolveTask(task.ID, resolution, false); err != nil {
+			s.logger.Error("failed to resolve task", "task_id", task.ID, "resolution", resolution, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		count++
+	}
+	s.logger.Info("resolved waiting tasks", "resolution", resolution, "count", count, "failed", len(errs))
+
+	if len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("Failed to resolve %d of %d tasks:\n%s", len(errs), count+len(errs), errors.Join(errs...)), http.StatusConflict)
+	}
+}
+
+func (s *server) submitTaskPriority(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		s.logger.Error("parse form error", "error", err)
@@ -643,28 +864,65 @@ func (s *server) submitTaskCancellation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	s.logger.Info("cancelling task", "task_id", taskId)
+	priority, err := formPriority(r)
+	if err != nil {
+		s.logger.Error("invalid priority", "priority", r.FormValue("priority"), "error", err)
+		http.Error(w, "Invalid value for 'priority' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err = s.Processor.CancelTask(uint64(taskId))
+	err = s.Processor.SetTaskPriority(uint64(taskId), priority)
 	if err != nil {
-		s.logger.Error("task cancellation failed", "task_id", taskId, "error", err)
-		http.Error(w, "Failed to cancel task: "+err.Error(), http.StatusInternalServerError)
+		s.logger.Error("task priority change failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to change priority: "+err.Error(), http.StatusConflict)
 		return
 	}
 }
 
-func assetsRoutes(mux *http.ServeMux) {
-	fs := http.FileServer(http.FS(assets.Assets))
+func (s *server) submitTaskMove(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	assetHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
-		fs.ServeHTTP(w, r)
-	})
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
+	if err != nil {
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	mux.Handle("GET /assets/", http.StripPrefix("/assets/", assetHandler))
+	// position is "top", "bottom" or a 0-based index in the queue
+	positionS := r.FormValue("position")
+	var position int
+	switch positionS {
+	case "top":
+		position = 0
+	case "bottom":
+		position = -1
+	default:
+		position, err = strconv.Atoi(positionS)
+		if err != nil {
+			s.logger.Error("invalid position", "position", positionS, "error", err)
+			http.Error(w, "Invalid value for 'position' parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = s.Processor.MoveTask(uint64(taskId), position)
+	if err != nil {
+		s.logger.Error("task move failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to move task: "+err.Error(), http.StatusConflict)
+		return
+	}
 }
 
-func (s *server) submitAutoRejectSetting(w http.ResponseWriter, r *http.Request) {
+// submitQueueReorder reorders the pending queue. The form carries the
+// task IDs in their new order as repeated "order" values.
+func (s *server) submitQueueReorder(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		s.logger.Error("parse form error", "error", err)
@@ -672,89 +930,197 @@ func (s *server) submitAutoRejectSetting(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Get the checkbox value - if present, it's checked (true), if absent, it's unchecked (false)
-	autoReject := r.FormValue("auto-reject-larger") == "on"
+	ids := make([]uint64, 0, len(r.Form["order"]))
+	for _, idS := range r.Form["order"] {
+		id, err := strconv.ParseUint(idS, 10, 64)
+		if err != nil {
+			s.logger.Error("invalid task id", "task_id", idS, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
 
-	s.autoRejectMu.Lock()
-	s.autoRejectLarger = autoReject
-	s.autoRejectMu.Unlock()
+	s.Processor.ReorderQueue(ids)
+}
 
-	s.logger.Info("auto-reject setting updated", "enabled", autoReject)
+// formPriority parses the optional "priority" form value, defaulting to 0.
+func formPriority(r *http.Request) (int, error) {
+	priorityS := r.FormValue("priority")
+	if priorityS == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(priorityS)
+}
 
-	// If auto-reject is enabled, check all existing waiting_for_resolution tasks
-	if autoReject {
-		go s.processExistingWaitingTasks()
+func (s *server) submitTaskCancellation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
+	if err != nil {
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Info("cancelling task", "task_id", taskId)
 
-func (s *server) getAutoRejectSetting() bool {
-	s.autoRejectMu.RLock()
-	defer s.autoRejectMu.RUnlock()
-	return s.autoRejectLarger
+	err = s.Processor.CancelTask(uint64(taskId))
+	if err != nil {
+		s.logger.Error("task cancellation failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to cancel task: "+err.Error(), http.StatusConflict)
+		return
+	}
 }
 
-func (s *server) pageRoot(w http.ResponseWriter, r *http.Request) {
-	err := pages.Root(s.Processor.FFmpegBinary(), s.Config.Profiles, s.queue(), s.getAutoRejectSetting()).Render(r.Context(), w)
+func (s *server) submitTaskRetry(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
-		s.logger.Error("root page render error", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
+	if err != nil {
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Info("retrying task", "task_id", taskId)
+
+	err = s.Processor.RetryTask(uint64(taskId))
+	if err != nil {
+		s.logger.Error("task retry failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to retry task: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 }
 
-// handleTaskWaitingForResolution is called when a task transitions to waiting_for_resolution
-// and handles auto-rejection if enabled and result file is larger than original
-func (s *server) handleTaskWaitingForResolution(taskState processor.TaskState) {
-	// Check if auto-reject is enabled
-	if !s.getAutoRejectSetting() {
+func (s *server) submitTaskPause(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
+	if err != nil {
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.Processor.PauseTask(uint64(taskId))
+	if err != nil {
+		s.logger.Error("task pause failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to pause task: "+err.Error(), http.StatusConflict)
 		return
 	}
+}
 
-	log := s.logger.With("task_id", taskState.ID, "input", taskState.Input, "temp", taskState.TempFile)
+func (s *server) submitTaskResume(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Get file sizes
-	originalSize, err := s.getFileSize(taskState.Input)
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
 	if err != nil {
-		log.Error("failed to get original file size for auto-reject", "error", err)
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	resultSize, err := s.getFileSize(taskState.TempFile)
+	err = s.Processor.ResumeTask(uint64(taskId))
 	if err != nil {
-		log.Error("failed to get result file size for auto-reject", "error", err)
+		s.logger.Error("task resume failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to resume task: "+err.Error(), http.StatusConflict)
 		return
 	}
+}
 
-	log.Debug("auto-reject comparing file sizes", "original_size", originalSize, "result_size", resultSize)
+// submitTaskUndo undoes the replacement of a completed task, restoring the backed up original.
+func (s *server) submitTaskUndo(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.logger.Error("parse form error", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// If result file is larger than original, auto-reject
-	if resultSize > originalSize {
-		log.Info("auto-rejecting task due to larger result file",
-			"original_size", originalSize, "result_size", resultSize,
-			"size_diff", resultSize-originalSize)
+	taskIdS := r.FormValue("taskid")
+	taskId, err := strconv.Atoi(taskIdS)
+	if err != nil {
+		s.logger.Error("invalid task id", "task_id", taskIdS, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Use context.Background since this is an automated action
-		go s.Processor.ResolveTask(context.Background(), taskState.ID, false)
-	} else {
-		log.Debug("auto-reject: keeping task, result file is smaller or equal",
-			"original_size", originalSize, "result_size", resultSize)
+	err = s.Processor.UndoReplacement(uint64(taskId))
+	if err != nil {
+		s.logger.Error("undo replacement failed", "task_id", taskId, "error", err)
+		http.Error(w, "Failed to undo replacement: "+err.Error(), http.StatusConflict)
+		return
 	}
 }
 
-// getFileSize returns the size of a file in bytes
-func (s *server) getFileSize(filePath string) (int64, error) {
-	if filePath == "" {
-		return 0, fmt.Errorf("file path is empty")
+// submitRecoveryDismiss hides the outcome of the startup scan of the temp dir.
+func (s *server) submitRecoveryDismiss(w http.ResponseWriter, r *http.Request) {
+	s.Processor.DismissTempRecovery()
+}
+
+// submitQueuePause pauses or resumes the whole queue, "paused" is "true" or "false".
+func (s *server) submitQueuePause(w http.ResponseWriter, r *http.Request) {
+	paused, err := strconv.ParseBool(r.FormValue("paused"))
+	if err != nil {
+		http.Error(w, "Invalid value for 'paused' parameter: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	fileInfo, err := os.Stat(filePath)
+	if paused {
+		err = s.Processor.PauseQueue()
+	} else {
+		err = s.Processor.ResumeQueue()
+	}
 	if err != nil {
-		return 0, err
+		s.logger.Error("queue pause failed", "paused", paused, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+}
+
+func assetsRoutes(mux *http.ServeMux) {
+	fs := http.FileServer(http.FS(assets.Assets))
 
-	return fileInfo.Size(), nil
+	assetHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fs.ServeHTTP(w, r)
+	})
+
+	mux.Handle("GET /assets/", http.StripPrefix("/assets/", assetHandler))
+}
+
+func (s *server) pageRoot(w http.ResponseWriter, r *http.Request) {
+	err := pages.Root(s.Processor.FFmpegBinary(), s.Config.Profiles, s.queue(), s.Processor.TempRecovery()).Render(r.Context(), w)
+	if err != nil {
+		s.logger.Error("root page render error", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 // serveMedia serves video files over HTTP with byte-range support for <video> seeking.
@@ -812,37 +1178,3 @@ func mimeTypeFromExt(ext string) string {
 		return "application/octet-stream"
 	}
 }
-
-// processExistingWaitingTasks scans all existing tasks in waiting_for_resolution state
-// and applies auto-reject logic to them
-func (s *server) processExistingWaitingTasks() {
-	queue := s.Processor.GetQueue()
-	waitingCount := 0
-
-	for _, taskState := range queue {
-		if taskState.Status == processor.TaskStatusWaitingForResolution {
-			waitingCount++
-			s.handleTaskWaitingForResolution(taskState)
-		}
-	}
-
-	if waitingCount > 0 {
-		s.logger.Info("processed existing waiting_for_resolution tasks for auto-reject", "count", waitingCount)
-	}
-}
-
-// startPeriodicAutoRejectScanner runs a background process that periodically
-// scans for waiting_for_resolution tasks when auto-reject is enabled
-func (s *server) startPeriodicAutoRejectScanner() {
-	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
-	defer ticker.Stop()
-
-	s.logger.Info("auto-reject scanner started")
-
-	for range ticker.C {
-		if s.getAutoRejectSetting() {
-			s.logger.Debug("auto-reject scanner checking existing waiting tasks")
-			s.processExistingWaitingTasks()
-		}
-	}
-}
@@ -15,8 +15,8 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -29,6 +29,7 @@ import (
 	"os/signal"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -36,6 +37,8 @@ import (
 
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/mem"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 var (
@@ -184,7 +187,15 @@ type acquireTaskResponse struct {
 	FFmpegPath    string            `json:"ffmpeg_path"`
 	InputSize     int64             `json:"input_size"`
 	TotalDuration float64           `json:"total_duration"`
+	InputExt      string            `json:"input_ext"`
 	OutputExt     string            `json:"output_ext"`
+
+	TwoPass          bool              `json:"two_pass"`
+	FirstPassParams  map[string]string `json:"first_pass_params"`
+	SecondPassParams map[string]string `json:"second_pass_params"`
+
+	TargetVMAF float64               `json:"target_vmaf"`
+	CRFSearch  transcoding.CRFSearch `json:"crf_search"`
 }
 
 func acquireTask(workerID string) *acquireTaskResponse {
@@ -215,10 +226,16 @@ func processTask(workerID string, task *acquireTaskResponse) {
 	currentTaskID = &taskID
 	defer func() { currentTaskID = nil }()
 
+	// FFmpeg output goes to the task log on the main node. It is closed before
+	// the task is completed, the deferred Close only covers cancellation.
+	taskLog := newTaskLogShipper(workerID, task.ID)
+	defer taskLog.Close()
+
 	// Create temp directory for output
 	tempDir, err := os.MkdirTemp("", "easy-transcoder-worker-*")
 	if err != nil {
 		log.Printf("failed to create temp dir for task %d: %v", task.ID, err)
+		taskLog.Close()
 		reportCompletion(workerID, task.ID, false, err.Error())
 		return
 	}
@@ -233,7 +250,7 @@ func processTask(workerID string, task *acquireTaskResponse) {
 
 	// Construct input URL for FFmpeg's native HTTP reader.
 	// The file extension in the URL path lets FFmpeg auto-detect the container format.
-	inputExt := task.OutputExt
+	inputExt := task.InputExt
 	if inputExt == "" {
 		inputExt = ".mp4"
 	}
@@ -246,86 +263,171 @@ func processTask(workerID string, task *acquireTaskResponse) {
 		ffBin = *ffmpegPath
 	}
 
-	args := buildFFmpegArgs(ffBin, inputURL, outputPath, task.Params, *apiToken)
-	log.Printf("running ffmpeg: %s", strings.Join(args, " "))
+	// A target VMAF encode searches the CRF on samples of the input first
+	if task.TargetVMAF > 0 {
+		profile := transcoding.Profile{
+			Params:     task.Params,
+			TargetVMAF: task.TargetVMAF,
+			CRFSearch:  task.CRFSearch,
+		}
+		var headers string
+		if *apiToken != "" {
+			headers = "Authorization: Bearer " + *apiToken
+		}
+		log.Printf("searching crf for task %d, target vmaf %.1f", task.ID, task.TargetVMAF)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stopPing := pingCRFSearch(workerID, task.ID, cancel)
+		result, err := profile.SearchCRF(ctx, ffBin, inputURL, headers, task.TotalDuration, tempDir+"/crf-search", func(done, steps int) {
+			taskLog.Printf("crf search step %d/%d", done, steps)
+		})
+		stopPing()
+		if ctx.Err() != nil {
+			// Cancelled through a 409 on a ping, the server already marked the task
+			log.Printf("task %d cancelled by server", task.ID)
+			return
+		}
+		if err != nil {
+			log.Printf("crf search failed for task %d: %v", task.ID, err)
+			taskLog.Close()
+			reportCompletion(workerID, task.ID, false, "crf search failed: "+err.Error())
+			return
+		}
+		log.Printf("crf search for task %d chose crf %d", task.ID, result.CRF)
+		taskLog.Printf("crf search chose crf %d, sample scores %v", result.CRF, result.Scores)
+		if !reportCRFSearch(workerID, task.ID, &result) {
+			log.Printf("task %d cancelled by server", task.ID)
+			return
+		}
+		task.Params = profile.WithCRF(result.CRF).Params
+	}
+
+	// A two-pass encode runs the analysis pass first, sharing a passlog with the output pass
+	var passes [][]string
+	if task.TwoPass {
+		profile := transcoding.Profile{
+			Params:           task.Params,
+			FirstPassParams:  task.FirstPassParams,
+			SecondPassParams: task.SecondPassParams,
+		}
+		passlog := tempDir + "/passlog"
+		passes = [][]string{
+			buildFFmpegArgs(ffBin, inputURL, os.DevNull, profile.PassParams(1, passlog), *apiToken),
+			buildFFmpegArgs(ffBin, inputURL, outputPath, profile.PassParams(2, passlog), *apiToken),
+		}
+	} else {
+		passes = [][]string{
+			buildFFmpegArgs(ffBin, inputURL, outputPath, task.Params, *apiToken),
+		}
+	}
+
+	for i, args := range passes {
+		cancelled, err := runPass(workerID, task, args, i, len(passes), taskLog)
+		if cancelled {
+			// The server already marked the task as cancelled,
+			// so no completion report is needed.
+			log.Printf("task %d cancelled by server", task.ID)
+			return
+		}
+		if err != nil {
+			log.Printf("ffmpeg failed for task %d: %v", task.ID, err)
+			taskLog.Close()
+			reportCompletion(workerID, task.ID, false, err.Error())
+			return
+		}
+	}
+
+	// Read output file
+	outputData, err := os.ReadFile(outputPath)
+	if err != nil {
+		log.Printf("reading output file failed for task %d: %v", task.ID, err)
+		taskLog.Close()
+		reportCompletion(workerID, task.ID, false, err.Error())
+		return
+	}
+
+	log.Printf("transcoding complete for task %d, output=%d bytes", task.ID, len(outputData))
+
+	// Upload the transcoded output (this also completes the task on the server),
+	// after the rest of the log so it is complete once the task is
+	taskLog.Close()
+	if err := uploadOutput(workerID, task.ID, outputData); err != nil {
+		log.Printf("output upload failed for task %d: %v", task.ID, err)
+		reportCompletion(workerID, task.ID, false, err.Error())
+		return
+	}
+
+	log.Printf("task %d completed successfully", task.ID)
+}
+
+// runPass runs one ffmpeg pass of a task, reporting its share of the progress.
+// The command line and FFmpeg's stderr are written to taskLog.
+// Returns cancelled=true if the server cancelled the task while it was running.
+func runPass(workerID string, task *acquireTaskResponse, args []string, pass, passes int, taskLog *taskLogShipper) (cancelled bool, err error) {
+	log.Printf("running ffmpeg (pass %d/%d): %s", pass+1, passes, strings.Join(args, " "))
+	taskLog.Printf("$ %s", strings.Join(redactArgs(args), " "))
 
 	cmd := exec.Command(args[0], args[1:]...)
 
 	// Progress on stdout (clean, no FFmpeg errors mixed in)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Printf("stdout pipe failed for task %d: %v", task.ID, err)
-		reportCompletion(workerID, task.ID, false, err.Error())
-		return
+		return false, fmt.Errorf("stdout pipe failed: %w", err)
 	}
 
 	// Errors on stderr (captured separately for clean error logging)
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		log.Printf("stderr pipe failed for task %d: %v", task.ID, err)
-		reportCompletion(workerID, task.ID, false, err.Error())
-		return
+		return false, fmt.Errorf("stderr pipe failed: %w", err)
 	}
 
-	var stderrBuf bytes.Buffer
-
 	if err := cmd.Start(); err != nil {
-		log.Printf("ffmpeg start failed for task %d: %v", task.ID, err)
-		reportCompletion(workerID, task.ID, false, err.Error())
-		return
+		return false, fmt.Errorf("ffmpeg start failed: %w", err)
 	}
 
-	// Drain stderr into buffer in background
-	go func() { io.Copy(&stderrBuf, stderr) }()
+	// Drain stderr into the task log in background
+	stderrDone := make(chan struct{})
+	go func() {
+		io.Copy(taskLog, stderr)
+		close(stderrDone)
+	}()
 
 	// Parse progress from stdout; progressDone signals cancellation
 	progressDone := make(chan struct{})
-	go parseProgressLines(workerID, task.ID, task.TotalDuration, stdout, progressDone)
+	go parseProgressLines(workerID, task.ID, task.TotalDuration, pass, passes, stdout, progressDone)
 
 	// Wait for FFmpeg in a goroutine so we can also watch for cancellation
 	waitDone := make(chan error, 1)
 	go func() {
+		<-stderrDone
 		waitDone <- cmd.Wait()
 	}()
 
-	var waitErr error
 	select {
-	case waitErr = <-waitDone:
+	case waitErr := <-waitDone:
 		// FFmpeg completed normally — progressDone was not closed.
+		if waitErr != nil {
+			return false, fmt.Errorf("ffmpeg error: %v: %s", waitErr, taskLog.LastLine())
+		}
+		return false, nil
 	case <-progressDone:
 		// Server signalled cancellation via 409 on progress report.
-		// Kill FFmpeg and stop — the server already marked the task
-		// as cancelled, so no completion report is needed.
-		log.Printf("task %d cancelled by server", task.ID)
 		cmd.Process.Kill()
 		<-waitDone
-		return
+		return true, nil
 	}
+}
 
-	if waitErr != nil {
-		log.Printf("ffmpeg failed for task %d: %v\nffmpeg stderr:\n%s", task.ID, waitErr, stderrBuf.String())
-		reportCompletion(workerID, task.ID, false, fmt.Sprintf("ffmpeg error: %v\n%s", waitErr, stderrBuf.String()))
-		return
-	}
-
-	// Read output file
-	outputData, err := os.ReadFile(outputPath)
-	if err != nil {
-		log.Printf("reading output file failed for task %d: %v", task.ID, err)
-		reportCompletion(workerID, task.ID, false, err.Error())
-		return
-	}
-
-	log.Printf("transcoding complete for task %d, output=%d bytes", task.ID, len(outputData))
-
-	// Upload the transcoded output (this also completes the task on the server)
-	if err := uploadOutput(workerID, task.ID, outputData); err != nil {
-		log.Printf("output upload failed for task %d: %v", task.ID, err)
-		reportCompletion(workerID, task.ID, false, err.Error())
-		return
+// redactArgs returns a copy of an FFmpeg command line with the API token
+// in the HTTP headers replaced, for logging.
+func redactArgs(args []string) []string {
+	redacted := slices.Clone(args)
+	for i, arg := range redacted {
+		if strings.HasPrefix(arg, "Authorization: Bearer ") {
+			redacted[i] = "Authorization: Bearer ***"
+		}
 	}
-
-	log.Printf("task %d completed successfully", task.ID)
+	return redacted
 }
 
 // buildFFmpegArgs constructs an FFmpeg command line.
@@ -338,50 +440,61 @@ func buildFFmpegArgs(ffBin, input, output string, params map[string]string, apiT
 	}
 	args = append(args, "-i", input, "-map", "0")
 	for k, v := range params {
-		args = append(args, "-"+k, v)
+		// Empty values are flags without an argument (e.g. "an")
+		args = append(args, "-"+k)
+		if v != "" {
+			args = append(args, v)
+		}
 	}
 	args = append(args, "-y", output)
 	return args
 }
 
-// parseProgressLines reads FFmpeg stderr line by line, extracts out_time_ms,
-// and reports progress to the main node. Exits when the reader is closed.
-func parseProgressLines(workerID string, taskID uint64, totalDuration float64, reader io.Reader, done chan<- struct{}) {
-	re := regexp.MustCompile(`out_time_ms=(\d+)`)
-	scanner := bufio.NewScanner(reader)
-	lastProgress := 0.0
-
-	for scanner.Scan() {
-		matches := re.FindStringSubmatch(scanner.Text())
-		if len(matches) >= 2 {
-			outTimeUs, _ := strconv.ParseInt(matches[1], 10, 64)
-			progress := float64(outTimeUs) / totalDuration / 1e6
-			if progress > 1.0 {
-				progress = 1.0
-			}
-			if progress < 0 {
-				progress = 0
-			}
+// parseProgressLines reads FFmpeg's -progress output and reports progress and
+// the encoding stats to the main node, at most every percent or every
+// progressReportInterval. Each of the passes covers an equal share of the
+// overall progress. Exits when the reader is closed.
+func parseProgressLines(workerID string, taskID uint64, totalDuration float64, pass, passes int, reader io.Reader, done chan<- struct{}) {
+	lastProgress := float64(pass) / float64(passes)
+	var lastReport time.Time
+	cancelled := false
+
+	transcoding.ParseProgress(reader, func(stats transcoding.Progress) {
+		if cancelled {
+			return
+		}
 
-			if progress-lastProgress >= 0.01 || progress >= 1.0 {
-				lastProgress = progress
-				if !reportProgress(workerID, taskID, progress) {
-					close(done) // signal cancellation to processTask
-					return
-				}
+		progress := min(max(stats.OutTime/totalDuration, 0), 1.0)
+		if stats.End {
+			progress = 1.0
+		}
+		progress = (float64(pass) + progress) / float64(passes)
+
+		if progress-lastProgress >= 0.01 || progress >= float64(pass+1)/float64(passes) || time.Since(lastReport) >= progressReportInterval {
+			lastProgress = progress
+			lastReport = time.Now()
+			if !reportProgress(workerID, taskID, progress, stats) {
+				cancelled = true
+				close(done) // signal cancellation to processTask
 			}
 		}
-	}
-	// Scanner ended normally (FFmpeg exited) — done is intentionally NOT closed
+	})
+	// Reader ended normally (FFmpeg exited) — done is intentionally NOT closed
 	// so the select in processTask does not race with waitDone.
 }
 
-// reportProgress sends a progress update. Returns false if the server signals cancellation (HTTP 409).
-func reportProgress(workerID string, taskID uint64, progress float64) bool {
+// progressReportInterval is the longest time between two progress reports
+// while FFmpeg keeps reporting, so the encoding stats stay current.
+const progressReportInterval = 5 * time.Second
+
+// reportProgress sends a progress update with the latest FFmpeg stats.
+// Returns false if the server signals cancellation (HTTP 409).
+func reportProgress(workerID string, taskID uint64, progress float64, stats transcoding.Progress) bool {
 	jsonData, _ := json.Marshal(map[string]any{
 		"worker_id": workerID,
 		"task_id":   taskID,
 		"progress":  progress,
+		"stats":     stats,
 	})
 
 	req, _ := http.NewRequest("POST", *serverURL+"/api/v1/worker/task/progress", bytes.NewReader(jsonData))
@@ -401,6 +514,57 @@ func reportProgress(workerID string, taskID uint64, progress float64) bool {
 	return true
 }
 
+// pingCRFSearch reports a zero progress every progressReportInterval while
+// a CRF search runs, which has no progress of its own to report, and calls
+// cancel when the server signals cancellation. The returned function stops it.
+func pingCRFSearch(workerID string, taskID uint64, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !reportCRFSearch(workerID, taskID, nil) {
+					cancel()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// reportCRFSearch sends the outcome of a CRF search along with a zero progress
+// update, or only the update while the search runs and result is nil.
+// Returns false if the server signals cancellation (HTTP 409).
+func reportCRFSearch(workerID string, taskID uint64, result *transcoding.CRFSearchResult) bool {
+	body := map[string]any{
+		"worker_id": workerID,
+		"task_id":   taskID,
+		"progress":  0,
+	}
+	if result != nil {
+		body["crf_search"] = result
+	}
+	jsonData, _ := json.Marshal(body)
+
+	req, _ := http.NewRequest("POST", *serverURL+"/api/v1/worker/task/progress", bytes.NewReader(jsonData))
+	req.Header.Set("Authorization", "Bearer "+*apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("crf search report failed for task %d: %v", taskID, err)
+		return true // network error, keep going
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode != http.StatusConflict
+}
+
 // uploadOutput streams the transcoded output bytes to the main node.
 func uploadOutput(workerID string, taskID uint64, data []byte) error {
 	u, _ := url.Parse(*serverURL + "/api/v1/worker/task/complete")
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// taskLogFlushInterval is how often buffered FFmpeg output is sent to the main node.
+	taskLogFlushInterval = 2 * time.Second
+
+	// taskLogMaxBuffer is the buffered size at which the output is sent right away.
+	taskLogMaxBuffer = 256 << 10
+
+	// taskLogTailSize is how much of the latest output is kept for error messages.
+	taskLogTailSize = 4 << 10
+)
+
+// taskLogShipper collects the FFmpeg output of a task and sends it to the
+// task log on the main node in the background. Close flushes the rest.
+type taskLogShipper struct {
+	workerID string
+	taskID   uint64
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	tail []byte
+
+	sendMu sync.Mutex // Keeps the chunks in order
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTaskLogShipper(workerID string, taskID uint64) *taskLogShipper {
+	s := &taskLogShipper{
+		workerID: workerID,
+		taskID:   taskID,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *taskLogShipper) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(taskLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *taskLogShipper) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	s.buf.Write(data)
+	s.tail = append(s.tail, data...)
+	if len(s.tail) > taskLogTailSize {
+		s.tail = s.tail[len(s.tail)-taskLogTailSize:]
+	}
+	full := s.buf.Len() >= taskLogMaxBuffer
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+	return len(data), nil
+}
+
+// Printf writes a timestamped line to the task log.
+func (s *taskLogShipper) Printf(format string, args ...any) {
+	fmt.Fprintf(s, "[%s] %s\n", time.Now().Format(time.DateTime), fmt.Sprintf(format, args...))
+}
+
+// LastLine returns the last non-empty line of the output, e.g. FFmpeg's error.
+func (s *taskLogShipper) LastLine() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines := strings.FieldsFunc(string(s.tail), func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// Close stops the background sending and flushes the remaining output.
+// Calling it again does nothing.
+func (s *taskLogShipper) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+}
+
+func (s *taskLogShipper) flush() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	data := bytes.Clone(s.buf.Bytes())
+	s.buf.Reset()
+	s.mu.Unlock()
+
+	if len(data) == 0 {
+		return
+	}
+	if err := uploadTaskLog(s.workerID, s.taskID, data); err != nil {
+		log.Printf("task log upload failed for task %d: %v", s.taskID, err)
+	}
+}
+
+// uploadTaskLog appends a chunk of output to the task's log on the main node.
+func uploadTaskLog(workerID string, taskID uint64, data []byte) error {
+	u, _ := url.Parse(*serverURL + "/api/v1/worker/task/log")
+	q := u.Query()
+	q.Set("task_id", strconv.FormatUint(taskID, 10))
+	q.Set("worker_id", workerID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*apiToken)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+	return nil
+}
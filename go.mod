@@ -23,6 +23,7 @@ require (
 	github.com/templui/templui v1.12.0
 	github.com/u2takey/ffmpeg-go v0.5.0
 	github.com/ulikunitz/xz v0.5.15
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/sys v0.35.0
 )
 
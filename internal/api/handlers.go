@@ -0,0 +1,418 @@
+// Package api implements the versioned JSON API for scripting against the
+// task queue. Its OpenAPI document is served at /api/v1/openapi.yaml.
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// taskStatuses are the statuses tasks can be filtered by.
+var taskStatuses = []processor.TaskStatus{
+	processor.TaskStatusPending,
+	processor.TaskStatusProcessing,
+	processor.TaskStatusPaused,
+	processor.TaskStatusWaitingForResolution,
+	processor.TaskStatusReplacing,
+	processor.TaskStatusCompleted,
+	processor.TaskStatusCancelled,
+	processor.TaskStatusFailed,
+}
+
+// Handlers holds the HTTP handlers of the task API.
+type Handlers struct {
+	processor *processor.Processor
+	workers   *worker.Manager
+	webhooks  *Webhooks
+	config    config.Config
+	logger    *slog.Logger
+}
+
+// NewHandlers creates the handlers of the task API.
+func NewHandlers(p *processor.Processor, workers *worker.Manager, webhooks *Webhooks, cfg config.Config, logger *slog.Logger) *Handlers {
+	return &Handlers{processor: p, workers: workers, webhooks: webhooks, config: cfg, logger: logger.With("component", "api")}
+}
+
+// HandleOpenAPI handles GET /api/v1/openapi.yaml
+func (h *Handlers) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+// HandleListTasks handles GET /api/v1/tasks. Tasks are filtered by the
+// optional "status" (repeated or comma separated), "profile", "worker" and
+// "input" (case-insensitive substring) query parameters.
+func (h *Handlers) HandleListTasks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var statuses []processor.TaskStatus
+	for _, values := range query["status"] {
+		for value := range strings.SplitSeq(values, ",") {
+			status := processor.TaskStatus(strings.TrimSpace(value))
+			if !slices.Contains(taskStatuses, status) {
+				h.writeError(w, http.StatusBadRequest, fmt.Errorf("unknown status %q", value), nil)
+				return
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	profile := query.Get("profile")
+	workerID := query.Get("worker")
+	input := strings.ToLower(query.Get("input"))
+
+	list := TaskList{Tasks: []Task{}}
+	for _, state := range h.processor.GetQueue() {
+		if len(statuses) > 0 && !slices.Contains(statuses, state.Status) {
+			continue
+		}
+		if profile != "" && state.Preset != profile {
+			continue
+		}
+		if workerID != "" && state.WorkerID != workerID {
+			continue
+		}
+		if input != "" && !strings.Contains(strings.ToLower(state.Input), input) {
+			continue
+		}
+		list.Tasks = append(list.Tasks, h.newTask(state))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// HandleGetTask handles GET /api/v1/tasks/{id}
+func (h *Handlers) HandleGetTask(w http.ResponseWriter, r *http.Request) {
+	state, ok := h.pathTask(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.newTask(state))
+}
+
+// HandleCreateTask handles POST /api/v1/tasks
+func (h *Handlers) HandleCreateTask(w http.ResponseWriter, r *http.Request) {
+	var req CreateTaskRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	if err := h.checkProfile(req.Profile); err != nil {
+		h.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if err := checkInput(req.Input); err != nil {
+		h.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	id := h.processor.AddTask(req.Input, req.Profile, req.Priority)
+	h.logger.Info("task created", "task_id", id, "input", req.Input, "profile", req.Profile)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/tasks/%d", id))
+	writeJSON(w, http.StatusCreated, h.newTask(h.processor.GetTask(id)))
+}
+
+// HandleCreateBatch handles POST /api/v1/tasks/batch
+func (h *Handlers) HandleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	var req CreateBatchRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	if (req.Dir == "") == (len(req.Inputs) == 0) {
+		h.writeError(w, http.StatusBadRequest, errors.New("either dir or inputs must be set"), nil)
+		return
+	}
+	if err := h.checkProfile(req.Profile); err != nil {
+		h.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	var ids []uint64
+	if req.Dir != "" {
+		info, err := os.Stat(req.Dir)
+		if err != nil || !info.IsDir() {
+			h.writeError(w, http.StatusBadRequest, fmt.Errorf("dir %q is not a directory", req.Dir), nil)
+			return
+		}
+		ids, err = h.processor.AddDirectory(req.Dir, req.Profile, req.Priority)
+		if err != nil {
+			// Tasks added before the error are kept and returned
+			h.logger.Error("batch directory scan failed", "dir", req.Dir, "error", err)
+		}
+	} else {
+		for _, input := range req.Inputs {
+			if err := checkInput(input); err != nil {
+				h.writeError(w, http.StatusBadRequest, err, nil)
+				return
+			}
+		}
+		ids = h.processor.AddTasks(req.Inputs, req.Profile, req.Priority)
+	}
+	h.logger.Info("batch created", "dir", req.Dir, "profile", req.Profile, "count", len(ids))
+
+	list := TaskList{Tasks: make([]Task, 0, len(ids))}
+	for _, id := range ids {
+		list.Tasks = append(list.Tasks, h.newTask(h.processor.GetTask(id)))
+	}
+	writeJSON(w, http.StatusCreated, list)
+}
+
+// HandleCancelTask handles POST /api/v1/tasks/{id}/cancel
+func (h *Handlers) HandleCancelTask(w http.ResponseWriter, r *http.Request) {
+	state, ok := h.pathTask(w, r)
+	if !ok {
+		return
+	}
+	if err := h.processor.CancelTask(state.ID); err != nil {
+		h.writeError(w, http.StatusConflict, err, &state)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.newTask(h.processor.GetTask(state.ID)))
+}
+
+// HandleResolveTask handles POST /api/v1/tasks/{id}/resolve. The resolution
+// runs in the background, the task is returned as "replacing" with 202.
+func (h *Handlers) HandleResolveTask(w http.ResponseWriter, r *http.Request) {
+	state, ok := h.pathTask(w, r)
+	if !ok {
+		return
+	}
+	var req ResolveRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	resolution, err := processor.ParseResolution(string(req.Resolution))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if req.Force && resolution != processor.ResolutionReplace {
+		h.writeError(w, http.StatusBadRequest, errors.New("force only applies to the replace resolution"), nil)
+		return
+	}
+
+	if err := h.processor.ResolveTask(state.ID, resolution, req.Force); err != nil {
+		h.writeError(w, http.StatusConflict, err, &state)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, h.newTask(h.processor.GetTask(state.ID)))
+}
+
+// HandleRetryTask handles POST /api/v1/tasks/{id}/retry
+func (h *Handlers) HandleRetryTask(w http.ResponseWriter, r *http.Request) {
+	state, ok := h.pathTask(w, r)
+	if !ok {
+		return
+	}
+	if err := h.processor.RetryTask(state.ID); err != nil {
+		h.writeError(w, http.StatusConflict, err, &state)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.newTask(h.processor.GetTask(state.ID)))
+}
+
+// HandleMoveTask handles POST /api/v1/tasks/{id}/move. The priority is
+// applied before the position.
+func (h *Handlers) HandleMoveTask(w http.ResponseWriter, r *http.Request) {
+	state, ok := h.pathTask(w, r)
+	if !ok {
+		return
+	}
+	var req MoveRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	if req.Position == nil && req.Priority == nil {
+		h.writeError(w, http.StatusBadRequest, errors.New("position or priority must be set"), nil)
+		return
+	}
+
+	if req.Priority != nil {
+		if err := h.processor.SetTaskPriority(state.ID, *req.Priority); err != nil {
+			h.writeError(w, http.StatusConflict, err, &state)
+			return
+		}
+	}
+	if req.Position != nil {
+		if err := h.processor.MoveTask(state.ID, *req.Position); err != nil {
+			h.writeError(w, http.StatusConflict, err, &state)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, h.newTask(h.processor.GetTask(state.ID)))
+}
+
+// HandleReorderTasks handles POST /api/v1/tasks/reorder. It returns the
+// pending tasks in their new queue order.
+func (h *Handlers) HandleReorderTasks(w http.ResponseWriter, r *http.Request) {
+	var req ReorderRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	queue := h.processor.GetQueue()
+	index := make(map[uint64]int, len(queue))
+	for i, state := range queue {
+		index[state.ID] = i
+	}
+	for _, id := range req.Order {
+		i, ok := index[id]
+		if !ok {
+			h.writeError(w, http.StatusNotFound, fmt.Errorf("task %d not found", id), nil)
+			return
+		}
+		if queue[i].Status != processor.TaskStatusPending {
+			h.writeError(w, http.StatusConflict, fmt.Errorf("task %d is not pending", id), &queue[i])
+			return
+		}
+	}
+
+	h.processor.ReorderQueue(req.Order)
+
+	pending := h.processor.GetPendingTasks()
+	list := TaskList{Tasks: make([]Task, 0, len(pending))}
+	for _, state := range pending {
+		list.Tasks = append(list.Tasks, h.newTask(state))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// HandleListProfiles handles GET /api/v1/profiles
+func (h *Handlers) HandleListProfiles(w http.ResponseWriter, r *http.Request) {
+	list := ProfileList{Profiles: make([]Profile, 0, len(h.config.Profiles))}
+	for _, profile := range h.config.Profiles {
+		list.Profiles = append(list.Profiles, Profile{
+			Name:             profile.Name,
+			Params:           profile.Params,
+			Extension:        profile.Extension,
+			TwoPass:          profile.TwoPass,
+			FirstPassParams:  profile.FirstPassParams,
+			SecondPassParams: profile.SecondPassParams,
+			TargetVMAF:       profile.TargetVMAF,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// HandleListWorkers handles GET /api/v1/workers. The list is empty when
+// the worker API is disabled.
+func (h *Handlers) HandleListWorkers(w http.ResponseWriter, r *http.Request) {
+	workers := h.workers.GetWorkers()
+	slices.SortFunc(workers, func(a, b worker.WorkerState) int {
+		return strings.Compare(a.Hostname, b.Hostname)
+	})
+	if workers == nil {
+		workers = []worker.WorkerState{}
+	}
+	writeJSON(w, http.StatusOK, WorkerList{Workers: workers})
+}
+
+// HandleListWebhookDeliveries handles GET /api/v1/webhooks/deliveries.
+// The optional "status" query parameter filters the deliveries.
+func (h *Handlers) HandleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	status := DeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("unknown status %q", status), nil)
+		return
+	}
+
+	list := DeliveryList{Deliveries: []Delivery{}}
+	for _, delivery := range h.webhooks.Deliveries() {
+		if status == "" || delivery.Status == status {
+			list.Deliveries = append(list.Deliveries, delivery)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// pathTask returns the task named by the {id} path value. When it
+// doesn't exist, an error response is written and ok is false.
+func (h *Handlers) pathTask(w http.ResponseWriter, r *http.Request) (processor.TaskState, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid task id %q", r.PathValue("id")), nil)
+		return processor.TaskState{}, false
+	}
+	state := h.processor.GetTask(id)
+	if state.ID == 0 {
+		h.writeError(w, http.StatusNotFound, fmt.Errorf("task %d not found", id), nil)
+		return processor.TaskState{}, false
+	}
+	return state, true
+}
+
+// newTask converts a task state to JSON, resolving the name of its worker.
+func (h *Handlers) newTask(state processor.TaskState) Task {
+	if state.WorkerID != "" && h.workers != nil {
+		state.WorkerName = h.workers.GetWorkerName(state.WorkerID)
+	}
+	return newTask(state)
+}
+
+// checkProfile checks that a profile is configured.
+func (h *Handlers) checkProfile(name string) error {
+	if h.config.GetProfile(name) == nil {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	return nil
+}
+
+// checkInput checks that an input is an existing file.
+func checkInput(input string) error {
+	if input == "" {
+		return errors.New("input must be set")
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		return fmt.Errorf("input %q: %w", input, errors.Unwrap(err))
+	}
+	if info.IsDir() {
+		return fmt.Errorf("input %q is a directory", input)
+	}
+	return nil
+}
+
+// decode reads a JSON request body. Unknown fields are rejected, so typos
+// don't go unnoticed. On failure an error response is written.
+func (h *Handlers) decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err), nil)
+		return false
+	}
+	return true
+}
+
+// writeError writes an error response, with the state of the task the
+// request failed on when there is one.
+func (h *Handlers) writeError(w http.ResponseWriter, status int, err error, state *processor.TaskState) {
+	body := Error{Error: err.Error()}
+	if state != nil {
+		task := h.newTask(*state)
+		body.Task = &task
+	}
+	writeJSON(w, status, body)
+}
+
+// writeJSON writes a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+)
+
+// newTestServer serves the task API like the server does, with a processor
+// whose tasks are only run by remote workers, so none starts by itself.
+func newTestServer(t *testing.T, token string) (*httptest.Server, *processor.Processor) {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	cfg := config.Config{
+		DBPath:   filepath.Join(t.TempDir(), "tasks.db"),
+		TempDir:  t.TempDir(),
+		Profiles: []transcoding.Profile{{Name: "x265", Params: map[string]string{"c:v": "libx265"}}},
+		API:      config.APIConfig{Token: token},
+	}
+	p, err := processor.NewProcessor(cfg, logger)
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	workers := worker.NewManager(cfg.Worker, p, logger)
+	webhooks, err := NewWebhooks(cfg.Webhooks, p, workers, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(p, workers, webhooks, cfg, logger)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/tasks", h.AuthMiddleware(http.HandlerFunc(h.HandleListTasks)))
+	mux.Handle("POST /api/v1/tasks", h.AuthMiddleware(http.HandlerFunc(h.HandleCreateTask)))
+	mux.Handle("POST /api/v1/tasks/batch", h.AuthMiddleware(http.HandlerFunc(h.HandleCreateBatch)))
+	mux.Handle("POST /api/v1/tasks/reorder", h.AuthMiddleware(http.HandlerFunc(h.HandleReorderTasks)))
+	mux.Handle("GET /api/v1/tasks/{id}", h.AuthMiddleware(http.HandlerFunc(h.HandleGetTask)))
+	mux.Handle("POST /api/v1/tasks/{id}/cancel", h.AuthMiddleware(http.HandlerFunc(h.HandleCancelTask)))
+	mux.Handle("POST /api/v1/tasks/{id}/resolve", h.AuthMiddleware(http.HandlerFunc(h.HandleResolveTask)))
+	mux.Handle("POST /api/v1/tasks/{id}/retry", h.AuthMiddleware(http.HandlerFunc(h.HandleRetryTask)))
+	mux.Handle("POST /api/v1/tasks/{id}/move", h.AuthMiddleware(http.HandlerFunc(h.HandleMoveTask)))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, p
+}
+
+// writeMedia puts an ffprobe on the PATH that prints the content of the
+// probed file, and writes a media file with a video stream it probes.
+func writeMedia(t *testing.T, path string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\ncat \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	data, err := json.Marshal(transcoding.FFProbeData{
+		Format:  transcoding.FFProbeFormat{Filename: path, Duration: "600.0"},
+		Streams: []transcoding.FFProbeStream{{CodecType: "video"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// do sends a request with an optional JSON body and token, and decodes
+// the JSON response into v unless it's nil.
+func do(t *testing.T, srv *httptest.Server, method, path, body, token string, v any) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: decoding the response: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+func TestHandlersErrors(t *testing.T) {
+	srv, p := newTestServer(t, "")
+	input := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(input, []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pending := p.AddTask(input, "x265", 0)
+	cancelled := p.AddTask(input, "x265", 0)
+	if err := p.CancelTask(cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		want     int
+		wantTask uint64 // Task in the error body
+	}{
+		{"unknown status", "GET", "/api/v1/tasks?status=pending,done", "", http.StatusBadRequest, 0},
+		{"invalid body", "POST", "/api/v1/tasks", `{"input":`, http.StatusBadRequest, 0},
+		{"unknown field", "POST", "/api/v1/tasks", `{"input":"` + input + `","profile":"x265","prio":1}`, http.StatusBadRequest, 0},
+		{"unknown profile", "POST", "/api/v1/tasks", `{"input":"` + input + `","profile":"av1"}`, http.StatusBadRequest, 0},
+		{"missing input", "POST", "/api/v1/tasks", `{"input":"/missing.mkv","profile":"x265"}`, http.StatusBadRequest, 0},
+		{"batch without inputs", "POST", "/api/v1/tasks/batch", `{"profile":"x265"}`, http.StatusBadRequest, 0},
+		{"invalid id", "GET", "/api/v1/tasks/first", "", http.StatusBadRequest, 0},
+		{"unknown id", "GET", "/api/v1/tasks/99", "", http.StatusNotFound, 0},
+		{"cancel unknown", "POST", "/api/v1/tasks/99/cancel", "", http.StatusNotFound, 0},
+		{"reorder unknown", "POST", "/api/v1/tasks/reorder", `{"order":[99]}`, http.StatusNotFound, 0},
+		{"cancel cancelled", "POST", "/api/v1/tasks/" + itoa(cancelled) + "/cancel", "", http.StatusConflict, cancelled},
+		{"retry pending", "POST", "/api/v1/tasks/" + itoa(pending) + "/retry", "", http.StatusConflict, pending},
+		{"resolve pending", "POST", "/api/v1/tasks/" + itoa(pending) + "/resolve", `{"resolution":"reject"}`, http.StatusConflict, pending},
+		{"unknown resolution", "POST", "/api/v1/tasks/" + itoa(pending) + "/resolve", `{"resolution":"discard"}`, http.StatusBadRequest, 0},
+		{"forced reject", "POST", "/api/v1/tasks/" + itoa(pending) + "/resolve", `{"resolution":"reject","force":true}`, http.StatusBadRequest, 0},
+		{"move nowhere", "POST", "/api/v1/tasks/" + itoa(pending) + "/move", `{}`, http.StatusBadRequest, 0},
+		{"move cancelled", "POST", "/api/v1/tasks/" + itoa(cancelled) + "/move", `{"position":0}`, http.StatusConflict, cancelled},
+		{"reorder cancelled", "POST", "/api/v1/tasks/reorder", `{"order":[` + itoa(cancelled) + `]}`, http.StatusConflict, cancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body Error
+			resp := do(t, srv, tt.method, tt.path, tt.body, "", &body)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d (%s), want %d", resp.StatusCode, body.Error, tt.want)
+			}
+			if body.Error == "" {
+				t.Error("error body without an error")
+			}
+			switch {
+			case tt.wantTask == 0 && body.Task != nil:
+				t.Errorf("error body with task %d", body.Task.ID)
+			case tt.wantTask != 0 && (body.Task == nil || body.Task.ID != tt.wantTask):
+				t.Errorf("error body task = %+v, want %d", body.Task, tt.wantTask)
+			}
+		})
+	}
+}
+
+func TestHandlersTaskLifecycle(t *testing.T) {
+	srv, p := newTestServer(t, "")
+	input := filepath.Join(t.TempDir(), "movie.mkv")
+	writeMedia(t, input)
+
+	var created Task
+	resp := do(t, srv, "POST", "/api/v1/tasks", `{"input":"`+input+`","profile":"x265","priority":2}`, "", &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", resp.StatusCode)
+	}
+	if want := "/api/v1/tasks/" + itoa(created.ID); resp.Header.Get("Location") != want {
+		t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), want)
+	}
+	if created.Status != processor.TaskStatusPending || created.Priority != 2 || created.QueuePosition != 1 {
+		t.Errorf("created task = %+v", created)
+	}
+
+	var list TaskList
+	do(t, srv, "GET", "/api/v1/tasks?status=pending&profile=x265&input=MOVIE", "", "", &list)
+	if len(list.Tasks) != 1 || list.Tasks[0].ID != created.ID {
+		t.Errorf("filtered list = %+v", list.Tasks)
+	}
+	do(t, srv, "GET", "/api/v1/tasks?status=failed", "", "", &list)
+	if len(list.Tasks) != 0 {
+		t.Errorf("failed tasks = %+v", list.Tasks)
+	}
+
+	// Run by a remote worker, which fails it
+	if acquired, err := p.DequeueForWorker("worker", true); err != nil || acquired == nil {
+		t.Fatalf("DequeueForWorker() = %v, %v", acquired, err)
+	}
+	if err := p.CompleteTask(created.ID, false, "exit status 1"); err != nil {
+		t.Fatal(err)
+	}
+	var retried Task
+	if resp := do(t, srv, "POST", "/api/v1/tasks/"+itoa(created.ID)+"/retry", "", "", &retried); resp.StatusCode != http.StatusOK {
+		t.Fatalf("retry status = %d, want 200", resp.StatusCode)
+	}
+	if retried.Status != processor.TaskStatusPending || len(retried.Attempts) != 1 {
+		t.Errorf("retried task = %+v", retried)
+	}
+
+	// Run again, its output is waiting for a resolution
+	if _, err := p.DequeueForWorker("worker", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CompleteTask(created.ID, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	var resolved Task
+	if resp := do(t, srv, "POST", "/api/v1/tasks/"+itoa(created.ID)+"/resolve", `{"resolution":"reject"}`, "", &resolved); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("resolve status = %d, want 202", resp.StatusCode)
+	}
+	if resolved.Status != processor.TaskStatusReplacing && resolved.Status != processor.TaskStatusCompleted {
+		t.Errorf("resolved status = %s, want replacing or completed", resolved.Status)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	srv, _ := newTestServer(t, "secret")
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "guess", http.StatusUnauthorized},
+		{"token", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := do(t, srv, "GET", "/api/v1/tasks", "", tt.token, nil); resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	// Only the bearer scheme is accepted
+	req, _ := http.NewRequest("GET", srv.URL+"/api/v1/tasks", nil)
+	req.Header.Set("Authorization", "Basic secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("basic auth status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func itoa(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
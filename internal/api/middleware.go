@@ -0,0 +1,28 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AuthMiddleware returns an HTTP middleware that validates the Bearer token
+// against the configured API token. When no token is configured, all
+// requests pass, like they do for the web UI.
+func (h *Handlers) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := h.config.API.Token
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || auth[7:] != token {
+			h.writeError(w, http.StatusUnauthorized, errors.New("unauthorized"), nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+)
+
+// Task is the JSON representation of a task.
+type Task struct {
+	ID            uint64               `json:"id"`
+	Input         string               `json:"input"`
+	Profile       string               `json:"profile"`
+	Status        processor.TaskStatus `json:"status"`
+	Progress      float64              `json:"progress"` // 0.0 to 1.0
+	Priority      int                  `json:"priority"`
+	QueuePosition int                  `json:"queue_position,omitempty"` // 1-based, only for pending tasks
+
+	CreatedAt time.Time `json:"created_at"`
+	StartedAt time.Time `json:"started_at,omitzero"`
+	EndedAt   time.Time `json:"ended_at,omitzero"`
+
+	ETA   float64               `json:"eta,omitempty"`   // Seconds until the running task completes
+	Stats *transcoding.Progress `json:"stats,omitempty"` // Latest FFmpeg progress of the running task
+	Error string                `json:"error,omitempty"`
+
+	WorkerID   string `json:"worker_id,omitempty"`
+	WorkerName string `json:"worker_name,omitempty"`
+
+	Attempts []processor.Attempt `json:"attempts,omitempty"`
+	RetryAt  time.Time           `json:"retry_at,omitzero"`
+
+	CRFSearch *transcoding.CRFSearchResult `json:"crf_search,omitempty"`
+	Metrics   map[string]float64           `json:"metrics,omitempty"`
+
+	AutoResolution string   `json:"auto_resolution,omitempty"`
+	Output         string   `json:"output,omitempty"`
+	Backup         string   `json:"backup,omitempty"`
+	Restored       bool     `json:"restored,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+}
+
+// newTask converts a task state to its JSON representation.
+func newTask(state processor.TaskState) Task {
+	task := Task{
+		ID:             state.ID,
+		Input:          state.Input,
+		Profile:        state.Preset,
+		Status:         state.Status,
+		Progress:       state.Progress,
+		Priority:       state.Priority,
+		QueuePosition:  state.QueuePosition,
+		CreatedAt:      state.CreateAt,
+		StartedAt:      state.StartedAt,
+		EndedAt:        state.EndedAt,
+		ETA:            state.ETA.Seconds(),
+		WorkerID:       state.WorkerID,
+		WorkerName:     state.WorkerName,
+		Attempts:       state.Attempts,
+		RetryAt:        state.RetryAt,
+		CRFSearch:      state.CRFSearch,
+		Metrics:        state.Metrics,
+		AutoResolution: state.AutoResolution,
+		Output:         state.Output,
+		Backup:         state.Backup,
+		Restored:       state.Restored,
+		Warnings:       state.Warnings,
+	}
+	if state.Error != nil {
+		task.Error = state.Error.Error()
+	}
+	if state.Status == processor.TaskStatusProcessing || state.Status == processor.TaskStatusPaused {
+		stats := state.Stats
+		task.Stats = &stats
+	}
+	return task
+}
+
+// Error is the body of every error response. Task is the current state of
+// the task the request failed on, when there is one.
+type Error struct {
+	Error string `json:"error"`
+	Task  *Task  `json:"task,omitempty"`
+}
+
+// TaskList is the body of responses listing tasks.
+type TaskList struct {
+	Tasks []Task `json:"tasks"`
+}
+
+// CreateTaskRequest is the body of POST /api/v1/tasks.
+type CreateTaskRequest struct {
+	Input    string `json:"input"`
+	Profile  string `json:"profile"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// CreateBatchRequest is the body of POST /api/v1/tasks/batch. Either Dir,
+// scanned for video files like the batch form of the UI, or Inputs is set.
+type CreateBatchRequest struct {
+	Dir      string   `json:"dir,omitempty"`
+	Inputs   []string `json:"inputs,omitempty"`
+	Profile  string   `json:"profile"`
+	Priority int      `json:"priority,omitempty"`
+}
+
+// ResolveRequest is the body of POST /api/v1/tasks/{id}/resolve.
+type ResolveRequest struct {
+	Resolution processor.Resolution `json:"resolution"`
+	Force      bool                 `json:"force,omitempty"` // Skip the sanity checks of a replacement
+}
+
+// MoveRequest is the body of POST /api/v1/tasks/{id}/move.
+type MoveRequest struct {
+	Position *int `json:"position,omitempty"` // 0-based queue position, negative for the bottom
+	Priority *int `json:"priority,omitempty"`
+}
+
+// ReorderRequest is the body of POST /api/v1/tasks/reorder.
+type ReorderRequest struct {
+	Order []uint64 `json:"order"` // Pending task IDs in their new order at the front of the queue
+}
+
+// Profile is the JSON representation of a transcoding profile.
+type Profile struct {
+	Name             string            `json:"name"`
+	Params           map[string]string `json:"params"`
+	Extension        string            `json:"extension,omitempty"`
+	TwoPass          bool              `json:"two_pass,omitempty"`
+	FirstPassParams  map[string]string `json:"first_pass_params,omitempty"`
+	SecondPassParams map[string]string `json:"second_pass_params,omitempty"`
+	TargetVMAF       float64           `json:"target_vmaf,omitempty"`
+}
+
+// ProfileList is the body of GET /api/v1/profiles.
+type ProfileList struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+// WorkerList is the body of GET /api/v1/workers.
+type WorkerList struct {
+	Workers []worker.WorkerState `json:"workers"`
+}
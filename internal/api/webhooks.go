@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/events"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/worker"
+)
+
+// WebhookEvent is the name of a task lifecycle event posted to webhooks.
+type WebhookEvent string
+
+const (
+	WebhookTaskCreated   WebhookEvent = "task.created"
+	WebhookTaskStarted   WebhookEvent = "task.started"
+	WebhookTaskProgress  WebhookEvent = "task.progress" // A progress milestone was reached, see config.WebhooksConfig.ProgressStep
+	WebhookTaskWaiting   WebhookEvent = "task.waiting_for_resolution"
+	WebhookTaskCompleted WebhookEvent = "task.completed"
+	WebhookTaskFailed    WebhookEvent = "task.failed"
+	WebhookTaskCancelled WebhookEvent = "task.cancelled"
+)
+
+var webhookEvents = []WebhookEvent{
+	WebhookTaskCreated,
+	WebhookTaskStarted,
+	WebhookTaskProgress,
+	WebhookTaskWaiting,
+	WebhookTaskCompleted,
+	WebhookTaskFailed,
+	WebhookTaskCancelled,
+}
+
+// WebhookPayload is the JSON body posted to webhooks.
+type WebhookPayload struct {
+	ID        string       `json:"id"` // Delivery ID, the same for every attempt
+	Event     WebhookEvent `json:"event"`
+	Timestamp time.Time    `json:"timestamp"`
+	Milestone int          `json:"milestone,omitempty"` // Progress percentage reached, for task.progress
+	Task      Task         `json:"task"`
+}
+
+// DeliveryStatus is the state of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending" // Not delivered yet, attempts are left
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is an entry of the webhook delivery log.
+type Delivery struct {
+	ID           string         `json:"id"`
+	URL          string         `json:"url"`
+	Event        WebhookEvent   `json:"event"`
+	TaskID       uint64         `json:"task_id"`
+	Status       DeliveryStatus `json:"status"`
+	Attempts     int            `json:"attempts"`
+	ResponseCode int            `json:"response_code,omitempty"` // HTTP status of the last attempt
+	Error        string         `json:"error,omitempty"`         // Why the last attempt failed
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// DeliveryList is the body of GET /api/v1/webhooks/deliveries.
+type DeliveryList struct {
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// Webhooks posts task lifecycle events to the configured endpoints. It
+// receives the events through a processor task hook instead of the lossy
+// event bus, so no event is missed. Every endpoint has its own delivery
+// queue, so a slow or unreachable endpoint delays only its own deliveries,
+// which arrive in the order the events happened.
+//
+// The queues and the delivery log are kept in memory, deliveries not made
+// yet are lost on restart.
+type Webhooks struct {
+	config    config.WebhooksConfig
+	processor *processor.Processor
+	workers   *worker.Manager
+	client    *http.Client
+	logger    *slog.Logger
+
+	endpoints []*webhookEndpoint
+	events    *events.Queue[processor.Event] // Filled by the task hook, drained by run
+
+	// Highest milestone sent for the current attempt of each running task,
+	// only used by run
+	milestones map[uint64]int
+
+	logMu sync.Mutex
+	log   []*Delivery // Oldest first, at most config.LogSize entries
+}
+
+type webhookEndpoint struct {
+	config config.WebhookEndpoint
+	queue  *events.Queue[*webhookDelivery]
+}
+
+func (e *webhookEndpoint) wants(event WebhookEvent) bool {
+	return len(e.config.Events) == 0 || slices.Contains(e.config.Events, string(event))
+}
+
+type webhookDelivery struct {
+	record *Delivery // Guarded by Webhooks.logMu
+	body   []byte
+}
+
+// NewWebhooks creates the webhooks of the configured endpoints. workers
+// fills in the worker names of the payloads.
+func NewWebhooks(cfg config.WebhooksConfig, p *processor.Processor, workers *worker.Manager, logger *slog.Logger) (*Webhooks, error) {
+	wh := &Webhooks{
+		config:     cfg,
+		processor:  p,
+		workers:    workers,
+		client:     &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		logger:     logger.With("component", "webhooks"),
+		events:     events.NewQueue[processor.Event](),
+		milestones: map[uint64]int{},
+	}
+	for i, endpoint := range cfg.Endpoints {
+		for _, event := range endpoint.Events {
+			if !slices.Contains(webhookEvents, WebhookEvent(event)) {
+				return nil, fmt.Errorf("webhooks.endpoints[%d]: unknown event %q", i, event)
+			}
+		}
+		wh.endpoints = append(wh.endpoints, &webhookEndpoint{
+			config: endpoint,
+			queue:  events.NewQueue[*webhookDelivery](),
+		})
+	}
+	return wh, nil
+}
+
+// Start hooks into the processor's task events and starts delivering them.
+// Nothing is started without endpoints.
+func (wh *Webhooks) Start() {
+	if len(wh.endpoints) == 0 {
+		return
+	}
+	for _, endpoint := range wh.endpoints {
+		go wh.deliverLoop(endpoint)
+	}
+	// The hook may run with worker manager locks held, enqueue calls
+	// GetWorkerName, so the event is only handed off to run
+	wh.processor.OnTaskEvent(wh.events.Push)
+	go wh.run()
+	wh.logger.Info("webhooks enabled", "endpoints", len(wh.endpoints))
+}
+
+// Deliveries returns the delivery log, newest first.
+func (wh *Webhooks) Deliveries() []Delivery {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+
+	deliveries := make([]Delivery, 0, len(wh.log))
+	for _, d := range slices.Backward(wh.log) {
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries
+}
+
+// run turns the processor's events into webhook deliveries.
+func (wh *Webhooks) run() {
+	for {
+		event := wh.events.Pop()
+		switch event.Kind {
+		case processor.EventTaskChanged:
+			if webhookEvent, ok := wh.statusEvent(event); ok {
+				wh.enqueue(webhookEvent, event.Task, 0)
+			}
+		case processor.EventTaskProgress:
+			if milestone, ok := wh.milestone(event.Task); ok {
+				wh.enqueue(WebhookTaskProgress, event.Task, milestone)
+			}
+		}
+	}
+}
+
+// statusEvent maps a task status transition to its webhook event.
+func (wh *Webhooks) statusEvent(event processor.Event) (WebhookEvent, bool) {
+	task := event.Task
+	if event.PrevStatus == task.Status {
+		return "", false // Not a transition, e.g. a CRF search result was recorded
+	}
+
+	switch task.Status {
+	case processor.TaskStatusPending:
+		return WebhookTaskCreated, event.PrevStatus == ""
+	case processor.TaskStatusProcessing:
+		if event.PrevStatus == processor.TaskStatusPaused {
+			return "", false // Resumed
+		}
+		delete(wh.milestones, task.ID)
+		return WebhookTaskStarted, true
+	case processor.TaskStatusWaitingForResolution:
+		// The attempt reached its last milestone, the task may stay waiting for good
+		delete(wh.milestones, task.ID)
+		// A refused replacement returns the task to waiting, it was announced already
+		return WebhookTaskWaiting, event.PrevStatus != processor.TaskStatusReplacing
+	case processor.TaskStatusCompleted:
+		delete(wh.milestones, task.ID)
+		return WebhookTaskCompleted, true
+	case processor.TaskStatusFailed:
+		delete(wh.milestones, task.ID)
+		return WebhookTaskFailed, true
+	case processor.TaskStatusCancelled:
+		delete(wh.milestones, task.ID)
+		return WebhookTaskCancelled, true
+	}
+	return "", false
+}
+
+// milestone returns the highest progress milestone the task reached, if
+// it wasn't sent for the current attempt yet.
+func (wh *Webhooks) milestone(task processor.TaskState) (int, bool) {
+	step := wh.config.ProgressStep
+	if step == 0 {
+		return 0, false
+	}
+	// A late update of an attempt that already ended must not track it again
+	if task.Status != processor.TaskStatusProcessing {
+		return 0, false
+	}
+	milestone := int(task.Progress*100) / step * step
+	if milestone == 0 || milestone >= 100 || milestone <= wh.milestones[task.ID] {
+		return 0, false
+	}
+	wh.milestones[task.ID] = milestone
+	return milestone, true
+}
+
+// enqueue records a delivery of the event for every endpoint that wants it
+// and queues it.
+func (wh *Webhooks) enqueue(event WebhookEvent, state processor.TaskState, milestone int) {
+	task := newTask(state)
+	if task.WorkerID != "" {
+		task.WorkerName = wh.workers.GetWorkerName(task.WorkerID)
+	}
+
+	now := time.Now()
+	for _, endpoint := range wh.endpoints {
+		if !endpoint.wants(event) {
+			continue
+		}
+
+		payload := WebhookPayload{
+			ID:        newDeliveryID(),
+			Event:     event,
+			Timestamp: now,
+			Milestone: milestone,
+			Task:      task,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			wh.logger.Error("failed to encode webhook payload", "event", event, "task_id", task.ID, "error", err)
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			record: &Delivery{
+				ID:        payload.ID,
+				URL:       endpoint.config.URL,
+				Event:     event,
+				TaskID:    task.ID,
+				Status:    DeliveryPending,
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+			body: body,
+		}
+		wh.record(delivery.record)
+		endpoint.queue.Push(delivery)
+	}
+}
+
+// deliverLoop delivers the queued deliveries of an endpoint one by one.
+func (wh *Webhooks) deliverLoop(endpoint *webhookEndpoint) {
+	for {
+		wh.deliver(endpoint, endpoint.queue.Pop())
+	}
+}
+
+// deliver posts a delivery until it succeeds, fails permanently or runs
+// out of attempts.
+func (wh *Webhooks) deliver(endpoint *webhookEndpoint, delivery *webhookDelivery) {
+	log := wh.logger.With("url", endpoint.config.URL, "delivery_id", delivery.record.ID)
+
+	backoff := time.Duration(wh.config.Backoff) * time.Second
+	for attempt := 1; ; attempt++ {
+		code, retry, err := wh.post(endpoint, delivery)
+
+		wh.update(delivery.record, func(d *Delivery) {
+			d.Attempts = attempt
+			d.ResponseCode = code
+			d.Error = ""
+			switch {
+			case err == nil:
+				d.Status = DeliveryDelivered
+			case !retry || attempt >= wh.config.MaxAttempts:
+				d.Status = DeliveryFailed
+				d.Error = err.Error()
+			default:
+				d.Error = err.Error()
+			}
+		})
+
+		if err == nil {
+			log.Debug("webhook delivered", "attempt", attempt)
+			return
+		}
+		if !retry || attempt >= wh.config.MaxAttempts {
+			log.Warn("webhook delivery failed", "attempt", attempt, "error", err)
+			return
+		}
+		log.Info("webhook delivery failed, retrying", "attempt", attempt, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Duration(wh.config.MaxBackoff)*time.Second)
+	}
+}
+
+// post makes one delivery attempt. Network errors, timeouts, 408, 429 and
+// 5xx responses are retried, other failures are permanent.
+func (wh *Webhooks) post(endpoint *webhookEndpoint, delivery *webhookDelivery) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.config.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "easy-transcoder-webhooks")
+	req.Header.Set("X-Easy-Transcoder-Event", string(delivery.record.Event))
+	req.Header.Set("X-Easy-Transcoder-Delivery", delivery.record.ID)
+	if endpoint.config.Secret != "" {
+		req.Header.Set("X-Easy-Transcoder-Signature", sign(endpoint.config.Secret, delivery.body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return resp.StatusCode, retry, fmt.Errorf("unexpected response status %s", resp.Status)
+}
+
+// sign returns the X-Easy-Transcoder-Signature header of a payload:
+// "sha256=" followed by the hex encoded HMAC-SHA256 of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// record appends a delivery to the log, dropping the oldest beyond the log size.
+func (wh *Webhooks) record(d *Delivery) {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+
+	wh.log = append(wh.log, d)
+	if excess := len(wh.log) - wh.config.LogSize; excess > 0 {
+		wh.log = slices.Delete(wh.log, 0, excess)
+	}
+}
+
+// update changes a delivery of the log.
+func (wh *Webhooks) update(d *Delivery, change func(*Delivery)) {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+
+	change(d)
+	d.UpdatedAt = time.Now()
+}
+
+// newDeliveryID returns a random delivery ID.
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
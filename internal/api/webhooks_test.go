@@ -0,0 +1,73 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/processor"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{
+			name:   "rfc 4231 case 2",
+			secret: "Jefe",
+			body:   "what do ya want for nothing?",
+			want:   "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		},
+		{
+			name:   "pangram",
+			secret: "key",
+			body:   "The quick brown fox jumps over the lazy dog",
+			want:   "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		},
+		{
+			name:   "empty",
+			secret: "",
+			body:   "",
+			want:   "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sign(tt.secret, []byte(tt.body)); got != tt.want {
+				t.Errorf("sign() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookMilestones(t *testing.T) {
+	wh := &Webhooks{config: config.WebhooksConfig{ProgressStep: 25}, milestones: map[uint64]int{}}
+	task := processor.TaskState{ID: 1, Status: processor.TaskStatusProcessing}
+
+	progress := func(p float64) (int, bool) {
+		task.Progress = p
+		return wh.milestone(task)
+	}
+	transition := func(prev, status processor.TaskStatus) {
+		task.Status = status
+		wh.statusEvent(processor.Event{Kind: processor.EventTaskChanged, TaskID: task.ID, Task: task, PrevStatus: prev})
+	}
+
+	if m, ok := progress(0.3); !ok || m != 25 {
+		t.Errorf("milestone at 30%% = %d, %v, want 25", m, ok)
+	}
+	if _, ok := progress(0.4); ok {
+		t.Error("milestone 25 sent twice")
+	}
+
+	// A task left waiting for resolution doesn't keep its entry
+	transition(processor.TaskStatusProcessing, processor.TaskStatusWaitingForResolution)
+	if _, ok := progress(0.99); ok {
+		t.Error("milestone sent for a task waiting for resolution")
+	}
+	if len(wh.milestones) != 0 {
+		t.Errorf("milestones = %v after the attempt ended, want none", wh.milestones)
+	}
+}
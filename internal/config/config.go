@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"strings"
@@ -43,17 +44,145 @@ type WorkerConfig struct {
 	DisableLocalProcessing bool `koanf:"disable_local_processing"`
 }
 
+// APIConfig configures the JSON task API.
+type APIConfig struct {
+	// Token is the Bearer token the task API requires. When empty, the
+	// task API is open like the web UI.
+	Token string `koanf:"token"`
+}
+
+// ReplaceCheckConfig configures the sanity checks comparing an output to
+// its input before the output replaces the original.
+type ReplaceCheckConfig struct {
+	// Disabled skips the checks, every replacement goes through.
+	Disabled bool `koanf:"disabled"`
+
+	// DurationTolerance is the allowed difference in seconds between
+	// the durations of input and output.
+	DurationTolerance float64 `koanf:"duration_tolerance"`
+}
+
+// RetryConfig configures automatic retries of failed tasks.
+type RetryConfig struct {
+	// MaxAttempts is the number of times a task is run before it stays
+	// failed. 1 disables automatic retries.
+	MaxAttempts int `koanf:"max_attempts"`
+
+	// Backoff is the delay in seconds before the first retry,
+	// it doubles with every further retry up to MaxBackoff.
+	Backoff    int `koanf:"backoff"`
+	MaxBackoff int `koanf:"max_backoff"`
+
+	// AvoidLastWorker keeps a retried task away from the remote worker its
+	// last attempt failed on, as long as another worker can take it.
+	AvoidLastWorker bool `koanf:"avoid_last_worker"`
+}
+
+// TaskLogConfig configures the per-task FFmpeg logs.
+type TaskLogConfig struct {
+	// Dir is the directory the task logs are written to.
+	// When empty, task logs are disabled.
+	Dir string `koanf:"dir"`
+
+	// MaxSize is the size in bytes at which a task log is rotated.
+	// The current and the previous log are kept.
+	MaxSize int `koanf:"max_size"`
+
+	// MaxAge is the number of days the log of a finished task is kept after
+	// it was last written, 0 keeps it regardless of age.
+	MaxAge int `koanf:"max_age"`
+}
+
+// BackupConfig configures backups of the originals replaced by outputs.
+type BackupConfig struct {
+	// Dir is the quarantine directory replaced originals are moved to,
+	// so a replacement can be undone. When empty, originals are not kept.
+	Dir string `koanf:"dir"`
+
+	// MaxAge is the number of days a backup is kept, 0 keeps it regardless of age.
+	MaxAge int `koanf:"max_age"`
+
+	// MaxSize is the total size in bytes of the kept backups, the oldest
+	// are removed beyond it. 0 keeps them regardless of size.
+	MaxSize int `koanf:"max_size"`
+}
+
+// PreserveConfig selects the attributes of an original that the output
+// replacing it takes over. The permissions are always kept.
+type PreserveConfig struct {
+	Ownership bool `koanf:"ownership"` // Owner and group
+	Times     bool `koanf:"times"`     // Access and modification time
+	XAttrs    bool `koanf:"xattrs"`    // Extended attributes, except ACLs
+	ACLs      bool `koanf:"acls"`      // POSIX ACLs
+}
+
+// DiskSpaceConfig configures the free space check before a task starts.
+// The output size is estimated from the input and the profile, it must fit
+// into the temp dir and next to the input, where a replacement writes a copy.
+type DiskSpaceConfig struct {
+	// Enabled turns the check on, it is off by default.
+	Enabled bool `koanf:"enabled"`
+
+	// TempReserve and DestReserve are the bytes that must stay free on the
+	// filesystems of the temp dir and of the input.
+	TempReserve int `koanf:"temp_reserve"`
+	DestReserve int `koanf:"dest_reserve"`
+
+	// EstimateMargin multiplies the estimated output size.
+	EstimateMargin float64 `koanf:"estimate_margin"`
+
+	// Action is what happens to a task that doesn't fit: "hold" keeps it in
+	// its place until enough space is free and starts the next tasks that
+	// fit, "fail" fails it without automatic retries.
+	Action string `koanf:"action"`
+
+	// CheckInterval is the number of seconds between checks of a held task.
+	CheckInterval int `koanf:"check_interval"`
+}
+
 // Config holds the application configuration
 type Config struct {
 	CustomFFmpegURL string `koanf:"custom_ffmpeg"`
 
+	// DBPath is the path of the task database used to persist the queue
+	// across restarts. When empty, tasks are kept only in memory.
+	DBPath string `koanf:"db_path"`
+
 	TempDir  string                `koanf:"tempdir"`
 	Profiles []transcoding.Profile `koanf:"profiles"`
 	Logging  LogConfig             `koanf:"logging"`
 
 	TranscodingNiceness int `koanf:"transcoding_niceness"`
 
+	// MaxConcurrentTasks is the number of tasks the local worker
+	// transcodes in parallel.
+	MaxConcurrentTasks int `koanf:"max_concurrent_tasks"`
+
+	// ResolutionRules resolve tasks waiting for resolution automatically.
+	// They apply to every profile, after the profile's own rules.
+	ResolutionRules []transcoding.ResolutionRule `koanf:"resolution_rules"`
+
+	ReplaceChecks ReplaceCheckConfig `koanf:"replace_checks"`
+
+	KeepBoth KeepBothConfig `koanf:"keep_both"`
+
+	Backup BackupConfig `koanf:"backup"`
+
+	Preserve PreserveConfig `koanf:"preserve"`
+
+	DiskSpace DiskSpaceConfig `koanf:"disk_space"`
+
+	Retry RetryConfig `koanf:"retry"`
+
+	Schedule ScheduleConfig `koanf:"schedule"`
+
+	TaskLogs TaskLogConfig `koanf:"task_logs"`
+
 	Worker WorkerConfig `koanf:"worker"`
+
+	API APIConfig `koanf:"api"`
+
+	Webhooks WebhooksConfig `koanf:"webhooks"`
 }
 
 // GetLogLevel returns the slog.Level based on the configured string level
@@ -118,6 +247,84 @@ func validateConfig(config Config) error {
 		return errors.New("transcoding_niceness must be between -20 and 19")
 	}
 
+	if config.MaxConcurrentTasks < 1 {
+		return errors.New("max_concurrent_tasks must be at least 1")
+	}
+
+	for _, profile := range config.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", profile.Name, err)
+		}
+	}
+
+	for _, rule := range config.ResolutionRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("resolution_rules: %w", err)
+		}
+	}
+
+	if config.ReplaceChecks.DurationTolerance < 0 {
+		return errors.New("replace_checks.duration_tolerance must not be negative")
+	}
+
+	if err := config.KeepBoth.Validate(); err != nil {
+		return fmt.Errorf("keep_both: %w", err)
+	}
+
+	if config.Backup.MaxAge < 0 || config.Backup.MaxSize < 0 {
+		return errors.New("backup max_age and max_size must not be negative")
+	}
+
+	if config.DiskSpace.Action != "hold" && config.DiskSpace.Action != "fail" {
+		return fmt.Errorf("disk_space.action must be hold or fail, got %q", config.DiskSpace.Action)
+	}
+
+	if config.DiskSpace.TempReserve < 0 || config.DiskSpace.DestReserve < 0 {
+		return errors.New("disk_space reserves must not be negative")
+	}
+
+	if config.DiskSpace.EstimateMargin <= 0 {
+		return errors.New("disk_space.estimate_margin must be positive")
+	}
+
+	if config.DiskSpace.CheckInterval < 1 {
+		return errors.New("disk_space.check_interval must be at least 1")
+	}
+
+	if config.Retry.MaxAttempts < 1 {
+		return errors.New("retry.max_attempts must be at least 1")
+	}
+
+	if config.Retry.Backoff < 0 || config.Retry.MaxBackoff < 0 {
+		return errors.New("retry backoff must not be negative")
+	}
+
+	for i, window := range config.Schedule.Windows {
+		if err := window.Validate(); err != nil {
+			return fmt.Errorf("schedule.windows[%d]: %w", i, err)
+		}
+	}
+
+	if config.Schedule.MaxLoad < 0 || config.Schedule.MaxCPU < 0 {
+		return errors.New("schedule max_load and max_cpu must not be negative")
+	}
+
+	if config.Schedule.CheckInterval < 1 {
+		return errors.New("schedule.check_interval must be at least 1")
+	}
+
+	if config.TaskLogs.Dir != "" && config.TaskLogs.MaxSize < 1 {
+		return errors.New("task_logs.max_size must be at least 1")
+	}
+
+	if config.TaskLogs.MaxAge < 0 {
+		return errors.New("task_logs.max_age must not be negative")
+	}
+
+	if err := config.Webhooks.Validate(); err != nil {
+		return fmt.Errorf("webhooks: %w", err)
+	}
+
 	if config.TempDir != "" {
 		info, err := os.Stat(config.TempDir)
 		if err != nil {
@@ -3,6 +3,7 @@ package config
 import "github.com/royalcat/easy-transcoder/internal/transcoding"
 
 var DefaultConfig = Config{
+	DBPath: "easy-transcoder.db",
 	Profiles: []transcoding.Profile{
 		{
 			Name: "H264 Ultra Fast",
@@ -21,6 +22,37 @@ var DefaultConfig = Config{
 			},
 		},
 	},
+	MaxConcurrentTasks: 1,
+	ReplaceChecks: ReplaceCheckConfig{
+		DurationTolerance: 2,
+	},
+	KeepBoth: KeepBothConfig{
+		Template: "{dir}/{stem}.{profile}.{ext}",
+	},
+	Preserve: PreserveConfig{
+		Ownership: true,
+		Times:     true,
+	},
+	DiskSpace: DiskSpaceConfig{
+		TempReserve:    1 << 30,
+		DestReserve:    1 << 30,
+		EstimateMargin: 1.2,
+		Action:         "hold",
+		CheckInterval:  60,
+	},
+	Retry: RetryConfig{
+		MaxAttempts: 1,
+		Backoff:     30,
+		MaxBackoff:  600,
+	},
+	Schedule: ScheduleConfig{
+		CheckInterval: 30,
+	},
+	TaskLogs: TaskLogConfig{
+		Dir:     "task-logs",
+		MaxSize: 1 << 20,
+		MaxAge:  30,
+	},
 	Logging: LogConfig{
 		Level:  "info",
 		Format: "text",
@@ -29,4 +61,12 @@ var DefaultConfig = Config{
 		HeartbeatTimeout:  30,
 		HeartbeatInterval: 10,
 	},
+	Webhooks: WebhooksConfig{
+		ProgressStep: 25,
+		MaxAttempts:  5,
+		Backoff:      10,
+		MaxBackoff:   600,
+		Timeout:      10,
+		LogSize:      200,
+	},
 }
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// KeepBothConfig configures where the "keep both" resolution saves an output
+// next to the kept original.
+type KeepBothConfig struct {
+	// Template is the path of the new file. Placeholders:
+	//   {dir}     directory of the input
+	//   {rel_dir} directory of the input relative to SourceRoot, for a mirror tree
+	//   {stem}    file name of the input without extension
+	//   {ext}     extension of the output without the dot
+	//   {profile} name of the profile
+	Template string `koanf:"template"`
+
+	// SourceRoot is the root of the inputs {rel_dir} is relative to.
+	SourceRoot string `koanf:"source_root"`
+}
+
+var placeholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Validate checks the placeholders of the template.
+func (c KeepBothConfig) Validate() error {
+	if !strings.Contains(c.Template, "{stem}") {
+		return errors.New("template must contain {stem}")
+	}
+	if strings.Contains(c.Template, "{rel_dir}") && c.SourceRoot == "" {
+		return errors.New("{rel_dir} requires source_root")
+	}
+	for _, placeholder := range placeholderRe.FindAllString(c.Template, -1) {
+		switch placeholder {
+		case "{dir}", "{rel_dir}", "{stem}", "{ext}", "{profile}":
+		default:
+			return fmt.Errorf("unknown placeholder %s", placeholder)
+		}
+	}
+	return nil
+}
+
+// Path expands the template for an input, the profile it was transcoded
+// with and the extension of the output (without the dot).
+func (c KeepBothConfig) Path(input, profile, ext string) (string, error) {
+	dir := filepath.Dir(input)
+	stem := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+
+	relDir := ""
+	if strings.Contains(c.Template, "{rel_dir}") {
+		rel, err := filepath.Rel(c.SourceRoot, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("input %s is outside of source_root %s", input, c.SourceRoot)
+		}
+		relDir = rel
+	}
+
+	// A profile name may contain anything, keep it within one path element
+	profile = strings.ReplaceAll(profile, string(filepath.Separator), "_")
+
+	path := strings.NewReplacer(
+		"{dir}", dir,
+		"{rel_dir}", relDir,
+		"{stem}", stem,
+		"{ext}", ext,
+		"{profile}", profile,
+	).Replace(c.Template)
+	return filepath.Clean(path), nil
+}
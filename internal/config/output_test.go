@@ -0,0 +1,100 @@
+package config
+
+import "testing"
+
+func TestKeepBothConfigPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  KeepBothConfig
+		input   string
+		profile string
+		ext     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "default template",
+			config:  KeepBothConfig{Template: "{dir}/{stem}.{profile}.{ext}"},
+			input:   "/media/movies/Movie (2020).mkv",
+			profile: "x265",
+			ext:     "mkv",
+			want:    "/media/movies/Movie (2020).x265.mkv",
+		},
+		{
+			name:    "other extension",
+			config:  KeepBothConfig{Template: "{dir}/{stem}.{ext}"},
+			input:   "/media/clip.avi",
+			profile: "x265",
+			ext:     "mp4",
+			want:    "/media/clip.mp4",
+		},
+		{
+			name:    "profile kept in one element",
+			config:  KeepBothConfig{Template: "{dir}/{stem}.{profile}.{ext}"},
+			input:   "/media/clip.mkv",
+			profile: "hevc/small",
+			ext:     "mkv",
+			want:    "/media/clip.hevc_small.mkv",
+		},
+		{
+			name:   "mirror tree",
+			config: KeepBothConfig{Template: "/transcoded/{rel_dir}/{stem}.{ext}", SourceRoot: "/media"},
+			input:  "/media/shows/Show/S01E01.mkv",
+			ext:    "mkv",
+			want:   "/transcoded/shows/Show/S01E01.mkv",
+		},
+		{
+			name:   "mirror tree root",
+			config: KeepBothConfig{Template: "/transcoded/{rel_dir}/{stem}.{ext}", SourceRoot: "/media/"},
+			input:  "/media/clip.mkv",
+			ext:    "mkv",
+			want:   "/transcoded/clip.mkv",
+		},
+		{
+			name:    "outside source root",
+			config:  KeepBothConfig{Template: "/transcoded/{rel_dir}/{stem}.{ext}", SourceRoot: "/media"},
+			input:   "/other/clip.mkv",
+			ext:     "mkv",
+			wantErr: true,
+		},
+		{
+			name:    "sibling of source root",
+			config:  KeepBothConfig{Template: "/transcoded/{rel_dir}/{stem}.{ext}", SourceRoot: "/media"},
+			input:   "/media2/clip.mkv",
+			ext:     "mkv",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.Path(tt.input, tt.profile, tt.ext)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Path() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Path() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepBothConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  KeepBothConfig
+		wantErr bool
+	}{
+		{"default", KeepBothConfig{Template: "{dir}/{stem}.{profile}.{ext}"}, false},
+		{"mirror tree", KeepBothConfig{Template: "/out/{rel_dir}/{stem}.{ext}", SourceRoot: "/media"}, false},
+		{"missing stem", KeepBothConfig{Template: "{dir}/output.{ext}"}, true},
+		{"rel_dir without source root", KeepBothConfig{Template: "/out/{rel_dir}/{stem}.{ext}"}, true},
+		{"unknown placeholder", KeepBothConfig{Template: "{dir}/{stem}.{date}.{ext}"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
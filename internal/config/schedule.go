@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig restricts when the local worker starts new tasks.
+// Tasks already running are not interrupted.
+type ScheduleConfig struct {
+	// Windows are the times new tasks may start. When empty, any time is allowed.
+	Windows []ScheduleWindow `koanf:"windows"`
+
+	// MaxLoad is the highest 1-minute system load average at which a
+	// new task starts, 0 disables the check.
+	MaxLoad float64 `koanf:"max_load"`
+
+	// MaxCPU is the highest system-wide CPU usage in percent at which a
+	// new task starts, 0 disables the check.
+	MaxCPU float64 `koanf:"max_cpu"`
+
+	// CheckInterval is the number of seconds between checks while the
+	// queue is held. With MaxLoad or MaxCPU, it is also the least time
+	// between two starts, so each check sees the load of the last start.
+	CheckInterval int `koanf:"check_interval"`
+}
+
+// ScheduleWindow is a daily time range, e.g. 22:00 to 06:00. A window whose
+// end is before its start runs past midnight into the next day.
+type ScheduleWindow struct {
+	// Days the window starts on (mon, tue, ...). Empty means every day.
+	Days  []string `koanf:"days"`
+	Start string   `koanf:"start"`
+	End   string   `koanf:"end"`
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Validate checks the day names and the start and end times.
+func (w ScheduleWindow) Validate() error {
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, strings.ToLower(day)) {
+			return fmt.Errorf("unknown day %q, expected one of %s", day, strings.Join(weekdays, ", "))
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	return nil
+}
+
+// Contains reports whether t falls into the window, in t's location.
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	if start <= end {
+		return w.onDay(today) && now >= start && now < end
+	}
+	// The window runs past midnight
+	return (w.onDay(today) && now >= start) || (w.onDay(yesterday) && now < end)
+}
+
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(w.Days, func(d string) bool {
+		return strings.ToLower(d) == weekdays[day]
+	})
+}
+
+// parseClock parses a "15:04" time of day into the duration since midnight.
+// "24:00" is accepted as the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
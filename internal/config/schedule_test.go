@@ -0,0 +1,75 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowContains(t *testing.T) {
+	// 2026-01-05 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2026, time.January, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	const mon, tue, fri, sat, sun = 5, 6, 9, 10, 11
+
+	night := ScheduleWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "06:00"}
+	weekend := ScheduleWindow{Days: []string{"Sat", "SUN"}, Start: "00:00", End: "24:00"}
+	daily := ScheduleWindow{Start: "09:30", End: "17:00"}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		time   time.Time
+		want   bool
+	}{
+		{"daily inside", daily, at(tue, "12:00"), true},
+		{"daily at start", daily, at(sat, "09:30"), true},
+		{"daily before start", daily, at(tue, "09:29"), false},
+		{"daily at end", daily, at(tue, "17:00"), false},
+		{"night evening", night, at(mon, "23:00"), true},
+		{"night past midnight", night, at(tue, "05:59"), true},
+		{"night at end", night, at(tue, "06:00"), false},
+		{"night daytime", night, at(tue, "12:00"), false},
+		{"night started friday", night, at(sat, "03:00"), true},
+		{"night not started sunday", night, at(mon, "03:00"), false},
+		{"night saturday evening", night, at(sat, "23:00"), false},
+		{"weekend whole day", weekend, at(sun, "23:59"), true},
+		{"weekend midnight", weekend, at(sat, "00:00"), true},
+		{"weekend weekday", weekend, at(fri, "12:00"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if got := tt.window.Contains(tt.time); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.time.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleWindowValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  ScheduleWindow
+		wantErr bool
+	}{
+		{"valid", ScheduleWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, false},
+		{"end of day", ScheduleWindow{Start: "00:00", End: "24:00"}, false},
+		{"unknown day", ScheduleWindow{Days: []string{"monday"}, Start: "22:00", End: "06:00"}, true},
+		{"invalid start", ScheduleWindow{Start: "25:00", End: "06:00"}, true},
+		{"missing end", ScheduleWindow{Start: "22:00"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
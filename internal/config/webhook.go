@@ -0,0 +1,75 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// WebhooksConfig configures the webhooks task lifecycle events are posted to.
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpoint `koanf:"endpoints"`
+
+	// ProgressStep is the percentage a running task progresses between two
+	// task.progress events, e.g. 25 sends them at 25, 50 and 75 percent.
+	// 0 disables them.
+	ProgressStep int `koanf:"progress_step"`
+
+	// MaxAttempts is the number of times a delivery is tried before it is
+	// recorded as failed.
+	MaxAttempts int `koanf:"max_attempts"`
+
+	// Backoff is the delay in seconds before the first retry of a delivery,
+	// it doubles with every further retry up to MaxBackoff.
+	Backoff    int `koanf:"backoff"`
+	MaxBackoff int `koanf:"max_backoff"`
+
+	// Timeout is the number of seconds a delivery attempt may take.
+	Timeout int `koanf:"timeout"`
+
+	// LogSize is the number of deliveries kept in the delivery log.
+	LogSize int `koanf:"log_size"`
+}
+
+// WebhookEndpoint is a URL task lifecycle events are posted to.
+type WebhookEndpoint struct {
+	URL string `koanf:"url"`
+
+	// Secret is the key of the HMAC-SHA256 signature of every payload,
+	// sent in the X-Easy-Transcoder-Signature header. When empty, payloads
+	// are not signed.
+	Secret string `koanf:"secret"`
+
+	// Events are the events posted to the endpoint, e.g. task.completed.
+	// When empty, every event is posted.
+	Events []string `koanf:"events"`
+}
+
+// Validate checks the endpoints and the delivery settings.
+func (c WebhooksConfig) Validate() error {
+	for i, endpoint := range c.Endpoints {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return fmt.Errorf("endpoints[%d]: %w", i, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("endpoints[%d]: url must be http or https, got %q", i, endpoint.URL)
+		}
+	}
+	if c.ProgressStep < 0 || c.ProgressStep > 99 {
+		return errors.New("progress_step must be between 0 and 99")
+	}
+	if c.MaxAttempts < 1 {
+		return errors.New("max_attempts must be at least 1")
+	}
+	if c.Backoff < 0 || c.MaxBackoff < 0 {
+		return errors.New("backoff must not be negative")
+	}
+	if c.Timeout < 1 {
+		return errors.New("timeout must be at least 1")
+	}
+	if c.LogSize < 0 {
+		return errors.New("log_size must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package events implements the in-process event bus the processor and the
+// worker manager publish their state changes on.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Bus delivers published events to every subscriber. The zero value is
+// ready to use.
+//
+// Publish never blocks: when a subscriber's buffer is full the event is
+// dropped for it and the subscription is marked as lagged, so a slow
+// subscriber (e.g. a stalled SSE client) never holds up the publisher.
+type Bus[T any] struct {
+	mu   sync.RWMutex
+	subs map[*Subscription[T]]struct{}
+}
+
+// Subscription receives the events published after Subscribe.
+type Subscription[T any] struct {
+	C <-chan T
+
+	c      chan T
+	bus    *Bus[T]
+	lagged atomic.Bool
+	once   sync.Once
+}
+
+// Subscribe returns a subscription buffering up to buffer events.
+// Close it when done.
+func (b *Bus[T]) Subscribe(buffer int) *Subscription[T] {
+	c := make(chan T, buffer)
+	sub := &Subscription[T]{C: c, c: c, bus: b}
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = map[*Subscription[T]]struct{}{}
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Publish sends the event to every subscriber.
+func (b *Bus[T]) Publish(event T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.c <- event:
+		default:
+			sub.lagged.Store(true)
+		}
+	}
+}
+
+// Lagged reports whether events were dropped since the last call, in which
+// case the subscriber should resynchronize its state.
+func (s *Subscription[T]) Lagged() bool {
+	return s.lagged.Swap(false)
+}
+
+// Close unsubscribes and closes C.
+func (s *Subscription[T]) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.c)
+	})
+}
@@ -0,0 +1,52 @@
+package events
+
+import "sync"
+
+// Queue is an unbounded FIFO queue. Push never blocks and never drops, for
+// consumers that must see every event, unlike the subscribers of a Bus.
+type Queue[T any] struct {
+	mu    sync.Mutex
+	items []T
+	ready chan struct{} // Holds a token after a push
+}
+
+// NewQueue returns an empty queue.
+func NewQueue[T any]() *Queue[T] {
+	return &Queue[T]{ready: make(chan struct{}, 1)}
+}
+
+// Push appends an item.
+func (q *Queue[T]) Push(item T) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop removes and returns the first item, waiting for one if the queue is empty.
+func (q *Queue[T]) Pop() T {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			item := q.items[0]
+			var zero T
+			q.items[0] = zero
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return item
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// Len returns the number of queued items.
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
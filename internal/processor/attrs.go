@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+
+	"golang.org/x/sys/unix"
+)
+
+// preserveAll keeps every attribute, for copies that must be faithful like backups.
+var preserveAll = config.PreserveConfig{Ownership: true, Times: true, XAttrs: true, ACLs: true}
+
+// fileAttrs are the attributes of an original its replacement takes over.
+type fileAttrs struct {
+	mode         fs.FileMode
+	uid, gid     int
+	atime, mtime time.Time
+	xattrs       map[string][]byte
+}
+
+// isACLXattr reports whether an extended attribute holds a POSIX ACL.
+func isACLXattr(name string) bool {
+	return strings.HasPrefix(name, "system.posix_acl_")
+}
+
+// readAttrs reads the attributes of a file, the extended attributes only
+// when withXattrs is set. Extended attributes that can't be read are
+// returned as warnings.
+func readAttrs(path string, withXattrs bool) (fileAttrs, []string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileAttrs{}, nil, err
+	}
+
+	attrs := fileAttrs{
+		mode:  info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		mtime: info.ModTime(),
+		atime: info.ModTime(),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		attrs.uid, attrs.gid = int(st.Uid), int(st.Gid)
+		attrs.atime = time.Unix(st.Atim.Unix())
+	}
+
+	if !withXattrs {
+		return attrs, nil, nil
+	}
+
+	var warnings []string
+	names, err := listXattrs(path)
+	if err != nil {
+		if !errors.Is(err, unix.ENOTSUP) {
+			warnings = append(warnings, fmt.Sprintf("extended attributes not read: %s", err))
+		}
+		return attrs, warnings, nil
+	}
+	attrs.xattrs = make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("extended attribute %s not read: %s", name, err))
+			continue
+		}
+		attrs.xattrs[name] = value
+	}
+	return attrs, warnings, nil
+}
+
+// applyAttrs sets the attributes selected by preserve on a file. The
+// permissions are always set. Attributes that couldn't be set are
+// returned as warnings.
+func applyAttrs(path string, attrs fileAttrs, preserve config.PreserveConfig) []string {
+	var warnings []string
+
+	// Changing the owner clears the setuid and setgid bits, so it goes first
+	if preserve.Ownership {
+		if err := os.Lchown(path, attrs.uid, attrs.gid); err != nil {
+			warnings = append(warnings, fmt.Sprintf("ownership %d:%d not preserved: %s", attrs.uid, attrs.gid, unwrapPathError(err)))
+		}
+	}
+
+	if err := os.Chmod(path, attrs.mode); err != nil {
+		warnings = append(warnings, fmt.Sprintf("permissions %s not preserved: %s", attrs.mode, unwrapPathError(err)))
+	}
+
+	for name, value := range attrs.xattrs {
+		if isACLXattr(name) && !preserve.ACLs || !isACLXattr(name) && !preserve.XAttrs {
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			warnings = append(warnings, fmt.Sprintf("extended attribute %s not preserved: %s", name, err))
+		}
+	}
+
+	// Last, writing the other attributes may touch the times
+	if preserve.Times {
+		if err := os.Chtimes(path, attrs.atime, attrs.mtime); err != nil {
+			warnings = append(warnings, fmt.Sprintf("timestamps not preserved: %s", unwrapPathError(err)))
+		}
+	}
+
+	return warnings
+}
+
+// listXattrs returns the names of the extended attributes of a file.
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range strings.SplitSeq(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of an extended attribute of a file.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// unwrapPathError drops the operation and path of an error, warnings name the attribute instead.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAttrsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "original.mkv")
+	writeFile(t, src, "original")
+	if err := os.Chmod(src, 0640); err != nil {
+		t.Fatal(err)
+	}
+	atime, mtime := time.Unix(1_600_000_000, 0), time.Unix(1_700_000_000, 0)
+	if err := os.Chtimes(src, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	// Not every filesystem has user extended attributes
+	withXattrs := true
+	if err := unix.Lsetxattr(src, "user.easy_transcoder", []byte("kept"), 0); err != nil {
+		if !errors.Is(err, unix.ENOTSUP) && !errors.Is(err, unix.EPERM) {
+			t.Fatal(err)
+		}
+		withXattrs = false
+	}
+
+	tests := []struct {
+		name      string
+		preserve  config.PreserveConfig
+		wantTimes bool
+		wantXattr bool
+	}{
+		{"all", preserveAll, true, withXattrs},
+		{"permissions only", config.PreserveConfig{}, false, false},
+		{"times", config.PreserveConfig{Times: true}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs, warnings, err := readAttrs(src, tt.preserve.XAttrs)
+			if err != nil {
+				t.Fatalf("readAttrs() error = %v", err)
+			}
+			if len(warnings) > 0 {
+				t.Errorf("readAttrs() warnings = %v", warnings)
+			}
+
+			dst := filepath.Join(t.TempDir(), "output.mkv")
+			writeFile(t, dst, "output")
+			if warnings := applyAttrs(dst, attrs, tt.preserve); len(warnings) > 0 {
+				t.Errorf("applyAttrs() warnings = %v", warnings)
+			}
+
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode() & fs.ModePerm; mode != 0640 {
+				t.Errorf("mode = %s, want -rw-r-----", mode)
+			}
+			if got := info.ModTime().Equal(mtime); got != tt.wantTimes {
+				t.Errorf("mtime = %s, preserved %v, want %v", info.ModTime(), got, tt.wantTimes)
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				if gotAtime := time.Unix(st.Atim.Unix()); gotAtime.Equal(atime) != tt.wantTimes {
+					t.Errorf("atime = %s, want preserved %v", gotAtime, tt.wantTimes)
+				}
+				if int(st.Uid) != attrs.uid || int(st.Gid) != attrs.gid {
+					t.Errorf("owner = %d:%d, want %d:%d", st.Uid, st.Gid, attrs.uid, attrs.gid)
+				}
+			}
+
+			value, err := getXattr(dst, "user.easy_transcoder")
+			if tt.wantXattr && (err != nil || string(value) != "kept") {
+				t.Errorf("xattr = %q, %v, want kept", value, err)
+			}
+			if !tt.wantXattr && err == nil {
+				t.Errorf("xattr = %q, want none", value)
+			}
+		})
+	}
+}
+
+func TestReadAttrsMissing(t *testing.T) {
+	if _, _, err := readAttrs(filepath.Join(t.TempDir(), "missing"), true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readAttrs() error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// backupMetaFile is the metadata written next to every backed up original.
+	backupMetaFile = "backup.json"
+
+	// backupPruneInterval is how often the retention of the backups is applied.
+	backupPruneInterval = time.Hour
+)
+
+// backupMeta describes a backed up original. Every backup is a directory
+// in the backup dir holding the original and this metadata as backup.json.
+type backupMeta struct {
+	TaskID     uint64    `json:"task_id"`
+	Original   string    `json:"original"` // Path the original was replaced at
+	Output     string    `json:"output"`   // Path of the output replacing it
+	Profile    string    `json:"profile"`
+	Size       int64     `json:"size"`
+	BackedUpAt time.Time `json:"backed_up_at"`
+}
+
+// backupOriginal moves the input of a task into the backup dir before the
+// output replaces it. The input is renamed when the backup dir is on the
+// same filesystem and copied otherwise, so it may still exist afterwards.
+func (p *Processor) backupOriginal(task *task, output string) (string, error) {
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+
+	info, err := os.Stat(task.Input)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(p.config.Backup.Dir, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(p.config.Backup.Dir, fmt.Sprintf("%d-", task.ID))
+	if err != nil {
+		return "", err
+	}
+
+	meta, err := json.MarshalIndent(backupMeta{
+		TaskID:     task.ID,
+		Original:   task.Input,
+		Output:     output,
+		Profile:    task.Preset,
+		Size:       info.Size(),
+		BackedUpAt: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupMetaFile), meta, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	backup := filepath.Join(dir, filepath.Base(task.Input))
+	if err := moveFile(task.Input, backup); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return backup, nil
+}
+
+// restoreBackup puts a backed up original back in place after a failed replacement.
+func (p *Processor) restoreBackup(backup, original string) error {
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+
+	if _, err := os.Lstat(original); err == nil {
+		// The original was copied and is still in place
+		return os.RemoveAll(filepath.Dir(backup))
+	}
+	if err := moveFile(backup, original); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Dir(backup))
+}
+
+// moveFile renames src to dst, or copies it with all its attributes when
+// they are on different filesystems. A copied src is left in place.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	attrs, _, err := readAttrs(src, true)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	// Best effort, what the filesystem of dst doesn't support is lost either way
+	applyAttrs(dst, attrs, preserveAll)
+	return nil
+}
+
+// UndoReplacement restores the backed up original of a replaced task
+// and removes the output that replaced it.
+func (p *Processor) UndoReplacement(taskID uint64) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", taskID)
+	}
+
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+
+	if task.status() != TaskStatusCompleted || task.Backup == "" {
+		return fmt.Errorf("task %d has no backup to restore", taskID)
+	}
+	if _, err := os.Stat(task.Backup); err != nil {
+		return fmt.Errorf("backup of task %d is gone: %w", taskID, err)
+	}
+
+	log := p.logger.With("task_id", taskID, "backup", task.Backup, "input", task.Input)
+	log.Info("undoing replacement")
+
+	// Rename the original back over the output, or copy it in place
+	// through a temporary file when the backup is on another filesystem
+	if err := os.Rename(task.Backup, task.Input); errors.Is(err, syscall.EXDEV) {
+		attrs, _, err := readAttrs(task.Backup, true)
+		if err != nil {
+			return fmt.Errorf("failed to restore the original: %w", err)
+		}
+		warnings, err := p.replaceFile(task.Backup, task.Input, attrs, preserveAll)
+		if err != nil {
+			return fmt.Errorf("failed to restore the original: %w", err)
+		}
+		for _, warning := range warnings {
+			log.Warn("attribute of the original not restored", "warning", warning)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to restore the original: %w", err)
+	}
+
+	if task.Output != "" && task.Output != task.Input {
+		// The output was saved under another name, the original doesn't replace it
+		if err := os.Remove(task.Output); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("failed to remove the output", "output", task.Output, "error", err)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Dir(task.Backup)); err != nil {
+		log.Warn("failed to remove the backup", "error", err)
+	}
+
+	p.logTask(task.ID, "replacement undone, restored the original %s", task.Input)
+	task.update(func() {
+		task.Backup = ""
+		task.Output = ""
+		task.Restored = true
+	})
+	task.changed()
+	return nil
+}
+
+// pruneBackupsLoop applies the retention of the backups periodically.
+func (p *Processor) pruneBackupsLoop() {
+	ticker := time.NewTicker(backupPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.pruneBackups()
+		<-ticker.C
+	}
+}
+
+// pruneBackups removes the backups older than max_age, then the oldest ones
+// until the rest fits into max_size.
+func (p *Processor) pruneBackups() {
+	cfg := p.config.Backup
+	if cfg.Dir == "" || (cfg.MaxAge == 0 && cfg.MaxSize == 0) {
+		return
+	}
+
+	p.backupMu.Lock()
+	defer p.backupMu.Unlock()
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.Error("failed to read backup directory", "dir", cfg.Dir, "error", err)
+		}
+		return
+	}
+
+	type backup struct {
+		dir  string
+		meta backupMeta
+	}
+	var backups []backup
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(cfg.Dir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, backupMetaFile))
+		if err != nil {
+			// Not a backup, or one still being written
+			continue
+		}
+		var meta backupMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			p.logger.Warn("invalid backup metadata", "dir", dir, "error", err)
+			continue
+		}
+		backups = append(backups, backup{dir: dir, meta: meta})
+		total += meta.Size
+	}
+	slices.SortFunc(backups, func(a, b backup) int {
+		return a.meta.BackedUpAt.Compare(b.meta.BackedUpAt)
+	})
+
+	maxAge := time.Duration(cfg.MaxAge) * 24 * time.Hour
+	for _, b := range backups {
+		expired := cfg.MaxAge > 0 && time.Since(b.meta.BackedUpAt) > maxAge
+		oversize := cfg.MaxSize > 0 && total > int64(cfg.MaxSize)
+		if !expired && !oversize {
+			// Sorted by age, the rest is newer and fits
+			break
+		}
+
+		p.logger.Info("removing backup", "dir", b.dir, "task_id", b.meta.TaskID, "original", b.meta.Original)
+		if err := os.RemoveAll(b.dir); err != nil {
+			p.logger.Error("failed to remove backup", "dir", b.dir, "error", err)
+			continue
+		}
+		total -= b.meta.Size
+		p.backupRemoved(b.meta.TaskID, b.dir)
+	}
+}
+
+// backupRemoved clears the backup of a task once it was removed.
+func (p *Processor) backupRemoved(taskID uint64, dir string) {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok || task.Backup == "" || !strings.HasPrefix(task.Backup, dir+string(filepath.Separator)) {
+		return
+	}
+	p.logTask(taskID, "backup of the original removed by the retention")
+	task.update(func() { task.Backup = "" })
+	task.changed()
+}
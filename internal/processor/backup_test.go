@@ -0,0 +1,233 @@
+package processor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+// readFile returns the content of a file, empty when it can't be read.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, _ := os.ReadFile(path)
+	return string(data)
+}
+
+func TestBackupReplacement(t *testing.T) {
+	fakeFFprobe(t)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "media", "movie.mkv")
+	output := filepath.Join(dir, "temp", "movie.mkv")
+	writeMedia(t, input, "600.0", "video", "audio")
+	writeMedia(t, output, "600.0", "video", "audio")
+	original, transcoded := readFile(t, input), readFile(t, output)
+
+	p := newTestProcessor(t, config.Config{Backup: config.BackupConfig{Dir: filepath.Join(dir, "backup")}})
+	task := addWaitingTask(p, input, output)
+
+	if err := p.ResolveTask(task.ID, ResolutionReplace, false); err != nil {
+		t.Fatalf("ResolveTask() error = %v", err)
+	}
+	state := waitStatus(t, p, task.ID, TaskStatusReplacing)
+	if state.Status != TaskStatusCompleted || state.Backup == "" {
+		t.Fatalf("status = %s (%v), backup %q, want completed with a backup", state.Status, state.Error, state.Backup)
+	}
+	if got := readFile(t, input); got != transcoded {
+		t.Errorf("input = %q, want the output", got)
+	}
+	if got := readFile(t, state.Backup); got != original {
+		t.Errorf("backup = %q, want the original", got)
+	}
+	var meta backupMeta
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(filepath.Dir(state.Backup), backupMetaFile))), &meta); err != nil {
+		t.Fatalf("backup metadata: %v", err)
+	}
+	if meta.TaskID != task.ID || meta.Original != input || meta.Size != int64(len(original)) {
+		t.Errorf("backup metadata = %+v", meta)
+	}
+
+	if err := p.UndoReplacement(task.ID); err != nil {
+		t.Fatalf("UndoReplacement() error = %v", err)
+	}
+	if got := readFile(t, input); got != original {
+		t.Errorf("input after undo = %q, want the original", got)
+	}
+	if _, err := os.Stat(filepath.Dir(state.Backup)); !os.IsNotExist(err) {
+		t.Errorf("backup dir after undo: %v", err)
+	}
+	if state := p.GetTask(task.ID); state.Backup != "" || !state.Restored {
+		t.Errorf("task after undo = backup %q, restored %v", state.Backup, state.Restored)
+	}
+	if err := p.UndoReplacement(task.ID); err == nil {
+		t.Error("second UndoReplacement() succeeded")
+	}
+	if err := p.UndoReplacement(99); err == nil {
+		t.Error("UndoReplacement() of an unknown task succeeded")
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "movie.mkv")
+	p := newTestProcessor(t, config.Config{Backup: config.BackupConfig{Dir: filepath.Join(dir, "backup")}})
+	task := newTask(1, input, "x265", 0)
+
+	tests := []struct {
+		name   string
+		copied bool // The original is still in place, as when copied across filesystems
+	}{
+		{"moved", false},
+		{"copied", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFile(t, input, "original")
+
+			backup, err := p.backupOriginal(task, input)
+			if err != nil {
+				t.Fatalf("backupOriginal() error = %v", err)
+			}
+			if _, err := os.Stat(input); !os.IsNotExist(err) {
+				t.Fatalf("original after the backup: %v", err)
+			}
+			if got := readFile(t, backup); got != "original" {
+				t.Fatalf("backup = %q, want the original", got)
+			}
+			if tt.copied {
+				writeFile(t, input, "original")
+			}
+
+			if err := p.restoreBackup(backup, input); err != nil {
+				t.Fatalf("restoreBackup() error = %v", err)
+			}
+			if got := readFile(t, input); got != "original" {
+				t.Errorf("restored = %q, want the original", got)
+			}
+			if _, err := os.Stat(filepath.Dir(backup)); !os.IsNotExist(err) {
+				t.Errorf("backup dir after restoring: %v", err)
+			}
+		})
+	}
+
+	if _, err := p.backupOriginal(newTask(2, filepath.Join(dir, "missing.mkv"), "x265", 0), input); err == nil {
+		t.Error("backupOriginal() of a missing input succeeded")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{Backup: config.BackupConfig{Dir: dir, MaxAge: 30, MaxSize: 250}})
+
+	// Backed up the given number of days ago
+	backup := func(name string, taskID uint64, days int, size int64) string {
+		path := filepath.Join(dir, name)
+		data, err := json.Marshal(backupMeta{TaskID: taskID, Original: "/media/" + name, Size: size, BackedUpAt: time.Now().AddDate(0, 0, -days)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(path, backupMetaFile), string(data))
+		writeFile(t, filepath.Join(path, name), "original")
+		return path
+	}
+
+	// A task whose backup is pruned forgets it
+	task := addWaitingTask(p, "/media/oldest", "")
+	task.Status = TaskStatusCompleted
+
+	expired := backup("expired", 10, 31, 10)
+	oldest := backup("oldest", task.ID, 20, 100)
+	older := backup("older", 11, 10, 100)
+	newest := backup("newest", 12, 1, 100)
+	writeFile(t, filepath.Join(dir, "partial", "movie.mkv"), "being written")
+	task.Backup = filepath.Join(oldest, "oldest")
+
+	p.pruneBackups()
+
+	tests := []struct {
+		dir  string
+		kept bool
+	}{
+		{expired, false},
+		{oldest, false}, // Over max_size
+		{older, true},
+		{newest, true},
+		{filepath.Join(dir, "partial"), true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(tt.dir)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s kept = %v, want %v", filepath.Base(tt.dir), kept, tt.kept)
+		}
+	}
+	if state := p.GetTask(task.ID); state.Backup != "" {
+		t.Errorf("backup of the task = %q after pruning it", state.Backup)
+	}
+}
+
+func TestReplacementBackupFailure(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "media", "movie.mkv")
+	output := filepath.Join(dir, "temp", "movie.mkv")
+	writeFile(t, input, "original")
+	writeFile(t, output, "transcoded")
+	// A file where the backup dir should be, so the backup fails after the output was staged
+	writeFile(t, filepath.Join(dir, "backup"), "")
+
+	p := newTestProcessor(t, config.Config{Backup: config.BackupConfig{Dir: filepath.Join(dir, "backup")}})
+	task := addWaitingTask(p, input, output)
+
+	if err := p.ResolveTask(task.ID, ResolutionReplace, true); err != nil {
+		t.Fatalf("ResolveTask() error = %v", err)
+	}
+	if state := waitStatus(t, p, task.ID, TaskStatusReplacing); state.Status != TaskStatusFailed {
+		t.Fatalf("status = %s, want failed", state.Status)
+	}
+	if got := readFile(t, input); got != "original" {
+		t.Errorf("input = %q, want the original", got)
+	}
+	entries, err := os.ReadDir(filepath.Dir(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("media dir holds %d files, want the staged output removed", len(entries))
+	}
+}
+
+func TestCommitStaged(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{})
+	src := filepath.Join(dir, "src.mkv")
+	writeFile(t, src, "transcoded")
+
+	dst := filepath.Join(dir, "movie.mkv")
+	staged, _, err := p.stageFile(src, dst, fileAttrs{}, config.PreserveConfig{})
+	if err != nil {
+		t.Fatalf("stageFile() error = %v", err)
+	}
+	if err := p.commitStaged(staged, dst); err != nil {
+		t.Fatalf("commitStaged() error = %v", err)
+	}
+	if got := readFile(t, dst); got != "transcoded" {
+		t.Errorf("dst = %q, want the staged file", got)
+	}
+
+	// A directory in the way fails the rename, the staged file is removed
+	blocked := filepath.Join(dir, "blocked.mkv")
+	writeFile(t, filepath.Join(blocked, "file"), "")
+	staged, _, err = p.stageFile(src, blocked, fileAttrs{}, config.PreserveConfig{})
+	if err != nil {
+		t.Fatalf("stageFile() error = %v", err)
+	}
+	if err := p.commitStaged(staged, blocked); err == nil {
+		t.Error("commitStaged() over a directory succeeded")
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("staged file after a failed rename: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+	"github.com/shirou/gopsutil/v4/disk"
+
+	"golang.org/x/sys/unix"
+)
+
+// errInsufficientSpace is wrapped by the errors of the disk space checks.
+var errInsufficientSpace = errors.New("not enough disk space")
+
+// diskSpaceHold is why the disk space guard holds back a queued task.
+type diskSpaceHold struct {
+	reason string
+	until  time.Time // The task isn't checked again before
+}
+
+// popAdmissible takes the first queued task accepted by accept (nil accepts
+// all) that the disk space guard admits. Tasks held by the guard are skipped
+// and keep their place in the queue, a task failed by it leaves the queue.
+// Returns nil when no task is left.
+func (p *Processor) popAdmissible(accept func(t *task) bool) *task {
+	for {
+		task := p.queue.peekFunc(func(t *task) bool {
+			return !p.diskSpaceHeld(t.ID) && (accept == nil || accept(t))
+		})
+		if task == nil {
+			return nil
+		}
+		if !p.admitDiskSpace(task) {
+			continue
+		}
+		if p.queue.tryTake(task.ID) {
+			return task
+		}
+		// Taken by another slot or a remote worker meanwhile
+	}
+}
+
+// admitDiskSpace applies the disk space guard to a queued task. It returns
+// false when the task may not start: it was failed and taken out of the
+// queue, or it is held until its next check.
+func (p *Processor) admitDiskSpace(task *task) bool {
+	cfg := p.config.DiskSpace
+	if !cfg.Enabled || task.cancelled.Load() {
+		return true
+	}
+
+	err := p.checkDiskSpace(task)
+	if err == nil {
+		p.diskSpaceMu.Lock()
+		_, held := p.diskSpaceHolds[task.ID]
+		delete(p.diskSpaceHolds, task.ID)
+		p.diskSpaceMu.Unlock()
+		if held {
+			p.logger.Info("enough disk space again", "task_id", task.ID)
+			p.events.Publish(Event{Kind: EventQueueChanged})
+		}
+		return true
+	}
+
+	if cfg.Action == "fail" {
+		if !p.queue.remove(task.ID) {
+			return false // Taken by another slot or a remote worker meanwhile
+		}
+		p.logger.Warn("task failed by the disk space guard", "task_id", task.ID, "error", err)
+		p.failTask(task, err)
+		return false
+	}
+
+	hold := diskSpaceHold{
+		reason: err.Error(),
+		until:  time.Now().Add(time.Duration(cfg.CheckInterval) * time.Second),
+	}
+	p.diskSpaceMu.Lock()
+	prev, held := p.diskSpaceHolds[task.ID]
+	if p.diskSpaceHolds == nil {
+		p.diskSpaceHolds = map[uint64]diskSpaceHold{}
+	}
+	p.diskSpaceHolds[task.ID] = hold
+	p.diskSpaceMu.Unlock()
+	if !held || prev.reason != hold.reason {
+		p.logger.Warn("task held by the disk space guard", "task_id", task.ID, "reason", hold.reason)
+		p.events.Publish(Event{Kind: EventQueueChanged})
+	}
+	return false
+}
+
+// diskSpaceHeld reports whether the disk space guard holds a task until its next check.
+func (p *Processor) diskSpaceHeld(taskID uint64) bool {
+	p.diskSpaceMu.Lock()
+	defer p.diskSpaceMu.Unlock()
+
+	hold, ok := p.diskSpaceHolds[taskID]
+	return ok && time.Now().Before(hold.until)
+}
+
+// waitDiskSpace blocks until the next check of a task held by the disk space guard.
+func (p *Processor) waitDiskSpace() {
+	p.diskSpaceMu.Lock()
+	var next time.Time
+	for _, hold := range p.diskSpaceHolds {
+		if next.IsZero() || hold.until.Before(next) {
+			next = hold.until
+		}
+	}
+	p.diskSpaceMu.Unlock()
+
+	time.Sleep(time.Until(next))
+}
+
+// DiskSpaceHold returns which tasks the disk space guard holds back and
+// why, or an empty string when it doesn't hold any. Holds of tasks that
+// left the queue meanwhile are dropped.
+func (p *Processor) DiskSpaceHold() string {
+	positions := p.queue.positions()
+
+	p.diskSpaceMu.Lock()
+	defer p.diskSpaceMu.Unlock()
+
+	var held []string
+	for _, id := range slices.Sorted(maps.Keys(p.diskSpaceHolds)) {
+		if _, ok := positions[id]; !ok {
+			delete(p.diskSpaceHolds, id)
+			continue
+		}
+		held = append(held, fmt.Sprintf("task %d, %s", id, p.diskSpaceHolds[id].reason))
+	}
+	return strings.Join(held, "; ")
+}
+
+// checkDiskSpace estimates the output of a task and checks that it fits
+// into the temp dir and, for a replacement, next to the input, keeping the
+// reserves free. Space the outputs of running tasks will still take is
+// accounted for.
+func (p *Processor) checkDiskSpace(task *task) error {
+	cfg := p.config.DiskSpace
+
+	probe, err := transcoding.Probe(task.Input)
+	if err != nil {
+		// Processing the task fails with the probe error
+		return nil
+	}
+	profile, err := p.getProfile(task.Preset).Render(probe)
+	if err != nil {
+		return nil
+	}
+	estimate := int64(float64(profile.EstimateSize(probe)) * cfg.EstimateMargin)
+	task.update(func() { task.estimate = estimate })
+
+	type volume struct {
+		path    string
+		need    int64
+		reserve int64
+	}
+	volumes := map[uint64]*volume{}
+	add := func(path string, need, reserve int64) error {
+		dev, err := deviceOf(path)
+		if err != nil {
+			return err
+		}
+		v, ok := volumes[dev]
+		if !ok {
+			v = &volume{path: path}
+			volumes[dev] = v
+		}
+		v.need += need
+		v.reserve = max(v.reserve, reserve)
+		return nil
+	}
+
+	tempDir := p.tempDir()
+	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := add(tempDir, task.estimate+p.pendingOutputs(task.ID), int64(cfg.TempReserve)); err != nil {
+		return err
+	}
+	if err := add(filepath.Dir(task.Input), task.estimate, int64(cfg.DestReserve)); err != nil {
+		return err
+	}
+
+	for _, v := range volumes {
+		free, _, err := diskSpace(v.path)
+		if err != nil {
+			return err
+		}
+		if free < v.need+v.reserve {
+			return fmt.Errorf("%w on %s: %s free, %s needed for an estimated output of %s and a reserve of %s",
+				errInsufficientSpace, v.path, humanize.Bytes(uint64(free)), humanize.Bytes(uint64(v.need+v.reserve)),
+				humanize.Bytes(uint64(task.estimate)), humanize.Bytes(uint64(v.reserve)))
+		}
+	}
+	return nil
+}
+
+// checkReplaceSpace checks that a replacement can write the output of a
+// task next to the input, keeping the destination reserve free.
+func (p *Processor) checkReplaceSpace(task *task, dst string) error {
+	cfg := p.config.DiskSpace
+	if !cfg.Enabled {
+		return nil
+	}
+
+	info, err := os.Stat(task.TempFile)
+	if err != nil {
+		return err
+	}
+	free, _, err := diskSpace(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if need := info.Size() + int64(cfg.DestReserve); free < need {
+		return fmt.Errorf("replacement refused, %w on %s: %s free, %s needed",
+			errInsufficientSpace, filepath.Dir(dst), humanize.Bytes(uint64(free)), humanize.Bytes(uint64(need)))
+	}
+	return nil
+}
+
+// pendingOutputs returns the space the outputs of the other running tasks
+// are still expected to take in the temp dir.
+func (p *Processor) pendingOutputs(taskID uint64) int64 {
+	p.tasksMu.RLock()
+	defer p.tasksMu.RUnlock()
+
+	var pending int64
+	for _, t := range p.tasks {
+		if t.ID == taskID || !t.IsActive() {
+			continue
+		}
+		t.mu.RLock()
+		estimate, tempFile := t.estimate, t.TempFile
+		t.mu.RUnlock()
+		if estimate == 0 {
+			continue
+		}
+		written := int64(0)
+		if info, err := os.Stat(tempFile); err == nil {
+			written = info.Size()
+		}
+		pending += max(0, estimate-written)
+	}
+	return pending
+}
+
+// DiskUsage is the free space of a filesystem used by the processor.
+type DiskUsage struct {
+	Label string // "temp" or the mount point of the inputs
+	Free  int64
+	Total int64
+}
+
+// DiskUsage returns the free space of the temp dir and of the filesystems
+// holding the inputs of the unfinished tasks.
+func (p *Processor) DiskUsage() []DiskUsage {
+	var usage []DiskUsage
+	seen := map[uint64]bool{}
+
+	if free, total, err := diskSpace(p.tempDir()); err == nil {
+		usage = append(usage, DiskUsage{Label: "temp", Free: free, Total: total})
+		if dev, err := deviceOf(p.tempDir()); err == nil {
+			seen[dev] = true
+		}
+	}
+
+	p.tasksMu.RLock()
+	var dirs []string
+	for _, t := range p.tasks {
+		if !t.IsFinished() {
+			dirs = append(dirs, filepath.Dir(t.Input))
+		}
+	}
+	p.tasksMu.RUnlock()
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+
+	var mounts []string
+	if partitions, err := disk.Partitions(true); err == nil {
+		for _, partition := range partitions {
+			mounts = append(mounts, partition.Mountpoint)
+		}
+	}
+
+	for _, dir := range dirs {
+		dev, err := deviceOf(dir)
+		if err != nil || seen[dev] {
+			continue
+		}
+		seen[dev] = true
+		if free, total, err := diskSpace(dir); err == nil {
+			usage = append(usage, DiskUsage{Label: mountPoint(mounts, dir), Free: free, Total: total})
+		}
+	}
+	return usage
+}
+
+// mountPoint returns the longest mount point containing path, or path itself.
+func mountPoint(mounts []string, path string) string {
+	best := ""
+	for _, mount := range mounts {
+		if (path == mount || strings.HasPrefix(path, strings.TrimSuffix(mount, "/")+"/")) && len(mount) > len(best) {
+			best = mount
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return best
+}
+
+// diskSpace returns the space available to unprivileged users and the total size of a filesystem.
+func diskSpace(path string) (int64, int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("failed to get free space of %s: %w", path, err)
+	}
+	return int64(stat.Bavail) * stat.Bsize, int64(stat.Blocks) * stat.Bsize, nil
+}
+
+// deviceOf returns the device of the filesystem holding path.
+func deviceOf(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device for %s", path)
+	}
+	return uint64(st.Dev), nil
+}
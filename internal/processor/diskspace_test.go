@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+// writeSizedMedia writes a ten minute media file probed by fakeFFprobe with
+// the given bit rate, which a profile without a bit rate target keeps.
+func writeSizedMedia(t *testing.T, path, bitRate string) {
+	t.Helper()
+	data, err := json.Marshal(transcoding.FFProbeData{
+		Format: transcoding.FFProbeFormat{Filename: path, Duration: "600", BitRate: bitRate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(data))
+}
+
+func TestPopAdmissible(t *testing.T) {
+	fakeFFprobe(t)
+
+	tests := []struct {
+		action string
+		want   TaskStatus // Of the task that doesn't fit
+		queued bool       // The task that doesn't fit keeps its place
+	}{
+		{"hold", TaskStatusPending, true},
+		{"fail", TaskStatusFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			dir := t.TempDir()
+			large, small := filepath.Join(dir, "large.mkv"), filepath.Join(dir, "small.mkv")
+			writeSizedMedia(t, large, "10000000000000000") // 750 PB
+			writeSizedMedia(t, small, "1000")              // 75 kB
+
+			p := newTestProcessor(t, config.Config{
+				Profiles:  []transcoding.Profile{{Name: "x265", Params: map[string]string{"c:v": "libx265"}}},
+				DiskSpace: config.DiskSpaceConfig{Enabled: true, EstimateMargin: 1, Action: tt.action, CheckInterval: 60},
+				Retry:     config.RetryConfig{MaxAttempts: 3},
+			})
+			largeID := p.AddTask(large, "x265", 0)
+			smallID := p.AddTask(small, "x265", 0)
+
+			// The task after the one that doesn't fit starts
+			if task := p.popAdmissible(nil); task == nil || task.ID != smallID {
+				t.Fatalf("popAdmissible() = %v, want task %d", task, smallID)
+			}
+			if task := p.popAdmissible(nil); task != nil {
+				t.Fatalf("popAdmissible() = task %d, want none", task.ID)
+			}
+
+			state := p.GetTask(largeID)
+			if state.Status != tt.want {
+				t.Errorf("status = %s, want %s", state.Status, tt.want)
+			}
+			if _, queued := p.queue.positions()[largeID]; queued != tt.queued {
+				t.Errorf("queued = %v, want %v", queued, tt.queued)
+			}
+			if hold := p.DiskSpaceHold(); strings.Contains(hold, fmt.Sprintf("task %d,", largeID)) != tt.queued {
+				t.Errorf("DiskSpaceHold() = %q", hold)
+			}
+			if tt.want == TaskStatusFailed {
+				// Failed with the real error, no attempt and no automatic retry
+				if !errors.Is(state.Error, errInsufficientSpace) || len(state.Attempts) != 0 || !state.RetryAt.IsZero() {
+					t.Errorf("failed task = %v, %d attempts, retry at %v", state.Error, len(state.Attempts), state.RetryAt)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskSpaceHoldDropped(t *testing.T) {
+	fakeFFprobe(t)
+	dir := t.TempDir()
+	large := filepath.Join(dir, "large.mkv")
+	writeSizedMedia(t, large, "10000000000000000")
+
+	p := newTestProcessor(t, config.Config{
+		Profiles:  []transcoding.Profile{{Name: "x265"}},
+		DiskSpace: config.DiskSpaceConfig{Enabled: true, EstimateMargin: 1, Action: "hold", CheckInterval: 60},
+	})
+	id := p.AddTask(large, "x265", 0)
+
+	if task := p.popAdmissible(nil); task != nil {
+		t.Fatalf("popAdmissible() = task %d, want none", task.ID)
+	}
+	if !p.diskSpaceHeld(id) || p.DiskSpaceHold() == "" {
+		t.Fatal("task not held")
+	}
+
+	// A held task that leaves the queue no longer holds it
+	if err := p.CancelTask(id); err != nil {
+		t.Fatal(err)
+	}
+	if hold := p.DiskSpaceHold(); hold != "" {
+		t.Errorf("DiskSpaceHold() = %q after cancelling the held task", hold)
+	}
+}
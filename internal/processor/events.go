@@ -0,0 +1,70 @@
+package processor
+
+import "github.com/royalcat/easy-transcoder/internal/events"
+
+// EventKind identifies what changed in an Event.
+type EventKind string
+
+const (
+	// EventTaskChanged is published after every task status transition and
+	// when a task is added. PrevStatus is empty for a new task.
+	EventTaskChanged EventKind = "task_changed"
+	// EventTaskProgress is published on every progress update of a running task.
+	EventTaskProgress EventKind = "task_progress"
+	// EventTaskLog is published when output is appended to a task log.
+	EventTaskLog EventKind = "task_log"
+	// EventQueueChanged is published when the order of the pending queue
+	// changes or the queue is paused, resumed or held.
+	EventQueueChanged EventKind = "queue_changed"
+)
+
+// Event is a state change of the processor.
+type Event struct {
+	Kind   EventKind
+	TaskID uint64 // Zero for EventQueueChanged
+
+	// Task is the state of the task after the change, set for
+	// EventTaskChanged and EventTaskProgress.
+	Task       TaskState
+	PrevStatus TaskStatus // Status before an EventTaskChanged
+}
+
+// Subscribe returns a subscription to the processor's events. A subscriber
+// that falls behind misses events, see events.Bus.
+func (p *Processor) Subscribe(buffer int) *events.Subscription[Event] {
+	return p.events.Subscribe(buffer)
+}
+
+// OnTaskEvent registers a hook called with every EventTaskChanged and
+// EventTaskProgress. Unlike a subscription it never misses an event. It is
+// called in the goroutine changing the task, possibly with processor and
+// worker manager locks held, so it must only hand the event off.
+func (p *Processor) OnTaskEvent(hook func(Event)) {
+	p.taskHooksMu.Lock()
+	defer p.taskHooksMu.Unlock()
+	p.taskHooks = append(p.taskHooks, hook)
+}
+
+// publishTask passes a task event to the hooks and publishes it.
+func (p *Processor) publishTask(event Event) {
+	p.taskHooksMu.RLock()
+	for _, hook := range p.taskHooks {
+		hook(event)
+	}
+	p.taskHooksMu.RUnlock()
+
+	p.events.Publish(event)
+}
+
+// taskProgressed publishes the progress update of a running task.
+func (p *Processor) taskProgressed(t *task) {
+	p.publishTask(Event{Kind: EventTaskProgress, TaskID: t.ID, Task: t.State()})
+}
+
+// queueChanged is called with the pending queue order after every modification.
+func (p *Processor) queueChanged(ids []uint64) {
+	if p.store != nil {
+		p.store.saveOrder(ids)
+	}
+	p.events.Publish(Event{Kind: EventQueueChanged})
+}
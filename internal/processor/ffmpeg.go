@@ -1,83 +1,54 @@
 package processor
 
 import (
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"path"
-	"regexp"
-	"strconv"
-	"strings"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
-func (p *Processor) ffmpegProgressSock(totalDuration float64, progressCallback func(float64), taskID uint64) string {
+// ffmpegProgressSock creates a unix socket for FFmpeg's -progress output and
+// calls progressCallback with the fraction of totalDuration encoded and the
+// raw update for every progress update received. The returned function
+// closes and removes the socket.
+func (p *Processor) ffmpegProgressSock(totalDuration float64, progressCallback func(float64, transcoding.Progress), taskID uint64) (string, func(), error) {
 	sockFileName := path.Join(os.TempDir(), fmt.Sprintf("%d_sock", rand.Int()))
 	p.logger.Debug("creating progress socket", "task_id", taskID, "socket", sockFileName)
 
 	l, err := net.Listen("unix", sockFileName)
 	if err != nil {
-		p.logger.Error("failed to create progress socket", "task_id", taskID, "error", err)
-		panic(err)
+		return "", nil, fmt.Errorf("failed to create progress socket: %w", err)
+	}
+
+	closeSock := func() {
+		l.Close()
+		os.Remove(sockFileName)
 	}
 
 	go func() {
-		re := regexp.MustCompile(`out_time_ms=(\d+)`)
-		fd, err := l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			p.logger.Error("socket accept error", "task_id", taskID, "error", err)
+			p.logger.Debug("socket accept ended", "task_id", taskID, "error", err)
 			return
 		}
+		defer conn.Close()
 
-		buf := make([]byte, 16)
-		data := ""
-		for {
-			_, err := fd.Read(buf)
-			if err != nil {
-				p.logger.Debug("socket read ended", "task_id", taskID, "error", err)
-				return
-			}
-
-			data += string(buf)
-			a := re.FindAllStringSubmatch(data, -1)
+		err = transcoding.ParseProgress(conn, func(update transcoding.Progress) {
 			prog := float64(0)
-			if len(a) > 0 && len(a[len(a)-1]) > 0 {
-				c, _ := strconv.Atoi(a[len(a)-1][len(a[len(a)-1])-1])
-				prog = float64(c) / totalDuration / 1000000
+			if totalDuration > 0 {
+				prog = update.OutTime / totalDuration
 			}
-
-			if strings.Contains(data, "progress=end") {
+			if update.End {
 				p.logger.Debug("ffmpeg reported progress=end", "task_id", taskID)
 				prog = 1
 			}
-
-			progressCallback(prog)
-		}
+			progressCallback(prog, update)
+		})
+		p.logger.Debug("socket read ended", "task_id", taskID, "error", err)
 	}()
 
-	return sockFileName
-}
-
-type probeFormat struct {
-	Duration string `json:"duration"`
-}
-
-type probeData struct {
-	Format probeFormat `json:"format"`
-}
-
-func probeDuration(a string) (float64, error) {
-	pd := probeData{}
-	err := json.Unmarshal([]byte(a), &pd)
-	if err != nil {
-		return 0, err
-	}
-
-	f, err := strconv.ParseFloat(pd.Format.Duration, 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return f, nil
+	return sockFileName, closeSock, nil
 }
@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+// metricResult is a quality metric of a task output, calculated at most once.
+type metricResult struct {
+	done  chan struct{} // Closed when the calculation finished
+	score float64
+	err   error
+}
+
+// TaskMetric returns a quality metric of a task waiting for resolution,
+// comparing its output to the input. Scores are cached on the task, and a
+// calculation already in flight, e.g. from auto_metrics, is waited for
+// instead of started again.
+func (p *Processor) TaskMetric(ctx context.Context, taskID uint64, metric string) (float64, error) {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("task %d not found", taskID)
+	}
+	return p.taskMetric(ctx, task, metric)
+}
+
+func (p *Processor) taskMetric(ctx context.Context, task *task, metric string) (float64, error) {
+	task.metricsMu.Lock()
+	result, ok := task.metrics[metric]
+	if !ok {
+		if task.status() != TaskStatusWaitingForResolution {
+			task.metricsMu.Unlock()
+			return 0, fmt.Errorf("task %d is not waiting for resolution", task.ID)
+		}
+		result = &metricResult{done: make(chan struct{})}
+		if task.metrics == nil {
+			task.metrics = map[string]*metricResult{}
+		}
+		task.metrics[metric] = result
+	}
+	task.metricsMu.Unlock()
+
+	if ok {
+		select {
+		case <-result.done:
+			return result.score, result.err
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	log := p.logger.With("task_id", task.ID, "metric", metric)
+	log.Info("calculating metric")
+
+	// Not bound to the request context, the score is cached for later requests
+	state := task.State()
+	result.score, result.err = transcoding.CalculateMetric(task.attemptCtx(), metric, task.Input, state.TempFile)
+	close(result.done)
+
+	if result.err != nil {
+		log.Error("metric calculation failed", "error", result.err)
+		// Forget the failure so the metric can be requested again, unless a
+		// retry already replaced it
+		task.metricsMu.Lock()
+		if task.metrics[metric] == result {
+			delete(task.metrics, metric)
+		}
+		task.metricsMu.Unlock()
+		return 0, result.err
+	}
+
+	log.Info("metric calculated", "score", result.score)
+	task.changed()
+	return result.score, nil
+}
+
+// Metrics returns the quality metrics calculated so far.
+func (t *task) Metrics() map[string]float64 {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+
+	if len(t.metrics) == 0 {
+		return nil
+	}
+	scores := make(map[string]float64, len(t.metrics))
+	for metric, result := range t.metrics {
+		select {
+		case <-result.done:
+			if result.err == nil {
+				scores[metric] = result.score
+			}
+		default:
+		}
+	}
+	return scores
+}
+
+// resetOutput forgets everything learned about the output of the previous
+// attempt, so the next output is measured and resolved on its own.
+func (t *task) resetOutput() {
+	t.metricsMu.Lock()
+	t.metrics = nil
+	t.metricsMu.Unlock()
+
+	t.update(func() {
+		t.CRFSearch = nil
+		t.AutoResolution = ""
+		t.Output = ""
+		t.Warnings = nil
+	})
+}
+
+// setMetrics restores calculated quality metrics.
+func (t *task) setMetrics(scores map[string]float64) {
+	t.metricsMu.Lock()
+	defer t.metricsMu.Unlock()
+
+	t.metrics = make(map[string]*metricResult, len(scores))
+	for metric, score := range scores {
+		done := make(chan struct{})
+		close(done)
+		t.metrics[metric] = &metricResult{done: done, score: score}
+	}
+}
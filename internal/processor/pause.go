@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// PauseQueue stops handing out pending tasks to the local worker and to
+// remote workers. Tasks already running are not affected.
+func (p *Processor) PauseQueue() error {
+	return p.setQueuePaused(true)
+}
+
+// ResumeQueue resumes handing out pending tasks.
+func (p *Processor) ResumeQueue() error {
+	return p.setQueuePaused(false)
+}
+
+// QueuePaused reports whether the queue is paused.
+func (p *Processor) QueuePaused() bool {
+	return p.queue.isPaused()
+}
+
+// setQueuePaused saves the pause state before it applies it, a queue that
+// comes back in another state after a restart must not report success.
+func (p *Processor) setQueuePaused(paused bool) error {
+	p.queuePauseMu.Lock()
+	defer p.queuePauseMu.Unlock()
+
+	if p.store != nil {
+		if err := p.store.savePaused(paused); err != nil {
+			return fmt.Errorf("failed to save queue pause state: %w", err)
+		}
+	}
+
+	p.queue.setPaused(paused)
+	p.logger.Info("queue pause changed", "paused", paused)
+	p.events.Publish(Event{Kind: EventQueueChanged})
+	return nil
+}
+
+// PauseTask suspends the ffmpeg process of a task running on the local worker.
+// The task keeps its progress and continues where it stopped on ResumeTask.
+// Only an encode can be paused: while no ffmpeg process of the task runs,
+// e.g. during the CRF search or between two passes, the pause is refused.
+func (p *Processor) PauseTask(id uint64) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[id]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+
+	if task.WorkerID != "" {
+		return fmt.Errorf("task %d runs on a remote worker and can't be paused", id)
+	}
+
+	// No command starts or ends while it's stopped and the task marked
+	task.cmdMu.Lock()
+	defer task.cmdMu.Unlock()
+	status, ok := task.swapStatus(func(status TaskStatus) bool {
+		return status == TaskStatusProcessing && task.cmd != nil
+	}, func(TaskStatus) {
+		task.cmd.Process.Signal(syscall.SIGSTOP)
+		task.MarkPaused()
+	})
+	if !ok {
+		if status == TaskStatusProcessing {
+			return fmt.Errorf("task %d has no encode running and can't be paused", id)
+		}
+		return fmt.Errorf("task %d is not processing", id)
+	}
+
+	p.logger.Info("task paused", "task_id", id)
+	return nil
+}
+
+// ResumeTask continues a task paused with PauseTask.
+func (p *Processor) ResumeTask(id uint64) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[id]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+
+	task.cmdMu.Lock()
+	defer task.cmdMu.Unlock()
+	_, ok = task.swapStatus(func(status TaskStatus) bool {
+		return status == TaskStatusPaused
+	}, func(TaskStatus) {
+		task.MarkResumed()
+		if task.cmd != nil {
+			task.cmd.Process.Signal(syscall.SIGCONT)
+		}
+	})
+	if !ok {
+		return fmt.Errorf("task %d is not paused", id)
+	}
+
+	p.logger.Info("task resumed", "task_id", id)
+	return nil
+}
@@ -0,0 +1,195 @@
+package processor
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+// addProcessingTask adds a task running on the given worker, empty for the local one.
+func addProcessingTask(p *Processor, workerID string) *task {
+	p.tasksMu.Lock()
+	defer p.tasksMu.Unlock()
+
+	t := newTask(p.taskAI.Add(1), "/media/input.mkv", "x265", 0)
+	t.onChange = p.taskChanged
+	t.WorkerID = workerID
+	t.MarkProcessing()
+	p.addTaskLocked(t)
+	return t
+}
+
+// waitStopped waits until a process is stopped, or running again.
+func waitStopped(t *testing.T, pid int, stopped bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			t.Skipf("process state unavailable: %v", err)
+		}
+		// The state follows the command name in parentheses, T is stopped
+		state := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))[0]
+		if (state == "T") == stopped {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process state = %s, want stopped %v", state, stopped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueuePause(t *testing.T) {
+	cfg := config.Config{DBPath: filepath.Join(t.TempDir(), "tasks.db"), TempDir: t.TempDir()}
+	// Opened and closed by the test, every processor is a restart
+	open := func() *Processor {
+		p, err := NewProcessor(cfg, slog.New(slog.DiscardHandler))
+		if err != nil {
+			t.Fatalf("NewProcessor() error = %v", err)
+		}
+		return p
+	}
+
+	p := open()
+	p.AddTask("/media/input.mkv", "x265", 0)
+	if err := p.PauseQueue(); err != nil {
+		t.Fatalf("PauseQueue() error = %v", err)
+	}
+	if !p.QueuePaused() {
+		t.Error("QueuePaused() = false after PauseQueue")
+	}
+	if task := p.queue.tryPop(); task != nil {
+		t.Errorf("paused queue handed out task %d", task.ID)
+	}
+	if task, err := p.DequeueForWorker("worker", true); task != nil || err != nil {
+		t.Errorf("paused queue handed out %v, %v to a worker", task, err)
+	}
+	p.Close()
+
+	p = open()
+	if !p.QueuePaused() {
+		t.Fatal("QueuePaused() = false after a restart")
+	}
+	if err := p.ResumeQueue(); err != nil {
+		t.Fatalf("ResumeQueue() error = %v", err)
+	}
+	if task := p.queue.tryPop(); task == nil {
+		t.Error("resumed queue handed out no task")
+	}
+	p.Close()
+
+	p = open()
+	defer p.Close()
+	if p.QueuePaused() {
+		t.Error("QueuePaused() = true after resuming and a restart")
+	}
+}
+
+func TestQueuePauseSaveFailure(t *testing.T) {
+	p := newTestProcessor(t, config.Config{DBPath: filepath.Join(t.TempDir(), "tasks.db")})
+	p.AddTask("/media/input.mkv", "x265", 0)
+	sub := p.Subscribe(1)
+	defer sub.Close()
+
+	// Every write fails once the database is closed
+	p.store.db.Close()
+	if err := p.PauseQueue(); err == nil {
+		t.Fatal("PauseQueue() succeeded without saving the pause state")
+	}
+	if p.QueuePaused() {
+		t.Error("QueuePaused() = true after a failed PauseQueue")
+	}
+	select {
+	case ev := <-sub.C:
+		t.Errorf("failed PauseQueue published %v", ev.Kind)
+	default:
+	}
+}
+
+func TestPauseTaskRefused(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	pending := p.AddTask("/media/input.mkv", "x265", 0)
+	remote := addProcessingTask(p, "worker")
+	searching := addProcessingTask(p, "") // No ffmpeg process, e.g. during the CRF search
+
+	tests := []struct {
+		name string
+		id   uint64
+		want string
+	}{
+		{"unknown", 99, "not found"},
+		{"pending", pending, "not processing"},
+		{"remote", remote.ID, "remote worker"},
+		{"no encode", searching.ID, "no encode running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.PauseTask(tt.id)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("PauseTask() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := p.ResumeTask(searching.ID); err == nil {
+		t.Error("ResumeTask() of a processing task succeeded")
+	}
+}
+
+func TestPauseTask(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	task := addProcessingTask(p, "")
+
+	// A stand-in for the ffmpeg process of the encode
+	cmd := exec.Command("sleep", "30")
+	if err := task.startCommand(cmd); err != nil {
+		t.Fatalf("startCommand() error = %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		task.endCommand()
+	}()
+
+	if err := p.PauseTask(task.ID); err != nil {
+		t.Fatalf("PauseTask() error = %v", err)
+	}
+	if status := p.GetTask(task.ID).Status; status != TaskStatusPaused {
+		t.Errorf("status = %s, want paused", status)
+	}
+	waitStopped(t, cmd.Process.Pid, true)
+	if err := p.PauseTask(task.ID); err == nil {
+		t.Error("second PauseTask() succeeded")
+	}
+
+	if err := p.ResumeTask(task.ID); err != nil {
+		t.Fatalf("ResumeTask() error = %v", err)
+	}
+	if status := p.GetTask(task.ID).Status; status != TaskStatusProcessing {
+		t.Errorf("status = %s, want processing", status)
+	}
+	waitStopped(t, cmd.Process.Pid, false)
+
+	// A paused task can be cancelled, its process is continued to handle the signal
+	if err := p.PauseTask(task.ID); err != nil {
+		t.Fatalf("PauseTask() error = %v", err)
+	}
+	if err := p.CancelTask(task.ID); err != nil {
+		t.Fatalf("CancelTask() error = %v", err)
+	}
+	if err := <-exited; err == nil {
+		t.Error("cancelled process exited cleanly")
+	}
+	if status := p.GetTask(task.ID).Status; status != TaskStatusCancelled {
+		t.Errorf("status = %s, want cancelled", status)
+	}
+}
@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+// afterTranscode runs in the background once a task reaches waiting for
+// resolution: it calculates the auto_metrics of the task's profile and then
+// applies the resolution rules. Tasks take turns for the metric
+// calculations so they don't compete with each other; the metrics are
+// shared with the resolver. Rules without metrics don't wait for them.
+func (p *Processor) afterTranscode(task *task) {
+	profile := p.getProfile(task.Preset)
+	rules := p.resolutionRules(profile)
+
+	metrics := slices.Clone(profile.AutoMetrics)
+	for _, rule := range rules {
+		for _, metric := range rule.Metrics() {
+			if !slices.Contains(metrics, metric) {
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	if len(metrics) == 0 && len(rules) == 0 {
+		return
+	}
+
+	go func() {
+		if len(metrics) > 0 {
+			p.autoMetricsMu.Lock()
+			for _, metric := range metrics {
+				if task.status() != TaskStatusWaitingForResolution {
+					break
+				}
+				p.taskMetric(context.Background(), task, metric)
+			}
+			p.autoMetricsMu.Unlock()
+		}
+
+		if len(rules) > 0 && task.status() == TaskStatusWaitingForResolution {
+			p.applyResolutionRules(task, rules)
+		}
+	}()
+}
+
+// resolutionRules returns the rules applying to a profile, its own rules first.
+func (p *Processor) resolutionRules(profile transcoding.Profile) []transcoding.ResolutionRule {
+	return slices.Concat(profile.ResolutionRules, p.config.ResolutionRules)
+}
+
+// applyResolutionRules resolves the task with the first matching rule.
+// When no rule matches, the task is left waiting for a human.
+func (p *Processor) applyResolutionRules(task *task, rules []transcoding.ResolutionRule) {
+	log := p.logger.With("task_id", task.ID, "input", task.Input)
+
+	facts, err := p.resolutionFacts(task, rules)
+	if err != nil {
+		log.Error("failed to evaluate resolution rules", "error", err)
+		return
+	}
+
+	for _, rule := range rules {
+		reasons, ok := rule.Match(facts)
+		if !ok {
+			continue
+		}
+
+		reason := strings.Join(reasons, ", ")
+		log.Info("resolution rule fired", "rule", rule.Name, "action", rule.Action, "reason", reason)
+		autoResolution := fmt.Sprintf("%s by rule %q: %s", rule.Action, rule.Name, reason)
+		// Resolved in the meantime, e.g. by hand or cancelled, the rule doesn't apply
+		if err := p.startResolution(task, ruleResolution(rule.Action), false, autoResolution); err != nil {
+			log.Warn("resolution rule could not resolve the task", "rule", rule.Name, "reason", reason, "error", err)
+		}
+		return
+	}
+
+	log.Info("no resolution rule matched, waiting for resolution")
+}
+
+// ruleResolution maps a resolution rule action to its resolution.
+func ruleResolution(action string) Resolution {
+	switch action {
+	case transcoding.RuleActionAccept:
+		return ResolutionReplace
+	case transcoding.RuleActionKeepBoth:
+		return ResolutionKeepBoth
+	default:
+		return ResolutionReject
+	}
+}
+
+// resolutionFacts gathers what the rules need to know about a transcoded task.
+// Metrics are taken from the cache, the streams are only probed when a rule
+// compares them.
+func (p *Processor) resolutionFacts(task *task, rules []transcoding.ResolutionRule) (transcoding.ResolutionFacts, error) {
+	input, err := os.Stat(task.Input)
+	if err != nil {
+		return transcoding.ResolutionFacts{}, fmt.Errorf("stat input failed: %w", err)
+	}
+	output, err := os.Stat(task.TempFile)
+	if err != nil {
+		return transcoding.ResolutionFacts{}, fmt.Errorf("stat output failed: %w", err)
+	}
+
+	facts := transcoding.ResolutionFacts{
+		InputSize:  input.Size(),
+		OutputSize: output.Size(),
+		Metrics:    task.Metrics(),
+	}
+
+	if slices.ContainsFunc(rules, transcoding.ResolutionRule.NeedsStreams) {
+		inputProbe, err := transcoding.Probe(task.Input)
+		if err != nil {
+			return transcoding.ResolutionFacts{}, fmt.Errorf("probe input failed: %w", err)
+		}
+		outputProbe, err := transcoding.Probe(task.TempFile)
+		if err != nil {
+			return transcoding.ResolutionFacts{}, fmt.Errorf("probe output failed: %w", err)
+		}
+		facts.DroppedStreams = transcoding.DroppedStreams(inputProbe, outputProbe)
+	}
+
+	return facts, nil
+}
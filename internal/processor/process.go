@@ -2,10 +2,15 @@ package processor
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/exec"
 	"path"
 	"strings"
 	"syscall"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 // only this function can modify not atomic task status
@@ -14,54 +19,126 @@ func (p *Processor) processTask(task *task) {
 
 	if task.cancelled.Load() {
 		log.Info("transcoding was cancelled")
-		task.MarkCancelled()
+		task.markCancelled()
 		return
 	}
 
 	task.MarkProcessing()
+	p.logTask(task.ID, "attempt %d started on the local worker", len(task.Attempts))
 
 	// Probe the input file and validate the preset
 	log.Info("probing input file")
 	totalDuration, _, preset, err := p.probeAndValidate(task)
 	if err != nil {
 		log.Error("probe failed", "error", err)
-		task.MarkFailed(fmt.Errorf("failed to probe input file: %s", err))
+		p.failTask(task, fmt.Errorf("failed to probe input file: %s", err))
 		return
 	}
 	log.Debug("media duration detected", "duration", totalDuration)
 
 	// Create temporary output file
-	task.TempFile, err = p.tempFile(task.Input)
-	if err != nil {
+	if _, err = p.tempFile(task, preset.OutputExt(task.Input)); err != nil {
 		log.Error("failed to create temp file", "task_id", task.ID, "error", err)
-		task.MarkFailed(fmt.Errorf("failed to create temp file: %s", err))
+		p.failTask(task, fmt.Errorf("failed to create temp file: %s", err))
 		return
 	}
 	log.Info("temp file created", "task_id", task.ID, "temp_file", task.TempFile)
 
-	// Setup progress tracking
-	progressCallback := func(prg float64) {
-		log.Debug("transcoding progress", "progress", fmt.Sprintf("%.2f%%", prg*100))
-		task.SetProgress(prg)
+	// Quality-targeted encode, find the CRF reaching the target VMAF on samples first
+	if preset.TargetVMAF > 0 {
+		log.Info("searching crf", "target_vmaf", preset.TargetVMAF)
+		workDir := path.Join(path.Dir(task.TempFile), "crf-search")
+		result, err := preset.SearchCRF(task.attemptCtx(), p.ffmpegBinary(), task.Input, "", totalDuration, workDir, func(done, steps int) {
+			p.logTask(task.ID, "crf search step %d/%d", done, steps)
+		})
+		if task.cancelled.Load() {
+			log.Info("transcoding was cancelled")
+			task.markCancelled()
+			return
+		}
+		if err != nil {
+			log.Error("crf search failed", "error", err)
+			p.failTask(task, fmt.Errorf("crf search failed: %s", err))
+			return
+		}
+		log.Info("crf search completed", "crf", result.CRF, "scores", result.Scores)
+		p.logTask(task.ID, "crf search chose crf %d, sample scores %v", result.CRF, result.Scores)
+		task.SetCRFSearch(result)
+		preset = preset.WithCRF(result.CRF)
+	}
+
+	passes := 1
+	if preset.TwoPass {
+		passes = 2
 	}
+	// Two-pass encodes share a passlog next to the output in the task temp dir
+	passlog := path.Join(path.Dir(task.TempFile), "passlog")
+
+	for pass := 1; pass <= passes; pass++ {
+		log := log.With("pass", pass, "passes", passes)
+
+		// Setup progress tracking, every pass covers an equal share of the progress
+		progressCallback := func(prg float64, stats transcoding.Progress) {
+			prg = (float64(pass-1) + prg) / float64(passes)
+			log.Debug("transcoding progress", "progress", fmt.Sprintf("%.2f%%", prg*100), "fps", stats.FPS, "speed", stats.Speed)
+			task.SetProgress(prg)
+			task.SetStats(stats)
+			p.taskProgressed(task)
+		}
+
+		progressSock, closeProgressSock, err := p.ffmpegProgressSock(totalDuration, progressCallback, task.ID)
+		if err != nil {
+			log.Error("failed to create progress socket", "error", err)
+			p.failTask(task, err)
+			return
+		}
 
-	progressSock := p.ffmpegProgressSock(totalDuration, progressCallback, task.ID)
-	defer os.Remove(progressSock)
+		// Prepare and run the command
+		var cmd *exec.Cmd
+		if preset.TwoPass {
+			cmd = preset.CompilePass(pass, p.ffmpegBinary(), task.Input, task.TempFile, passlog, progressSock)
+		} else {
+			cmd = preset.Compile(p.ffmpegBinary(), task.Input, task.TempFile, progressSock)
+		}
 
-	// Prepare and run the command
-	cmd := preset.Compile(p.ffmpegBinary(), task.Input, task.TempFile, progressSock)
-	task.SetCommand(cmd)
+		err = p.runFFmpeg(task, cmd, log)
+		closeProgressSock()
 
-	cmd.Stderr = &task.stderr
+		// Ignore error if the task was cancelled
+		if task.cancelled.Load() {
+			log.Info("transcoding was cancelled")
+			task.markCancelled()
+			return
+		}
+
+		if err != nil {
+			log.Error("transcoding failed", "error", err)
+			p.failTask(task, fmt.Errorf("transcoding failed: %s", err))
+			return
+		}
+	}
+
+	log.Info("transcoding completed, mark waiting for resolution")
+	p.completeTempManifest(task)
+	task.MarkWaitingForResolution()
+	p.afterTranscode(task)
+}
+
+// runFFmpeg starts the command as the task's current process and waits for it to exit.
+// The command is stored on the task so cancellation can signal whichever process is running.
+// A failure carries the last line of the FFmpeg output.
+func (p *Processor) runFFmpeg(task *task, cmd *exec.Cmd, log *slog.Logger) error {
+	var tail outputTail
+	cmd.Stderr = io.MultiWriter(p.taskLogWriter(task.ID), &tail)
 
 	log.Info("starting transcoding", "command", strings.Join(cmd.Args, " "))
+	p.logTask(task.ID, "$ %s", strings.Join(cmd.Args, " "))
 
-	err = cmd.Start()
+	err := task.startCommand(cmd)
 	if err != nil {
-		log.Error("failed to start transcoding", "error", err)
-		task.MarkFailed(fmt.Errorf("failed to start transcoding: %s", err))
-		return
+		return fmt.Errorf("failed to start: %w", err)
 	}
+	defer task.endCommand()
 
 	if p.config.TranscodingNiceness != 0 {
 		err = syscall.Setpriority(syscall.PRIO_PROCESS, cmd.Process.Pid, p.config.TranscodingNiceness)
@@ -70,36 +147,28 @@ func (p *Processor) processTask(task *task) {
 		}
 	}
 
-	err = cmd.Wait()
-
-	// Ignore error if the task was cancelled
-	if task.cancelled.Load() {
-		log.Info("transcoding was cancelled")
-		task.MarkCancelled()
-		return
-	}
-
-	if err != nil {
-		log.Error("transcoding failed", "error", err, "stderr", task.stderr.String())
-		task.MarkFailed(fmt.Errorf("transcoding failed: %s, see logs", err))
-		return
+	if err := cmd.Wait(); err != nil {
+		if line := tail.LastLine(); line != "" {
+			return fmt.Errorf("%w: %s", err, line)
+		}
+		return err
 	}
+	return nil
+}
 
-	log.Info("transcoding completed, mark waiting for resolution")
-	task.MarkWaitingForResolution()
-
-	// Call callback if set for auto-reject functionality
-	if p.onWaitingForResolution != nil {
-		p.onWaitingForResolution(task.State())
+// tempDir returns the directory the task temp dirs are created in.
+func (p *Processor) tempDir() string {
+	if p.config.TempDir == "" {
+		return path.Join(os.TempDir(), "easy-transcoder")
 	}
+	return p.config.TempDir
 }
 
-// tempFile creates a temporary file path for transcoding output.
-func (p *Processor) tempFile(filename string) (string, error) {
-	tempDir := p.config.TempDir
-	if tempDir == "" {
-		tempDir = path.Join(os.TempDir(), "easy-transcoder")
-	}
+// tempFile creates a temporary file path for the transcoding output of a
+// task, named after the input with the extension of the output. The temp
+// dir gets a manifest for the recovery after a restart.
+func (p *Processor) tempFile(task *task, ext string) (string, error) {
+	tempDir := p.tempDir()
 	p.logger.Debug("creating temp directory", "dir", tempDir)
 
 	err := os.MkdirAll(tempDir, os.ModePerm)
@@ -110,7 +179,7 @@ func (p *Processor) tempFile(filename string) (string, error) {
 		return "", err
 	}
 
-	tempDir, err = os.MkdirTemp(tempDir, "")
+	tempDir, err = os.MkdirTemp(tempDir, tempDirPrefix)
 	if err != nil {
 		p.logger.Error("failed to create temp subdirectory",
 			"parent_dir", tempDir,
@@ -118,7 +187,15 @@ func (p *Processor) tempFile(filename string) (string, error) {
 		return "", err
 	}
 
-	tempFilePath := path.Join(tempDir, path.Base(filename))
+	stem := strings.TrimSuffix(path.Base(task.Input), path.Ext(task.Input))
+	tempFilePath := path.Join(tempDir, stem+ext)
 	p.logger.Debug("created temp file path", "path", tempFilePath)
+
+	task.update(func() { task.TempFile = tempFilePath })
+	if err := writeTempManifest(task, false); err != nil {
+		os.RemoveAll(tempDir)
+		task.update(func() { task.TempFile = "" })
+		return "", fmt.Errorf("failed to write temp manifest: %w", err)
+	}
 	return tempFilePath, nil
 }
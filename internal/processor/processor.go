@@ -3,26 +3,36 @@ package processor
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
-
-	ffmpeg "github.com/u2takey/ffmpeg-go"
+	"time"
 
 	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/events"
 	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 // Processor manages a queue of transcoding tasks.
 type Processor struct {
 	taskAI  atomic.Uint64
-	queue   chan *task
+	queue   *taskQueue
 	tasksMu sync.RWMutex
 	tasks   map[uint64]*task
+	byInput map[string][]*task // tasks indexed by input path for HasTask
+	store   *taskStore
+
+	// Local worker slots
+	slots     atomic.Int32
+	busySlots atomic.Int32
 
 	ffmpegReady  bool
 	ffmpegBinary func() string
@@ -30,23 +40,95 @@ type Processor struct {
 	logger *slog.Logger
 	config config.Config
 
-	// Callback for when tasks reach waiting_for_resolution status
-	onWaitingForResolution func(TaskState)
+	// Orders saving and applying the queue pause state, see setQueuePaused
+	queuePauseMu sync.Mutex
+
+	// Serializes background auto_metrics calculations
+	autoMetricsMu sync.Mutex
+
+	// Schedule checks of the local worker, see waitSchedule
+	scheduleMu   sync.Mutex
+	scheduleNext time.Time // No task starts before, guarded by scheduleMu
+	scheduleHold atomic.Pointer[string]
+
+	taskLogsMu sync.Mutex
+	taskLogs   map[uint64]*taskLog
+
+	// Tasks held back for lack of disk space, see admitDiskSpace
+	diskSpaceMu    sync.Mutex
+	diskSpaceHolds map[uint64]diskSpaceHold
+
+	// Outcome of the startup scan of the temp dir, see recoverTempDirs
+	tempRecovery tempRecoveryLog
+
+	// Serializes changes to the backup dir, see backupOriginal
+	backupMu sync.Mutex
+
+	// Task and queue state changes, see Subscribe and OnTaskEvent
+	events      events.Bus[Event]
+	taskHooksMu sync.RWMutex
+	taskHooks   []func(Event)
 }
 
 const defaultFFmpegPath = "ffmpeg"
 
 // NewProcessor creates a new task processor.
-func NewProcessor(config config.Config, logger *slog.Logger) *Processor {
+// When a database path is configured, tasks persisted by a previous run
+// are restored and pending ones are put back into the queue.
+func NewProcessor(config config.Config, logger *slog.Logger) (*Processor, error) {
 	if logger == nil {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 	}
 
 	processor := &Processor{
-		config: config,
-		queue:  make(chan *task, 100),
-		tasks:  map[uint64]*task{},
-		logger: logger,
+		config:   config,
+		queue:    newTaskQueue(),
+		tasks:    map[uint64]*task{},
+		byInput:  map[string][]*task{},
+		taskLogs: map[uint64]*taskLog{},
+		logger:   logger,
+	}
+
+	var pending []*task
+	if config.DBPath != "" {
+		store, err := openTaskStore(config.DBPath, logger)
+		if err != nil {
+			return nil, err
+		}
+		processor.store = store
+
+		pending, err = processor.restoreTasks()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+
+		paused, err := store.loadPaused()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		processor.queue.paused = paused
+	}
+
+	// Recover outputs the database lost track of, and clean up partial ones
+	pending = processor.recoverTempDirs(pending)
+
+	processor.queue.tasks = pending
+	processor.queue.onChange = processor.queueChanged
+
+	// Resume the retries scheduled before the restart
+	for _, t := range processor.tasks {
+		if t.Status == TaskStatusFailed && !t.RetryAt.IsZero() {
+			processor.scheduleRetry(t, t.RetryAt)
+		}
+	}
+
+	if config.Backup.Dir != "" {
+		go processor.pruneBackupsLoop()
+	}
+	if config.TaskLogs.Dir != "" {
+		go processor.pruneTaskLogsLoop()
 	}
 
 	processor.ffmpegBinary = sync.OnceValue(func() string {
@@ -73,7 +155,15 @@ func NewProcessor(config config.Config, logger *slog.Logger) *Processor {
 	})
 	go processor.ffmpegBinary()
 
-	return processor
+	return processor, nil
+}
+
+// Close flushes and closes the task database.
+func (p *Processor) Close() error {
+	if p.store == nil {
+		return nil
+	}
+	return p.store.Close()
 }
 
 func (p *Processor) FFmpegBinary() string {
@@ -83,45 +173,185 @@ func (p *Processor) FFmpegBinary() string {
 	return p.ffmpegBinary()
 }
 
-// StartWorker begins a background worker that processes pending tasks.
+// StartWorker begins background workers that process pending tasks.
+// Up to max_concurrent_tasks tasks are transcoded in parallel, new tasks
+// only start when the schedule allows it.
 func (p *Processor) StartWorker() {
-	p.logger.Info("starting task processor worker")
+	slots := max(1, p.config.MaxConcurrentTasks)
+	p.slots.Store(int32(slots))
+	p.logger.Info("starting task processor workers", "slots", slots)
+
+	for range slots {
+		go func() {
+			for {
+				p.queue.waitReady()
+				p.waitSchedule()
+				task := p.popAdmissible(nil)
+				if task == nil {
+					// Taken by another slot or a remote worker meanwhile,
+					// or every task left is held by the disk space guard
+					p.waitDiskSpace()
+					continue
+				}
+				p.busySlots.Add(1)
+				p.processTask(task)
+				p.busySlots.Add(-1)
+			}
+		}()
+	}
+}
 
-	go func() {
-		for task := range p.queue {
-			p.processTask(task)
-		}
-	}()
+// LocalSlots returns the number of busy and total local worker slots.
+// Total is zero when local processing is disabled.
+func (p *Processor) LocalSlots() (busy, total int) {
+	return int(p.busySlots.Load()), int(p.slots.Load())
 }
 
+// HasTask returns true if a non-cancelled task exists for the given input and preset.
 func (p *Processor) HasTask(path, preset string) bool {
 	p.tasksMu.RLock()
 	defer p.tasksMu.RUnlock()
 
-	for _, t := range p.tasks {
-		if t.Input == path && t.Preset == preset && !t.cancelled.Load() {
+	for _, t := range p.byInput[path] {
+		if t.Preset == preset && !t.cancelled.Load() {
 			return true
 		}
 	}
 	return false
 }
 
-// AddTask creates and enqueues a new transcoding task.
-func (p *Processor) AddTask(path, preset string) {
+// AddTask creates and enqueues a new transcoding task and returns its ID.
+// The task is queued after all pending tasks with an equal or higher priority.
+// The pending queue is unbounded, so adding a task never blocks.
+func (p *Processor) AddTask(path, preset string, priority int) uint64 {
+	return p.AddTasks([]string{path}, preset, priority)[0]
+}
+
+// AddTasks creates a task for every input like AddTask and enqueues them
+// at once, so the queue changes only once. It returns the IDs in the order
+// of the inputs.
+func (p *Processor) AddTasks(paths []string, preset string, priority int) []uint64 {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	tasks := make([]*task, len(paths))
+	ids := make([]uint64, len(paths))
 	p.tasksMu.Lock()
-	defer p.tasksMu.Unlock()
-
-	id := p.taskAI.Add(1)
-	task := newTask(id, path, preset)
-	p.tasks[task.ID] = task
-	p.logger.Info("task added to queue",
-		"task_id", task.ID,
-		"input", task.Input,
-		"preset", task.Preset)
-	p.queue <- task
+	for i, path := range paths {
+		task := newTask(p.taskAI.Add(1), path, preset, priority)
+		task.onChange = p.taskChanged
+		p.addTaskLocked(task)
+		tasks[i] = task
+		ids[i] = task.ID
+	}
+	p.tasksMu.Unlock()
+
+	for _, task := range tasks {
+		p.taskChanged(task)
+		p.logger.Info("task added to queue",
+			"task_id", task.ID,
+			"input", task.Input,
+			"preset", task.Preset,
+			"priority", task.Priority)
+	}
+	p.queue.pushMany(tasks)
+	return ids
 }
 
-// CancelTask attempts to cancel a task by ID.
+// AddDirectory adds a task for every video file under dir, skipping files
+// matched by the profile's batch exclude filter and files that already have
+// a task with the profile. It returns the IDs of the added tasks.
+func (p *Processor) AddDirectory(dir, preset string, priority int) ([]uint64, error) {
+	log := p.logger.With("dir", dir, "profile", preset)
+
+	profile := p.config.GetProfile(preset)
+	if profile == nil {
+		return nil, fmt.Errorf("unknown profile %q", preset)
+	}
+
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Warn("skipping unreadable path", "path", path, "error", err)
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if d.IsDir() || !slices.Contains(transcoding.VideoExtensions, ext) {
+			return nil
+		}
+
+		if profile.BatchExcludeFilter != nil {
+			matches, err := profile.BatchExcludeFilter.Matches(path)
+			if err != nil {
+				log.Error("error applying filter", "file", path, "error", err)
+				return nil
+			}
+			if matches {
+				log.Info("skipping file due to filter", "file", path)
+				return nil
+			}
+		}
+
+		if p.HasTask(path, preset) {
+			log.Info("skipping file, task already exists", "file", path)
+			return nil
+		}
+
+		paths = append(paths, path)
+		return nil
+	})
+	// Files found before an error are added all the same
+	return p.AddTasks(paths, preset, priority), err
+}
+
+// addTaskLocked registers a task in the task maps. tasksMu must be held.
+func (p *Processor) addTaskLocked(t *task) {
+	p.tasks[t.ID] = t
+	p.byInput[t.Input] = append(p.byInput[t.Input], t)
+}
+
+// SetTaskPriority changes the priority of a pending task and repositions it
+// in the queue accordingly.
+func (p *Processor) SetTaskPriority(id uint64, priority int) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[id]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+
+	if !p.queue.setPriority(id, priority) {
+		return fmt.Errorf("task %d is not pending", id)
+	}
+	p.taskChanged(task)
+	p.logger.Info("task priority changed", "task_id", id, "priority", priority)
+	return nil
+}
+
+// MoveTask moves a pending task to the given 0-based queue position.
+// A negative position moves the task to the bottom of the queue.
+func (p *Processor) MoveTask(id uint64, position int) error {
+	if !p.queue.move(id, position) {
+		return fmt.Errorf("task %d is not pending", id)
+	}
+	p.logger.Info("task moved in queue", "task_id", id, "position", position)
+	return nil
+}
+
+// ReorderQueue moves the given pending tasks to the front of the queue
+// in the given order. Tasks not listed keep their relative order behind them.
+func (p *Processor) ReorderQueue(ids []uint64) {
+	p.queue.reorder(ids)
+	p.logger.Info("queue reordered", "count", len(ids))
+}
+
+// CancelTask cancels a pending, running or waiting task. Replacing,
+// completed, failed and cancelled tasks can't be cancelled.
 func (p *Processor) CancelTask(id uint64) error {
 	p.logger.Info("cancelling task", "task_id", id)
 
@@ -132,12 +362,31 @@ func (p *Processor) CancelTask(id uint64) error {
 		return fmt.Errorf("task %d not found", id)
 	}
 
-	task.cancelled.Store(true)
-	task.MarkCancelled()
-
-	if task.cmd != nil && task.cmd.Process != nil {
-		task.cmd.Process.Signal(syscall.SIGTERM)
+	status, ok := task.swapStatus(func(status TaskStatus) bool {
+		switch status {
+		case TaskStatusReplacing, TaskStatusCompleted, TaskStatusFailed, TaskStatusCancelled:
+			return false
+		}
+		return true
+	}, func(prev TaskStatus) {
+		task.cancelled.Store(true)
+		task.cancelCtx()
+		// The output of a task waiting for resolution is discarded
+		if prev == TaskStatusWaitingForResolution && task.TempFile != "" {
+			if err := os.RemoveAll(filepath.Dir(task.TempFile)); err != nil {
+				p.logger.Error("failed to remove temp dir of cancelled task", "task_id", id, "error", err)
+			}
+			task.update(func() { task.TempFile = "" })
+		}
+		task.MarkCancelled()
+	})
+	if !ok {
+		return fmt.Errorf("task %d is %s and can't be cancelled", id, status)
 	}
+	p.queue.remove(id)
+
+	// A stopped process only handles the signal once continued
+	task.signal(syscall.SIGTERM, syscall.SIGCONT)
 
 	return nil
 }
@@ -153,11 +402,6 @@ func (p *Processor) IsCancelled(taskID uint64) bool {
 	return task.cancelled.Load()
 }
 
-// SetOnWaitingForResolutionCallback sets a callback that gets called when a task transitions to waiting_for_resolution
-func (p *Processor) SetOnWaitingForResolutionCallback(callback func(TaskState)) {
-	p.onWaitingForResolution = callback
-}
-
 // getProfile retrieves a transcoding profile by name.
 func (p *Processor) getProfile(name string) transcoding.Profile {
 	for _, p := range p.config.Profiles {
@@ -177,69 +421,98 @@ type AcquiredTask struct {
 	FFmpegPath    string            `json:"ffmpeg_path"`
 	InputSize     int64             `json:"input_size"`
 	TotalDuration float64           `json:"total_duration"`
-	OutputExt     string            `json:"output_ext"`
+	InputExt      string            `json:"input_ext"`  // Lets FFmpeg detect the container of the input URL
+	OutputExt     string            `json:"output_ext"` // Extension of the output container of the profile
+
+	// Two-pass encoding, the pass params are merged over Params
+	TwoPass          bool              `json:"two_pass,omitempty"`
+	FirstPassParams  map[string]string `json:"first_pass_params,omitempty"`
+	SecondPassParams map[string]string `json:"second_pass_params,omitempty"`
+
+	// Target VMAF encoding, the worker searches the CRF before the full encode
+	TargetVMAF float64               `json:"target_vmaf,omitempty"`
+	CRFSearch  transcoding.CRFSearch `json:"crf_search"`
 }
 
-// DequeueForWorker atomically takes the next pending task from the channel
+// DequeueForWorker atomically takes the next pending task from the queue
 // and assigns it to a remote worker. Returns nil if no tasks are available.
-func (p *Processor) DequeueForWorker(workerID string) (*AcquiredTask, error) {
-	select {
-	case task := <-p.queue:
-		if task.cancelled.Load() {
-			task.MarkCancelled()
-			return nil, nil
+// With the avoid_last_worker retry option, tasks whose last attempt failed on
+// this worker are skipped, unless canSkip is false because no other worker
+// could take them.
+func (p *Processor) DequeueForWorker(workerID string, canSkip bool) (*AcquiredTask, error) {
+	var accept func(t *task) bool
+	if p.config.Retry.AvoidLastWorker && canSkip {
+		accept = func(t *task) bool {
+			failedOn, failed := t.lastFailedWorker()
+			return !failed || failedOn != workerID
 		}
+	}
+	task := p.popAdmissible(accept)
+	if task == nil {
+		return nil, nil // No tasks available
+	}
 
-		task.WorkerID = workerID
-		task.MarkProcessing()
+	if task.cancelled.Load() {
+		task.markCancelled()
+		return nil, nil
+	}
 
-		p.logger.Info("task assigned to remote worker",
-			"task_id", task.ID, "worker_id", workerID)
+	task.update(func() { task.WorkerID = workerID })
+	task.MarkProcessing()
 
-		duration, size, preset, err := p.probeAndValidate(task)
-		if err != nil {
-			task.MarkFailed(err)
-			return nil, err
-		}
+	p.logger.Info("task assigned to remote worker",
+		"task_id", task.ID, "worker_id", workerID)
+	p.logTask(task.ID, "attempt %d started on worker %s", len(task.Attempts), workerID)
 
-		// Create temp file path for output
-		task.TempFile, err = p.tempFile(task.Input)
-		if err != nil {
-			p.logger.Error("failed to create temp file", "task_id", task.ID, "error", err)
-			task.MarkFailed(fmt.Errorf("failed to create temp file: %w", err))
-			return nil, err
-		}
+	duration, size, preset, err := p.probeAndValidate(task)
+	if err != nil {
+		p.failTask(task, err)
+		return nil, err
+	}
 
-		// Final check: if the task was cancelled during probe/setup,
-		// do not hand it out to a worker.
-		if task.cancelled.Load() {
-			task.MarkCancelled()
-			return nil, nil
-		}
+	// Create temp file path for output
+	if _, err = p.tempFile(task, preset.OutputExt(task.Input)); err != nil {
+		p.logger.Error("failed to create temp file", "task_id", task.ID, "error", err)
+		p.failTask(task, fmt.Errorf("failed to create temp file: %w", err))
+		return nil, err
+	}
 
-		return &AcquiredTask{
-			ID:            task.ID,
-			Preset:        preset.Name,
-			Params:        preset.Params,
-			FFmpegPath:    p.ffmpegBinary(),
-			InputSize:     size,
-			TotalDuration: duration,
-			OutputExt:     path.Ext(task.Input),
-		}, nil
-	default:
-		return nil, nil // No tasks available
+	// Final check: if the task was cancelled during probe/setup,
+	// do not hand it out to a worker.
+	if task.cancelled.Load() {
+		task.markCancelled()
+		return nil, nil
 	}
+
+	return &AcquiredTask{
+		ID:            task.ID,
+		Preset:        preset.Name,
+		Params:        preset.Params,
+		FFmpegPath:    p.ffmpegBinary(),
+		InputSize:     size,
+		TotalDuration: duration,
+		InputExt:      path.Ext(task.Input),
+		OutputExt:     path.Ext(task.TempFile),
+
+		TwoPass:          preset.TwoPass,
+		FirstPassParams:  preset.FirstPassParams,
+		SecondPassParams: preset.SecondPassParams,
+
+		TargetVMAF: preset.TargetVMAF,
+		CRFSearch:  preset.CRFSearch,
+	}, nil
 }
 
 // probeAndValidate probes the input file and validates the preset.
-// Returns duration, file size, and the resolved profile.
+// Returns duration, file size, and the resolved profile with its
+// templated parameters evaluated against the input.
 func (p *Processor) probeAndValidate(task *task) (float64, int64, transcoding.Profile, error) {
-	a, err := ffmpeg.Probe(task.Input)
+	probe, err := transcoding.Probe(task.Input)
 	if err != nil {
 		return 0, 0, transcoding.Profile{}, fmt.Errorf("probe failed: %w", err)
 	}
 
-	duration, err := probeDuration(a)
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
 	if err != nil {
 		return 0, 0, transcoding.Profile{}, fmt.Errorf("duration parse failed: %w", err)
 	}
@@ -249,16 +522,30 @@ func (p *Processor) probeAndValidate(task *task) (float64, int64, transcoding.Pr
 		return 0, 0, transcoding.Profile{}, fmt.Errorf("invalid preset: %s", task.Preset)
 	}
 
+	preset, err = preset.Render(probe)
+	if err != nil {
+		return 0, 0, transcoding.Profile{}, fmt.Errorf("failed to evaluate preset params: %w", err)
+	}
+
 	info, err := os.Stat(task.Input)
 	if err != nil {
 		return 0, 0, transcoding.Profile{}, fmt.Errorf("stat failed: %w", err)
 	}
 
+	task.update(func() {
+		task.duration = duration
+		task.passes = 1
+		if preset.TwoPass {
+			task.passes = 2
+		}
+	})
+
 	return duration, info.Size(), preset, nil
 }
 
 // UpdateProgress sets the progress for a task (called by remote workers).
-func (p *Processor) UpdateProgress(taskID uint64, progress float64) error {
+// stats is the latest FFmpeg progress update, nil if the worker sent none.
+func (p *Processor) UpdateProgress(taskID uint64, progress float64, stats *transcoding.Progress) error {
 	p.tasksMu.RLock()
 	task, ok := p.tasks[taskID]
 	p.tasksMu.RUnlock()
@@ -266,6 +553,22 @@ func (p *Processor) UpdateProgress(taskID uint64, progress float64) error {
 		return fmt.Errorf("task %d not found", taskID)
 	}
 	task.SetProgress(progress)
+	if stats != nil {
+		task.SetStats(*stats)
+	}
+	p.taskProgressed(task)
+	return nil
+}
+
+// SetCRFSearchResult records the outcome of a CRF search (called by remote workers).
+func (p *Processor) SetCRFSearchResult(taskID uint64, result transcoding.CRFSearchResult) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", taskID)
+	}
+	task.SetCRFSearch(result)
 	return nil
 }
 
@@ -280,13 +583,11 @@ func (p *Processor) RequeueTask(taskID uint64) error {
 	}
 	// Do not requeue a cancelled task.
 	if task.cancelled.Load() {
-		task.MarkCancelled()
+		task.markCancelled()
 		return nil
 	}
-	task.Status = TaskStatusPending
-	task.WorkerID = ""
-	task.Progress = 0
-	p.queue <- task
+	task.MarkPending()
+	p.queue.push(task)
 	p.logger.Info("task requeued after worker disconnect", "task_id", taskID)
 	return nil
 }
@@ -306,14 +607,13 @@ func (p *Processor) CompleteTask(taskID uint64, success bool, errMsg string) err
 	}
 
 	if !success {
-		task.MarkFailed(fmt.Errorf("%s", errMsg))
+		p.failTask(task, fmt.Errorf("%s", errMsg))
 		return nil
 	}
 
+	p.completeTempManifest(task)
 	task.MarkWaitingForResolution()
-	if p.onWaitingForResolution != nil {
-		p.onWaitingForResolution(task.State())
-	}
+	p.afterTranscode(task)
 	return nil
 }
 
@@ -0,0 +1,155 @@
+package processor
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+func TestAddTaskNonBlocking(t *testing.T) {
+	// No worker takes tasks off the queue, adding must not block on it
+	p := newTestProcessor(t, config.Config{})
+	for i := range 1000 {
+		p.AddTask(fmt.Sprintf("/media/batch/%04d.mkv", i), "x265", 0)
+	}
+
+	positions := p.queue.positions()
+	if len(positions) != 1000 {
+		t.Fatalf("%d tasks queued, want 1000", len(positions))
+	}
+	for id := uint64(1); id <= 1000; id++ {
+		if positions[id] != int(id) {
+			t.Fatalf("task %d at position %d, want %d", id, positions[id], id)
+		}
+	}
+}
+
+func TestAddTasks(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	p.AddTask("/media/first.mkv", "x265", 5)
+
+	var changes [][]uint64
+	p.queue.onChange = func(ids []uint64) { changes = append(changes, ids) }
+
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/media/batch/%04d.mkv", i)
+	}
+	ids := p.AddTasks(paths, "x265", 0)
+
+	if len(ids) != len(paths) {
+		t.Fatalf("AddTasks() returned %d ids, want %d", len(ids), len(paths))
+	}
+	for i, id := range ids {
+		if want := uint64(i + 2); id != want {
+			t.Fatalf("ids[%d] = %d, want %d", i, id, want)
+		}
+		if state := p.GetTask(id); state.Input != paths[i] || state.Status != TaskStatusPending {
+			t.Fatalf("task %d = %s %s, want %s pending", id, state.Input, state.Status, paths[i])
+		}
+	}
+	// The whole batch is one queue change, behind the higher priority task
+	if len(changes) != 1 {
+		t.Fatalf("queue changed %d times, want 1", len(changes))
+	}
+	if want := append([]uint64{1}, ids...); !slices.Equal(changes[0], want) {
+		t.Errorf("queue order = %v..., want %v...", changes[0][:3], want[:3])
+	}
+
+	if ids := p.AddTasks(nil, "x265", 0); ids != nil {
+		t.Errorf("AddTasks(nil) = %v, want nil", ids)
+	}
+}
+
+func TestAddDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.mkv", "b.MP4", "notes.txt", "sub/c.avi", "sub/d.srt", "queued.mkv"} {
+		writeFile(t, filepath.Join(dir, name), "")
+	}
+
+	p := newTestProcessor(t, config.Config{Profiles: []transcoding.Profile{{Name: "x265"}}})
+	queued := p.AddTask(filepath.Join(dir, "queued.mkv"), "x265", 0)
+
+	ids, err := p.AddDirectory(dir, "x265", 3)
+	if err != nil {
+		t.Fatalf("AddDirectory() error = %v", err)
+	}
+
+	var inputs []string
+	for _, id := range ids {
+		state := p.GetTask(id)
+		if state.Priority != 3 {
+			t.Errorf("task %d priority = %d, want 3", id, state.Priority)
+		}
+		inputs = append(inputs, state.Input)
+	}
+	want := []string{filepath.Join(dir, "a.mkv"), filepath.Join(dir, "b.MP4"), filepath.Join(dir, "sub/c.avi")}
+	if !slices.Equal(inputs, want) {
+		t.Errorf("added %v, want %v", inputs, want)
+	}
+	if pos := p.queue.positions(); pos[queued] != len(want)+1 {
+		t.Errorf("queued task position = %d, want %d", pos[queued], len(want)+1)
+	}
+
+	if _, err := p.AddDirectory(dir, "unknown", 0); err == nil {
+		t.Error("AddDirectory() with an unknown profile succeeded")
+	}
+	if _, err := p.AddDirectory(filepath.Join(dir, "missing"), "x265", 0); err == nil {
+		t.Error("AddDirectory() of a missing dir succeeded")
+	}
+}
+
+func TestHasTask(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	p.AddTask("/media/a.mkv", "x265", 0)
+	p.AddTask("/media/b.mkv", "x265", 0)
+	p.AddTask("/media/b.mkv", "av1", 0)
+	if err := p.CancelTask(2); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, preset string
+		want         bool
+	}{
+		{"/media/a.mkv", "x265", true},
+		{"/media/a.mkv", "av1", false},
+		{"/media/b.mkv", "x265", false}, // Cancelled
+		{"/media/b.mkv", "av1", true},
+		{"/media/c.mkv", "x265", false},
+	}
+	for _, tt := range tests {
+		if got := p.HasTask(tt.path, tt.preset); got != tt.want {
+			t.Errorf("HasTask(%s, %s) = %v, want %v", tt.path, tt.preset, got, tt.want)
+		}
+	}
+}
+
+func TestCancelTaskPublishesOnce(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	task := addProcessingTask(p, "")
+
+	var changes []TaskStatus
+	p.OnTaskEvent(func(ev Event) {
+		if ev.Kind == EventTaskChanged && ev.TaskID == task.ID {
+			changes = append(changes, ev.Task.Status)
+		}
+	})
+
+	if err := p.CancelTask(task.ID); err != nil {
+		t.Fatalf("CancelTask() error = %v", err)
+	}
+	// The processing goroutine sees the cancelled flag once ffmpeg exits
+	task.markCancelled()
+
+	if !slices.Equal(changes, []TaskStatus{TaskStatusCancelled}) {
+		t.Errorf("published changes = %v, want one to cancelled", changes)
+	}
+	if state := p.GetTask(task.ID); len(state.Attempts) != 1 || state.Attempts[0].Error != "cancelled" {
+		t.Errorf("attempts = %+v, want one cancelled", state.Attempts)
+	}
+}
@@ -0,0 +1,268 @@
+package processor
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// taskQueue is the ordered list of pending tasks shared by the local and
+// remote workers. A new task is inserted after every queued task with an
+// equal or higher priority; afterwards the order can be changed freely.
+// While the queue is paused, no task is handed out.
+type taskQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tasks  []*task
+	paused bool
+
+	// onChange is called with the new order after every modification.
+	onChange func(ids []uint64)
+}
+
+func newTaskQueue() *taskQueue {
+	q := &taskQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push inserts a task according to its priority.
+func (q *taskQueue) push(t *task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.insert(t)
+	q.changed()
+	q.cond.Signal()
+}
+
+// pushMany inserts tasks according to their priority like a push of each
+// of them, but changes the queue only once.
+func (q *taskQueue) pushMany(tasks []*task) {
+	if len(tasks) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Merge the added tasks, highest priority first, into the queue: each
+	// goes before the first queued task with a lower priority, as with insert
+	added := slices.Clone(tasks)
+	slices.SortStableFunc(added, func(a, b *task) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	merged := make([]*task, 0, len(q.tasks)+len(added))
+	for _, t := range q.tasks {
+		for len(added) > 0 && added[0].Priority > t.Priority {
+			merged = append(merged, added[0])
+			added = added[1:]
+		}
+		merged = append(merged, t)
+	}
+	q.tasks = append(merged, added...)
+	q.changed()
+	q.cond.Broadcast()
+}
+
+// waitReady blocks until a task is available and the queue is not paused,
+// without taking the task.
+func (q *taskQueue) waitReady() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) == 0 || q.paused {
+		q.cond.Wait()
+	}
+}
+
+// tryPop removes and returns the first task, or nil if the queue is empty or paused.
+func (q *taskQueue) tryPop() *task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.tasks) == 0 || q.paused {
+		return nil
+	}
+	return q.shift()
+}
+
+// peekFunc returns the first task accepted by the function without taking
+// it, or nil if there is none or the queue is paused.
+func (q *taskQueue) peekFunc(accept func(t *task) bool) *task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.paused {
+		return nil
+	}
+	i := slices.IndexFunc(q.tasks, accept)
+	if i < 0 {
+		return nil
+	}
+	return q.tasks[i]
+}
+
+// tryTake removes the given task unless it isn't queued anymore or the
+// queue is paused. Returns whether it was removed.
+func (q *taskQueue) tryTake(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.paused || q.take(id) == nil {
+		return false
+	}
+	q.changed()
+	return true
+}
+
+// setPaused pauses or resumes handing out tasks.
+func (q *taskQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paused = paused
+	if !paused {
+		q.cond.Broadcast()
+	}
+}
+
+// isPaused reports whether the queue is paused.
+func (q *taskQueue) isPaused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.paused
+}
+
+// remove takes a task out of the queue. Returns false if it was not queued.
+func (q *taskQueue) remove(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.take(id) == nil {
+		return false
+	}
+	q.changed()
+	return true
+}
+
+// setPriority changes the priority of a queued task and moves it to the
+// position a new task with that priority would get.
+func (q *taskQueue) setPriority(id uint64, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := q.take(id)
+	if t == nil {
+		return false
+	}
+	t.update(func() { t.Priority = priority })
+	q.insert(t)
+	q.changed()
+	return true
+}
+
+// move places a queued task at the given index. Indexes past the end of
+// the queue, as well as negative ones, move the task to the bottom.
+func (q *taskQueue) move(id uint64, index int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := q.take(id)
+	if t == nil {
+		return false
+	}
+	if index < 0 || index > len(q.tasks) {
+		index = len(q.tasks)
+	}
+	q.tasks = slices.Insert(q.tasks, index, t)
+	q.changed()
+	return true
+}
+
+// reorder moves the given tasks to the front of the queue in the given order.
+// Unknown IDs are ignored, tasks not listed keep their relative order.
+func (q *taskQueue) reorder(ids []uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ordered := make([]*task, 0, len(q.tasks))
+	for _, id := range ids {
+		if t := q.take(id); t != nil {
+			ordered = append(ordered, t)
+		}
+	}
+	q.tasks = append(ordered, q.tasks...)
+	q.changed()
+}
+
+// positions returns the 1-based queue position of every queued task.
+func (q *taskQueue) positions() map[uint64]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	positions := make(map[uint64]int, len(q.tasks))
+	for i, t := range q.tasks {
+		positions[t.ID] = i + 1
+	}
+	return positions
+}
+
+// position returns the 1-based queue position of a task, 0 if it isn't queued.
+func (q *taskQueue) position(id uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return slices.IndexFunc(q.tasks, func(t *task) bool {
+		return t.ID == id
+	}) + 1
+}
+
+// snapshot returns the queued tasks in queue order.
+func (q *taskQueue) snapshot() []*task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return slices.Clone(q.tasks)
+}
+
+func (q *taskQueue) insert(t *task) {
+	i := slices.IndexFunc(q.tasks, func(other *task) bool {
+		return other.Priority < t.Priority
+	})
+	if i < 0 {
+		i = len(q.tasks)
+	}
+	q.tasks = slices.Insert(q.tasks, i, t)
+}
+
+func (q *taskQueue) shift() *task {
+	t := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	q.changed()
+	return t
+}
+
+func (q *taskQueue) take(id uint64) *task {
+	i := slices.IndexFunc(q.tasks, func(t *task) bool {
+		return t.ID == id
+	})
+	if i < 0 {
+		return nil
+	}
+	t := q.tasks[i]
+	q.tasks = slices.Delete(q.tasks, i, i+1)
+	return t
+}
+
+func (q *taskQueue) changed() {
+	if q.onChange == nil {
+		return
+	}
+	ids := make([]uint64, len(q.tasks))
+	for i, t := range q.tasks {
+		ids[i] = t.ID
+	}
+	q.onChange(ids)
+}
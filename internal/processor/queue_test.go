@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"slices"
+	"testing"
+)
+
+// queueOf returns a queue holding tasks with the given priorities, pushed in
+// order with IDs counting from 1.
+func queueOf(priorities ...int) *taskQueue {
+	q := newTaskQueue()
+	for i, priority := range priorities {
+		q.push(newTask(uint64(i+1), "", "", priority))
+	}
+	return q
+}
+
+func queueIDs(q *taskQueue) []uint64 {
+	ids := make([]uint64, len(q.tasks))
+	for i, t := range q.tasks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+func TestTaskQueuePush(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int
+		want       []uint64
+	}{
+		{"fifo", []int{0, 0, 0}, []uint64{1, 2, 3}},
+		{"higher first", []int{0, 5, 10}, []uint64{3, 2, 1}},
+		{"after equal priority", []int{5, 0, 5}, []uint64{1, 3, 2}},
+		{"negative last", []int{-1, 0, -1, 1}, []uint64{4, 2, 1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queueIDs(queueOf(tt.priorities...)); !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskQueuePushMany(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued []int
+		moved  bool // Move the last queued task to the front first, breaking the priority order
+		added  []int
+	}{
+		{"empty queue", nil, false, []int{0, 5, 0, 10}},
+		{"equal priorities", []int{0, 0}, false, []int{0, 0}},
+		{"mixed priorities", []int{10, 5, 0}, false, []int{5, 0, 10, -1}},
+		{"reordered queue", []int{10, 5, 0}, true, []int{5, 1, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// pushMany must give the same order as pushing the tasks one by one
+			single, batch := queueOf(tt.queued...), queueOf(tt.queued...)
+			if tt.moved {
+				single.move(uint64(len(tt.queued)), 0)
+				batch.move(uint64(len(tt.queued)), 0)
+			}
+
+			var added []*task
+			for i, priority := range tt.added {
+				id := uint64(len(tt.queued) + i + 1)
+				single.push(newTask(id, "", "", priority))
+				added = append(added, newTask(id, "", "", priority))
+			}
+			changes := 0
+			batch.onChange = func([]uint64) { changes++ }
+			batch.pushMany(added)
+
+			if got, want := queueIDs(batch), queueIDs(single); !slices.Equal(got, want) {
+				t.Errorf("order = %v, want %v", got, want)
+			}
+			if changes != 1 {
+				t.Errorf("onChange called %d times, want 1", changes)
+			}
+		})
+	}
+}
+
+func TestTaskQueueMove(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    uint64
+		index int
+		want  []uint64
+		ok    bool
+	}{
+		{"to front", 3, 0, []uint64{3, 1, 2, 4}, true},
+		{"to middle", 1, 2, []uint64{2, 3, 1, 4}, true},
+		{"to last index", 2, 3, []uint64{1, 3, 4, 2}, true},
+		{"past the end", 1, 10, []uint64{2, 3, 4, 1}, true},
+		{"negative", 2, -1, []uint64{1, 3, 4, 2}, true},
+		{"unknown", 9, 0, []uint64{1, 2, 3, 4}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := queueOf(0, 0, 0, 0)
+			if ok := q.move(tt.id, tt.index); ok != tt.ok {
+				t.Errorf("move = %v, want %v", ok, tt.ok)
+			}
+			if got := queueIDs(q); !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskQueueReorder(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint64
+		want []uint64
+	}{
+		{"all", []uint64{4, 3, 2, 1}, []uint64{4, 3, 2, 1}},
+		{"some to front", []uint64{3, 1}, []uint64{3, 1, 2, 4}},
+		{"unknown ignored", []uint64{9, 4}, []uint64{4, 1, 2, 3}},
+		{"duplicates ignored", []uint64{2, 2}, []uint64{2, 1, 3, 4}},
+		{"none", nil, []uint64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := queueOf(0, 0, 0, 0)
+			q.reorder(tt.ids)
+			if got := queueIDs(q); !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskQueueSetPriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       uint64
+		priority int
+		want     []uint64
+	}{
+		{"raise to front", 3, 10, []uint64{3, 1, 2}},
+		{"lower to back", 1, -1, []uint64{2, 3, 1}},
+		{"after equal priority", 1, 0, []uint64{2, 3, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := queueOf(0, 0, 0)
+			if !q.setPriority(tt.id, tt.priority) {
+				t.Fatal("setPriority = false")
+			}
+			if got := queueIDs(q); !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskQueuePosition(t *testing.T) {
+	q := queueOf(0, 5, 0)
+	q.reorder([]uint64{3})
+
+	positions := q.positions()
+	for id := range uint64(5) {
+		if got, want := q.position(id), positions[id]; got != want {
+			t.Errorf("position(%d) = %d, want %d", id, got, want)
+		}
+	}
+	if got := q.snapshot(); len(got) != 3 || got[0].ID != 3 || got[1].ID != 2 || got[2].ID != 1 {
+		t.Errorf("snapshot = %v, want tasks 3, 2, 1", got)
+	}
+}
@@ -0,0 +1,256 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+// tempManifestFile is the manifest written into every task temp dir.
+const tempManifestFile = "task.json"
+
+// tempDirPrefix starts the name of every task temp dir. The temp dir may be
+// shared (e.g. /tmp), a dir without a manifest is only deleted with this prefix.
+const tempDirPrefix = "easy-transcoder-"
+
+// tempManifest describes the output in a task temp dir, so it can be
+// recovered after a crash or a restart that lost track of it.
+type tempManifest struct {
+	TaskID      uint64    `json:"task_id"`
+	Input       string    `json:"input"`
+	Preset      string    `json:"preset"`
+	Output      string    `json:"output"` // File name of the output in the temp dir
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at,omitzero"` // Set once the output is complete
+}
+
+// writeTempManifest writes the manifest of a task's temp dir, complete
+// marks the output as fully written.
+func writeTempManifest(task *task, complete bool) error {
+	dir := filepath.Dir(task.TempFile)
+	manifest := tempManifest{
+		TaskID:    task.ID,
+		Input:     task.Input,
+		Preset:    task.Preset,
+		Output:    filepath.Base(task.TempFile),
+		CreatedAt: time.Now(),
+	}
+	if info, err := os.Stat(filepath.Join(dir, tempManifestFile)); err == nil {
+		manifest.CreatedAt = info.ModTime()
+	}
+	if complete {
+		manifest.CompletedAt = time.Now()
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written through a rename, a crash never leaves half a manifest
+	tmp := filepath.Join(dir, "."+tempManifestFile)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, tempManifestFile))
+}
+
+// completeTempManifest marks the output of a task as complete in its manifest.
+func (p *Processor) completeTempManifest(task *task) {
+	if err := writeTempManifest(task, true); err != nil {
+		p.logger.Warn("failed to update temp manifest", "task_id", task.ID, "error", err)
+	}
+}
+
+// TempRecovery is what the startup scan of the temp dir did with a task temp dir.
+type TempRecovery struct {
+	Dir       string
+	Input     string // Empty without a manifest
+	TaskID    uint64 // Task the output was recovered into, 0 if deleted
+	Recovered bool
+	Reason    string // Why the dir was deleted
+	Size      int64  // Size of the output or of the deleted dir
+}
+
+// tempRecoveryLog holds the outcome of the startup scan until it is dismissed.
+type tempRecoveryLog struct {
+	mu      sync.Mutex
+	entries []TempRecovery
+}
+
+// TempRecovery returns what the startup scan of the temp dir recovered and deleted.
+func (p *Processor) TempRecovery() []TempRecovery {
+	p.tempRecovery.mu.Lock()
+	defer p.tempRecovery.mu.Unlock()
+	return slices.Clone(p.tempRecovery.entries)
+}
+
+// DismissTempRecovery clears the outcome of the startup scan.
+func (p *Processor) DismissTempRecovery() {
+	p.tempRecovery.mu.Lock()
+	defer p.tempRecovery.mu.Unlock()
+	p.tempRecovery.entries = nil
+}
+
+// recoverTempDirs scans the temp dir for task temp dirs no task refers to.
+// Complete outputs passing an ffprobe check are recovered as tasks waiting
+// for resolution, everything else created by a task is deleted. Recovered tasks that were
+// still queued are removed from pending, which is returned.
+func (p *Processor) recoverTempDirs(pending []*task) []*task {
+	tempDir := p.tempDir()
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.Error("failed to scan temp directory", "dir", tempDir, "error", err)
+		}
+		return pending
+	}
+
+	inUse := map[string]bool{}
+	for _, t := range p.tasks {
+		if t.TempFile != "" {
+			inUse[filepath.Dir(t.TempFile)] = true
+		}
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(tempDir, entry.Name())
+		if !entry.IsDir() || inUse[dir] {
+			continue
+		}
+		log := p.logger.With("dir", dir)
+
+		manifest, err := readTempManifest(dir)
+		if err != nil {
+			// Without a manifest only the prefix tells it was created by a task,
+			// anything else in a shared temp dir belongs to someone else
+			if !strings.HasPrefix(entry.Name(), tempDirPrefix) {
+				log.Info("skipping temp dir without a task manifest", "error", err)
+				continue
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				p.deleteTempDir(dir, "", "no manifest")
+			} else {
+				p.deleteTempDir(dir, "", fmt.Sprintf("unreadable manifest: %s", err))
+			}
+			continue
+		}
+
+		output := filepath.Join(dir, manifest.Output)
+		if manifest.CompletedAt.IsZero() {
+			p.deleteTempDir(dir, manifest.Input, "partial output")
+			continue
+		}
+		if _, err := os.Stat(manifest.Input); err != nil {
+			p.deleteTempDir(dir, manifest.Input, "input is gone")
+			continue
+		}
+		if err := checkRecoveredOutput(output); err != nil {
+			p.deleteTempDir(dir, manifest.Input, err.Error())
+			continue
+		}
+		info, err := os.Stat(output)
+		if err != nil {
+			log.Warn("skipping temp dir, failed to stat the output", "error", err)
+			continue
+		}
+
+		t, ok := p.tasks[manifest.TaskID]
+		switch {
+		case ok && t.Input == manifest.Input && (t.Status == TaskStatusPending || t.Status == TaskStatusFailed):
+			// The task was re-queued or failed before its completion was persisted
+			pending = slices.DeleteFunc(pending, func(other *task) bool { return other == t })
+			t.update(func() {
+				t.RetryAt = time.Time{}
+				t.Error = nil
+			})
+		case ok && t.Input == manifest.Input:
+			p.deleteTempDir(dir, manifest.Input, fmt.Sprintf("task %d is already %s", t.ID, t.Status))
+			continue
+		default:
+			t = newTask(p.taskAI.Add(1), manifest.Input, manifest.Preset, 0)
+			t.onChange = p.taskChanged
+			p.addTaskLocked(t)
+		}
+
+		t.update(func() { t.TempFile = output })
+		t.MarkWaitingForResolution()
+		p.afterTranscode(t)
+		p.logTask(t.ID, "output recovered from %s after a restart", dir)
+
+		log.Info("recovered completed output", "task_id", t.ID, "input", manifest.Input)
+		p.tempRecovery.entries = append(p.tempRecovery.entries, TempRecovery{
+			Dir:       dir,
+			Input:     manifest.Input,
+			TaskID:    t.ID,
+			Recovered: true,
+			Size:      info.Size(),
+		})
+	}
+
+	return pending
+}
+
+// readTempManifest reads the manifest of a task temp dir.
+func readTempManifest(dir string) (tempManifest, error) {
+	var manifest tempManifest
+	data, err := os.ReadFile(filepath.Join(dir, tempManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err == nil && manifest.Output == "" {
+		err = errors.New("no output")
+	}
+	return manifest, err
+}
+
+// checkRecoveredOutput checks that an output is a readable media file.
+func checkRecoveredOutput(output string) error {
+	probe, err := transcoding.Probe(output)
+	if err != nil {
+		return fmt.Errorf("output fails ffprobe: %s", err)
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err != nil || duration <= 0 {
+		return errors.New("output has no duration")
+	}
+	return nil
+}
+
+// deleteTempDir removes an orphaned task temp dir and records why.
+func (p *Processor) deleteTempDir(dir, input, reason string) {
+	size := dirSize(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		p.logger.Error("failed to delete orphaned temp dir", "dir", dir, "error", err)
+		return
+	}
+	p.logger.Info("deleted orphaned temp dir", "dir", dir, "input", input, "reason", reason)
+	p.tempRecovery.entries = append(p.tempRecovery.entries, TempRecovery{
+		Dir:    dir,
+		Input:  input,
+		Reason: reason,
+		Size:   size,
+	})
+}
+
+// dirSize returns the total size of the files in a directory tree.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
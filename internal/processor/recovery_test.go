@@ -0,0 +1,157 @@
+package processor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+// writeManifest writes the manifest of a task temp dir.
+func writeManifest(t *testing.T, dir string, manifest tempManifest) {
+	t.Helper()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, tempManifestFile), string(data))
+}
+
+func TestRecoverTempDirs(t *testing.T) {
+	fakeFFprobe(t)
+
+	media, tempDir := t.TempDir(), t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "tasks.db")
+	input := filepath.Join(media, "movie.mkv")
+	requeued := filepath.Join(media, "requeued.mkv")
+	writeMedia(t, input, "600.0", "video", "audio")
+	writeMedia(t, requeued, "600.0", "video", "audio")
+
+	completed := time.Now()
+	dir := func(name string) string { return filepath.Join(tempDir, name) }
+
+	// A complete output of a task the database doesn't know
+	writeManifest(t, dir("orphan"), tempManifest{TaskID: 40, Input: input, Preset: "x265", Output: "movie.mkv", CompletedAt: completed})
+	writeMedia(t, filepath.Join(dir("orphan"), "movie.mkv"), "600.0", "video", "audio")
+	// A complete output of a task re-queued before its completion was persisted
+	writeManifest(t, dir("requeued"), tempManifest{TaskID: 2, Input: requeued, Preset: "x265", Output: "requeued.mkv", CompletedAt: completed})
+	writeMedia(t, filepath.Join(dir("requeued"), "requeued.mkv"), "600.0", "video", "audio")
+	// Outputs that can't be used
+	writeManifest(t, dir("partial"), tempManifest{TaskID: 41, Input: input, Output: "movie.mkv"})
+	writeFile(t, filepath.Join(dir("partial"), "movie.mkv"), "half")
+	writeManifest(t, dir("gone"), tempManifest{TaskID: 42, Input: filepath.Join(media, "gone.mkv"), Output: "gone.mkv", CompletedAt: completed})
+	writeMedia(t, filepath.Join(dir("gone"), "gone.mkv"), "600.0", "video")
+	writeManifest(t, dir("broken"), tempManifest{TaskID: 43, Input: input, Output: "movie.mkv", CompletedAt: completed})
+	writeFile(t, filepath.Join(dir("broken"), "movie.mkv"), "not media")
+	// A task temp dir left before its manifest was written, and dirs of
+	// others sharing the temp dir
+	writeFile(t, filepath.Join(dir(tempDirPrefix+"123456"), "movie.mkv"), "crashed")
+	writeFile(t, filepath.Join(dir("123456"), "movie.mkv"), "keep")
+	writeFile(t, filepath.Join(dir("stray"), "notes.txt"), "keep")
+	writeFile(t, filepath.Join(dir("other"), tempManifestFile), "keep")
+
+	writeTaskDB(t, dbPath, []taskRecord{
+		{ID: 1, Input: "/media/other.mkv", Preset: "x265", Status: TaskStatusPending},
+		{ID: 2, Input: requeued, Preset: "x265", Status: TaskStatusPending},
+	}, []uint64{1, 2})
+
+	p := newTestProcessor(t, config.Config{DBPath: dbPath, TempDir: tempDir})
+
+	for _, name := range []string{"orphan", "requeued", "123456", "stray", "other"} {
+		if _, err := os.Stat(dir(name)); err != nil {
+			t.Errorf("temp dir %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"partial", "gone", "broken", tempDirPrefix + "123456"} {
+		if _, err := os.Stat(dir(name)); !os.IsNotExist(err) {
+			t.Errorf("temp dir %s not deleted: %v", name, err)
+		}
+	}
+
+	// The orphan becomes a new task, the re-queued task takes its output back
+	orphan := p.GetTask(3)
+	if orphan.Input != input || orphan.Status != TaskStatusWaitingForResolution || orphan.TempFile != filepath.Join(dir("orphan"), "movie.mkv") {
+		t.Errorf("orphan task = %s %s %s, want %s waiting", orphan.Input, orphan.Status, orphan.TempFile, input)
+	}
+	if state := p.GetTask(2); state.Status != TaskStatusWaitingForResolution || state.TempFile != filepath.Join(dir("requeued"), "requeued.mkv") {
+		t.Errorf("re-queued task = %s %s, want waiting", state.Status, state.TempFile)
+	}
+	if got := queueIDs(p.queue); !slices.Equal(got, []uint64{1}) {
+		t.Errorf("queue = %v, want [1]", got)
+	}
+
+	recovered := map[string]TempRecovery{}
+	for _, entry := range p.TempRecovery() {
+		recovered[filepath.Base(entry.Dir)] = entry
+	}
+	tests := []struct {
+		dir       string
+		recovered bool
+		taskID    uint64
+		reason    string
+	}{
+		{"orphan", true, 3, ""},
+		{"requeued", true, 2, ""},
+		{"partial", false, 0, "partial output"},
+		{"gone", false, 0, "input is gone"},
+		{"broken", false, 0, ""},
+		{tempDirPrefix + "123456", false, 0, "no manifest"},
+	}
+	for _, tt := range tests {
+		entry, ok := recovered[tt.dir]
+		if !ok {
+			t.Errorf("no recovery entry for %s", tt.dir)
+			continue
+		}
+		if entry.Recovered != tt.recovered || entry.TaskID != tt.taskID || tt.reason != "" && entry.Reason != tt.reason {
+			t.Errorf("entry for %s = %+v, want recovered %v into %d, reason %q", tt.dir, entry, tt.recovered, tt.taskID, tt.reason)
+		}
+	}
+	for _, name := range []string{"123456", "stray", "other"} {
+		if _, ok := recovered[name]; ok {
+			t.Errorf("%s dir has a recovery entry", name)
+		}
+	}
+
+	p.DismissTempRecovery()
+	if entries := p.TempRecovery(); len(entries) != 0 {
+		t.Errorf("%d entries after dismissing", len(entries))
+	}
+}
+
+func TestTempManifest(t *testing.T) {
+	dir := t.TempDir()
+	task := newTask(5, "/media/movie.mkv", "x265", 0)
+	task.TempFile = filepath.Join(dir, "movie.mkv")
+
+	if err := writeTempManifest(task, false); err != nil {
+		t.Fatalf("writeTempManifest() error = %v", err)
+	}
+	manifest, err := readTempManifest(dir)
+	if err != nil {
+		t.Fatalf("readTempManifest() error = %v", err)
+	}
+	if manifest.TaskID != 5 || manifest.Input != task.Input || manifest.Output != "movie.mkv" || !manifest.CompletedAt.IsZero() {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	if err := writeTempManifest(task, true); err != nil {
+		t.Fatalf("writeTempManifest() error = %v", err)
+	}
+	completed, err := readTempManifest(dir)
+	if err != nil {
+		t.Fatalf("readTempManifest() error = %v", err)
+	}
+	if completed.CompletedAt.IsZero() || completed.CreatedAt.After(completed.CompletedAt) {
+		t.Errorf("completed manifest = %+v", completed)
+	}
+
+	writeFile(t, filepath.Join(dir, tempManifestFile), `{"task_id": 5}`)
+	if _, err := readTempManifest(dir); err == nil {
+		t.Error("readTempManifest() of a manifest without output succeeded")
+	}
+}
@@ -1,34 +1,96 @@
 package processor
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 
 	"golang.org/x/sys/unix"
 )
 
-// ResolveTask handles the final resolution of a completed task.
-func (p *Processor) ResolveTask(ctx context.Context, taskID uint64, replace bool) {
-	log := p.logger.With("task_id", taskID, "replace", replace)
+// Resolution is how a task waiting for resolution is resolved.
+type Resolution string
 
-	log.Info("resolving task")
+const (
+	ResolutionReplace  Resolution = "replace"   // Replace the original with the output
+	ResolutionReject   Resolution = "reject"    // Keep the original and discard the output
+	ResolutionKeepBoth Resolution = "keep_both" // Keep the original and save the output as a new file
+)
 
-	task := p.tasks[taskID]
+// ParseResolution parses a resolution name.
+func ParseResolution(s string) (Resolution, error) {
+	switch r := Resolution(s); r {
+	case ResolutionReplace, ResolutionReject, ResolutionKeepBoth:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown resolution %q", s)
+}
 
-	if task.Status != TaskStatusWaitingForResolution {
-		log.Error("task is not in a resolvable state", "status", task.Status)
-		return
+// ResolveTask handles the final resolution of a completed task.
+// A replacement is refused when the output fails the sanity checks against
+// the input, unless force is set. Keeping both is refused when the new file
+// would overwrite an existing one. The resolution runs in the background,
+// the returned error only reports a task that can't be resolved.
+func (p *Processor) ResolveTask(taskID uint64, resolution Resolution, force bool) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		p.logger.Error("task not found", "task_id", taskID)
+		return fmt.Errorf("task %d not found", taskID)
 	}
+	return p.startResolution(task, resolution, force, "")
+}
 
-	task.MarkStatusReplacing()
+// startResolution starts the resolution of a task waiting for resolution.
+// autoResolution names the rule resolving the task, empty for a human, and
+// is recorded together with the transition.
+func (p *Processor) startResolution(task *task, resolution Resolution, force bool, autoResolution string) error {
+	log := p.logger.With("task_id", task.ID, "resolution", resolution, "force", force)
+
+	log.Info("resolving task")
+
+	// Concurrent resolutions (e.g. from the UI and the API) can't both start
+	status, ok := task.swapStatus(func(status TaskStatus) bool {
+		return status == TaskStatusWaitingForResolution
+	}, func(TaskStatus) {
+		task.update(func() {
+			// Clear a previous refusal
+			task.Error = nil
+			if autoResolution != "" {
+				task.AutoResolution = autoResolution
+			}
+		})
+		task.MarkStatusReplacing()
+	})
+	if !ok {
+		log.Error("task is not in a resolvable state", "status", status)
+		return fmt.Errorf("task %d is %s, only tasks waiting for resolution can be resolved", task.ID, status)
+	}
 
 	go func() {
+		if resolution == ResolutionReplace && !force && !p.config.ReplaceChecks.Disabled {
+			if err := p.checkOutput(task); err != nil {
+				log.Warn("replacement refused", "error", err)
+				task.MarkReplaceRefused(err)
+				return
+			}
+		}
+
 		// Perform the actual resolution
-		err := p.resolveTask(task, replace)
+		err := p.resolveTask(task, resolution)
 
-		if err != nil {
+		if errors.Is(err, fs.ErrExist) || errors.Is(err, errInsufficientSpace) {
+			log.Warn("resolution refused", "error", err)
+			task.MarkReplaceRefused(err)
+		} else if err != nil {
 			log.Error("task resolution failed", "error", err)
 			task.MarkFailed(err)
 		} else {
@@ -37,14 +99,51 @@ func (p *Processor) ResolveTask(ctx context.Context, taskID uint64, replace bool
 		}
 	}()
 
+	return nil
 }
 
-// resolveTask completes a task that's waiting for resolution by either
-// keeping the original file or replacing it with the transcoded version.
-func (p *Processor) resolveTask(task *task, replace bool) error {
-	log := p.logger.With("task_id", task.ID, "replace", replace, "temp_file", task.TempFile, "input_file", task.Input)
+// checkOutput compares the output of a task to its input before a replacement.
+func (p *Processor) checkOutput(task *task) error {
+	input, err := transcoding.Probe(task.Input)
+	if err != nil {
+		return fmt.Errorf("replacement refused, failed to probe input: %w", err)
+	}
+	output, err := transcoding.Probe(task.TempFile)
+	if err != nil {
+		return fmt.Errorf("replacement refused, failed to probe output: %w", err)
+	}
+
+	problems := transcoding.CheckOutput(input, output, p.config.ReplaceChecks.DurationTolerance)
+	if len(problems) > 0 {
+		return fmt.Errorf("replacement refused, output differs from input: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// resolveTask completes a task that's waiting for resolution by keeping the
+// original file, replacing it with the transcoded version or keeping both.
+func (p *Processor) resolveTask(task *task, resolution Resolution) error {
+	log := p.logger.With("task_id", task.ID, "resolution", resolution, "temp_file", task.TempFile, "input_file", task.Input)
+
+	if resolution == ResolutionKeepBoth {
+		output, err := p.keepBothPath(task)
+		if err != nil {
+			return err
+		}
+
+		log.Info("saving output as new file", "output", output)
+		err = p.saveNewFile(task.TempFile, output)
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("keep both refused, %s already exists: %w", output, fs.ErrExist)
+		}
+		if err != nil {
+			log.Error("saving output failed", "error", err)
+			return err
+		}
+		task.update(func() { task.Output = output })
+	}
 
-	if !replace {
+	if resolution != ResolutionReplace {
 		// If not replacing, just clean up temp file
 		log.Info("keeping original file")
 
@@ -63,14 +162,83 @@ func (p *Processor) resolveTask(task *task, replace bool) error {
 	}
 
 	// Replace the original file with the transcoded version
-	log.Info("replacing original file with transcoded version")
+	output := replacePath(task)
+	log.Info("replacing original file with transcoded version", "output", output)
+
+	if output != task.Input {
+		// A new container gets the new extension, it must not overwrite an unrelated file
+		if _, err := os.Lstat(output); err == nil {
+			return fmt.Errorf("replacement refused, %s already exists: %w", output, fs.ErrExist)
+		}
+	}
+
+	if err := p.checkReplaceSpace(task, output); err != nil {
+		return err
+	}
+
+	// The output takes over the attributes of the original
+	preserve := p.config.Preserve
+	attrs, warnings, err := readAttrs(task.Input, preserve.XAttrs || preserve.ACLs)
+	if err != nil {
+		log.Error("failed to read the original", "error", err)
+		return fmt.Errorf("failed to read the original: %w", err)
+	}
 
-	err := p.replaceFile(task.TempFile, task.Input)
+	// Stage the output next to the original first, so the original is only
+	// moved to the backup dir once nothing but a rename is left to do
+	staged, attrWarnings, err := p.stageFile(task.TempFile, output, attrs, preserve)
 	if err != nil {
 		log.Error("file replacement failed", "error", err)
 		return err
 	}
 
+	// Keep the original in the backup dir
+	backup := ""
+	if p.config.Backup.Dir != "" {
+		backup, err = p.backupOriginal(task, output)
+		if err != nil {
+			log.Error("backup of the original failed", "error", err)
+			os.Remove(staged)
+			return fmt.Errorf("failed to back up the original: %w", err)
+		}
+		log.Info("original backed up", "backup", backup)
+	}
+
+	if err := p.commitStaged(staged, output); err != nil {
+		log.Error("file replacement failed", "error", err)
+		if backup != "" {
+			if err := p.restoreBackup(backup, task.Input); err != nil {
+				log.Error("failed to restore the original from its backup", "backup", backup, "error", err)
+			}
+		}
+		return err
+	}
+
+	warnings = append(warnings, attrWarnings...)
+	for _, warning := range warnings {
+		log.Warn("attribute of the original not preserved", "warning", warning)
+		p.logTask(task.ID, "warning: %s", warning)
+	}
+	task.update(func() { task.Warnings = warnings })
+
+	if backup != "" {
+		task.update(func() { task.Backup = backup })
+		p.logTask(task.ID, "original backed up to %s", backup)
+		go p.pruneBackups()
+	}
+
+	if output != task.Input {
+		// The output is in place under its new name, only now remove the original
+		// (unless it was already moved to the backup dir)
+		if err := os.Remove(task.Input); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("failed to remove the renamed original", "error", err)
+			p.logTask(task.ID, "replaced by %s, but failed to remove the original: %s", output, err)
+		} else {
+			p.logTask(task.ID, "replaced and renamed to %s", output)
+		}
+		task.update(func() { task.Output = output })
+	}
+
 	// Clean up temp directory
 	if task.TempFile != "" {
 		log.Debug("cleaning up temp directory", "dir", filepath.Dir(task.TempFile))
@@ -88,12 +256,136 @@ func (p *Processor) resolveTask(task *task, replace bool) error {
 	return nil
 }
 
-// replaceFile replaces the destination file with the contents of the source file.
-// Uses a safer approach with a single temporary file in the same directory as the destination.
-func (p *Processor) replaceFile(src, dst string) error {
+// replacePath returns where replacing the input of a task saves the output:
+// the input itself, or the input renamed to the extension of the output
+// when the profile writes another container.
+func replacePath(task *task) string {
+	inputExt, outputExt := filepath.Ext(task.Input), filepath.Ext(task.TempFile)
+	if task.TempFile == "" || strings.EqualFold(inputExt, outputExt) {
+		return task.Input
+	}
+	return strings.TrimSuffix(task.Input, inputExt) + outputExt
+}
+
+// ReplacePath returns where replacing the input of a task would save the
+// output and whether another file already exists there.
+func (p *Processor) ReplacePath(taskID uint64) (string, bool, error) {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return "", false, fmt.Errorf("task %d not found", taskID)
+	}
+
+	output := replacePath(task)
+	if output == task.Input {
+		return output, false, nil
+	}
+	_, err := os.Lstat(output)
+	return output, err == nil, nil
+}
+
+// keepBothPath returns where the "keep both" resolution saves the output of a task.
+func (p *Processor) keepBothPath(task *task) (string, error) {
+	ext := strings.TrimPrefix(filepath.Ext(task.TempFile), ".")
+	output, err := p.config.KeepBoth.Path(task.Input, task.Preset, ext)
+	if err != nil {
+		return "", err
+	}
+	if output == filepath.Clean(task.Input) {
+		return "", fmt.Errorf("keep both refused, %s is the input: %w", output, fs.ErrExist)
+	}
+	return output, nil
+}
+
+// KeepBothPath returns where the "keep both" resolution would save the output
+// of a task and whether a file already exists there.
+func (p *Processor) KeepBothPath(taskID uint64) (string, bool, error) {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return "", false, fmt.Errorf("task %d not found", taskID)
+	}
+
+	output, err := p.keepBothPath(task)
+	if err != nil {
+		return "", errors.Is(err, fs.ErrExist), err
+	}
+	_, err = os.Stat(output)
+	return output, err == nil, nil
+}
+
+// saveNewFile copies src to dst, which must not exist yet. On the same
+// filesystem the file is hard linked, otherwise it is copied.
+func (p *Processor) saveNewFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := os.Link(src, dst)
+	if err == nil || errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	p.logger.Debug("hard link failed, copying", "src", src, "dst", dst, "error", err)
+
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst with the permissions of src, dst must not exist yet.
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL refuses an existing destination
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// replaceFile replaces the original file with the contents of the source file,
+// saved as dst. dst is the original itself, or its new name when the container
+// changes, the caller removes the original then. The new file gets the
+// attributes of the original selected by preserve, the ones that couldn't
+// be set are returned as warnings.
+func (p *Processor) replaceFile(src, dst string, attrs fileAttrs, preserve config.PreserveConfig) ([]string, error) {
+	staged, warnings, err := p.stageFile(src, dst, attrs, preserve)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.commitStaged(staged, dst); err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
+
+// stageFile copies src into a temporary file in the directory of dst, with
+// the attributes of the original selected by preserve, so it can be renamed
+// over dst atomically. It returns the temporary file and the attributes that
+// couldn't be set as warnings.
+func (p *Processor) stageFile(src, dst string, attrs fileAttrs, preserve config.PreserveConfig) (string, []string, error) {
 	log := p.logger.With("src", src, "dst", dst)
 
-	log.Debug("replacing file")
+	log.Debug("staging file")
 
 	// Create a temporary file in the same directory as the destination
 	tmpFile := filepath.Join(filepath.Dir(dst), ".tmp_"+filepath.Base(dst))
@@ -102,7 +394,7 @@ func (p *Processor) replaceFile(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		log.Error("failed to open source file", "error", err)
-		return err
+		return "", nil, err
 	}
 	defer srcFile.Close()
 
@@ -110,7 +402,7 @@ func (p *Processor) replaceFile(src, dst string) error {
 	srcInfo, err := srcFile.Stat()
 	if err != nil {
 		log.Error("failed to get source file stats", "error", err)
-		return err
+		return "", nil, err
 	}
 	srcSize := srcInfo.Size()
 
@@ -118,7 +410,7 @@ func (p *Processor) replaceFile(src, dst string) error {
 	tmpDstFile, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Error("failed to create temporary file", "error", err)
-		return err
+		return "", nil, err
 	}
 	defer func() {
 		if tmpDstFile != nil {
@@ -145,7 +437,7 @@ func (p *Processor) replaceFile(src, dst string) error {
 		tmpDstFile.Close()
 		tmpDstFile = nil
 		os.Remove(tmpFile) // Clean up temp file on error
-		return err
+		return "", nil, err
 	}
 
 	// Close the temporary file before renaming
@@ -153,26 +445,25 @@ func (p *Processor) replaceFile(src, dst string) error {
 		log.Error("failed to close temporary file", "error", err)
 		tmpDstFile = nil
 		os.Remove(tmpFile)
-		return err
+		return "", nil, err
 	}
 	tmpDstFile = nil
 
-	// Preserve original file permissions if destination file exists
-	if fileInfo, err := os.Stat(dst); err == nil {
-		if err = os.Chmod(tmpFile, fileInfo.Mode()); err != nil {
-			log.Warn("failed to preserve file permissions", "error", err)
-			// Continue despite permission error
-		}
-	}
+	// Preserve the attributes of the original, the rename keeps them
+	warnings := applyAttrs(tmpFile, attrs, preserve)
 
-	// Atomically rename the temporary file to the destination
-	if err = os.Rename(tmpFile, dst); err != nil {
-		log.Error("failed to rename temporary file to destination", "error", err)
-		os.Remove(tmpFile) // Clean up temp file on error
+	log.Debug("file staged successfully", "bytes", bytesWritten)
+	return tmpFile, warnings, nil
+}
+
+// commitStaged atomically renames a staged file to its destination.
+// The staged file is removed when the rename fails.
+func (p *Processor) commitStaged(staged, dst string) error {
+	if err := os.Rename(staged, dst); err != nil {
+		p.logger.Error("failed to rename temporary file to destination", "src", staged, "dst", dst, "error", err)
+		os.Remove(staged) // Clean up temp file on error
 		return err
 	}
-
-	p.logger.Debug("file copied successfully", "bytes", bytesWritten)
 	p.logger.Info("file replaced successfully", "dst", dst)
 	return nil
 }
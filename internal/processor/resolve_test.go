@@ -0,0 +1,204 @@
+package processor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+)
+
+// fakeFFprobe puts an ffprobe on the PATH that prints the content of the
+// probed file, so test media files are written as ffprobe JSON, see writeMedia.
+func fakeFFprobe(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\ncat \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// writeMedia writes a media file probed by fakeFFprobe as the given streams.
+func writeMedia(t *testing.T, path string, duration string, codecTypes ...string) {
+	t.Helper()
+	probe := transcoding.FFProbeData{Format: transcoding.FFProbeFormat{Filename: path, Duration: duration}}
+	for i, codecType := range codecTypes {
+		probe.Streams = append(probe.Streams, transcoding.FFProbeStream{Index: i, CodecType: codecType})
+	}
+	data, err := json.Marshal(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(data))
+}
+
+// addWaitingTask adds a task whose transcode of input to output finished.
+func addWaitingTask(p *Processor, input, output string) *task {
+	p.tasksMu.Lock()
+	defer p.tasksMu.Unlock()
+
+	t := newTask(p.taskAI.Add(1), input, "x265", 0)
+	t.onChange = p.taskChanged
+	t.TempFile = output
+	t.Status = TaskStatusWaitingForResolution
+	p.addTaskLocked(t)
+	return t
+}
+
+// waitStatus waits until the task leaves the given status and returns its state.
+func waitStatus(t *testing.T, p *Processor, id uint64, status TaskStatus) TaskState {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state := p.GetTask(id)
+		if state.Status != status {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %d still %s", id, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolveTaskReplaceChecks(t *testing.T) {
+	fakeFFprobe(t)
+
+	tests := []struct {
+		name    string
+		streams []string // Of the output, the input has a video and an audio stream
+		force   bool
+		want    TaskStatus
+	}{
+		{"output matches", []string{"video", "audio"}, false, TaskStatusCompleted},
+		{"stream dropped", []string{"video"}, false, TaskStatusWaitingForResolution},
+		{"stream dropped and forced", []string{"video"}, true, TaskStatusCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "media", "movie.mkv")
+			output := filepath.Join(dir, "temp", "movie.mkv")
+			writeMedia(t, input, "600.0", "video", "audio")
+			writeMedia(t, output, "600.0", tt.streams...)
+			outputData, _ := os.ReadFile(output)
+
+			p := newTestProcessor(t, config.Config{})
+			task := addWaitingTask(p, input, output)
+
+			if err := p.ResolveTask(task.ID, ResolutionReplace, tt.force); err != nil {
+				t.Fatalf("ResolveTask() error = %v", err)
+			}
+			state := waitStatus(t, p, task.ID, TaskStatusReplacing)
+			if state.Status != tt.want {
+				t.Fatalf("status = %s (%v), want %s", state.Status, state.Error, tt.want)
+			}
+
+			data, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replaced := string(data) == string(outputData)
+			if tt.want == TaskStatusCompleted {
+				if !replaced {
+					t.Error("input not replaced by the output")
+				}
+				return
+			}
+
+			// A refused replacement keeps both files and tells why
+			if replaced {
+				t.Error("input replaced by the refused output")
+			}
+			if _, err := os.Stat(output); err != nil {
+				t.Errorf("output of refused replacement: %v", err)
+			}
+			if state.Error == nil || !strings.Contains(state.Error.Error(), "audio streams 1 -> 0") {
+				t.Errorf("error = %v, want the dropped audio stream", state.Error)
+			}
+
+			// The refusal is cleared by the next resolution
+			if err := p.ResolveTask(task.ID, ResolutionReplace, true); err != nil {
+				t.Fatalf("forced ResolveTask() error = %v", err)
+			}
+			state = waitStatus(t, p, task.ID, TaskStatusReplacing)
+			if state.Status != TaskStatusCompleted || state.Error != nil {
+				t.Errorf("after forced replacement status = %s (%v), want completed", state.Status, state.Error)
+			}
+		})
+	}
+}
+
+func TestResolveTaskOnlyWaiting(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "movie.mkv")
+	output := filepath.Join(dir, "temp", "movie.mkv")
+	writeFile(t, input, "input")
+	writeFile(t, output, "output")
+
+	p := newTestProcessor(t, config.Config{})
+	task := addWaitingTask(p, input, output)
+
+	if err := p.ResolveTask(task.ID, ResolutionReject, false); err != nil {
+		t.Fatalf("ResolveTask() error = %v", err)
+	}
+	// The first resolution is running or done, a second one is refused
+	if err := p.ResolveTask(task.ID, ResolutionReplace, false); err == nil {
+		t.Error("second ResolveTask() succeeded")
+	}
+	if state := waitStatus(t, p, task.ID, TaskStatusReplacing); state.Status != TaskStatusCompleted {
+		t.Errorf("status = %s, want completed", state.Status)
+	}
+	if _, err := os.Stat(filepath.Dir(output)); !os.IsNotExist(err) {
+		t.Errorf("temp dir of rejected output: %v", err)
+	}
+	if err := p.ResolveTask(99, ResolutionReject, false); err == nil {
+		t.Error("ResolveTask() of an unknown task succeeded")
+	}
+}
+
+func TestApplyResolutionRules(t *testing.T) {
+	rules := []transcoding.ResolutionRule{{Name: "always", Action: transcoding.RuleActionReject}}
+
+	tests := []struct {
+		name   string
+		status TaskStatus // Set before the rules run, e.g. by a human
+		want   TaskStatus
+		auto   bool // AutoResolution is recorded
+	}{
+		{"waiting", TaskStatusWaitingForResolution, TaskStatusCompleted, true},
+		{"resolved by hand", TaskStatusReplacing, TaskStatusReplacing, false},
+		{"cancelled", TaskStatusCancelled, TaskStatusCancelled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input, output := filepath.Join(dir, "movie.mkv"), filepath.Join(dir, "temp", "movie.mkv")
+			writeFile(t, input, "original")
+			writeFile(t, output, "transcoded")
+
+			p := newTestProcessor(t, config.Config{})
+			task := addWaitingTask(p, input, output)
+			task.Status = tt.status
+
+			p.applyResolutionRules(task, rules)
+
+			state := p.GetTask(task.ID)
+			if tt.status == TaskStatusWaitingForResolution {
+				state = waitStatus(t, p, task.ID, TaskStatusReplacing)
+			}
+			if state.Status != tt.want {
+				t.Errorf("status = %s (%v), want %s", state.Status, state.Error, tt.want)
+			}
+			if auto := state.AutoResolution != ""; auto != tt.auto {
+				t.Errorf("auto resolution = %q, want recorded %v", state.AutoResolution, tt.auto)
+			}
+		})
+	}
+}
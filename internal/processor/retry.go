@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// failTask marks a task as failed while processing and schedules an automatic
+// retry if the task has attempts left according to the retry policy.
+func (p *Processor) failTask(task *task, err error) {
+	// Logged first, the log of a finished task is evicted
+	p.logTask(task.ID, "failed: %s", err)
+	task.MarkFailed(err)
+
+	// A task failed by the disk space guard didn't start, it would only fail
+	// again without counting an attempt, it waits to be retried by hand
+	policy := p.config.Retry
+	attempts := len(task.Attempts)
+	if attempts >= policy.MaxAttempts || task.cancelled.Load() || errors.Is(err, errInsufficientSpace) {
+		return
+	}
+
+	// The backoff doubles with every attempt
+	delay := time.Duration(policy.Backoff) * time.Second
+	maxDelay := time.Duration(policy.MaxBackoff) * time.Second
+	for range attempts - 1 {
+		if maxDelay > 0 && delay >= maxDelay {
+			break
+		}
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	p.logger.Info("scheduling retry of failed task",
+		"task_id", task.ID, "attempt", attempts, "max_attempts", policy.MaxAttempts, "delay", delay)
+	p.scheduleRetry(task, time.Now().Add(delay))
+}
+
+// scheduleRetry retries a failed task at the given time.
+func (p *Processor) scheduleRetry(task *task, at time.Time) {
+	// The timer is armed only after the change is published, a retry due
+	// right away would otherwise reset the task while it is being published
+	timer := time.AfterFunc(time.Hour, func() {
+		// A manual retry in the meantime supersedes this one
+		_, ok := p.retry(task, func(status TaskStatus) bool {
+			return status == TaskStatusFailed && task.RetryAt.Equal(at)
+		})
+		if ok {
+			p.logger.Info("retried failed task", "task_id", task.ID)
+		}
+	})
+	timer.Stop()
+
+	_, ok := task.swapStatus(func(status TaskStatus) bool {
+		return status == TaskStatusFailed
+	}, func(TaskStatus) {
+		task.update(func() {
+			task.RetryAt = at
+			task.retryTimer = timer
+		})
+	})
+	if ok {
+		task.changed()
+		timer.Reset(time.Until(at))
+	}
+}
+
+// RetryTask puts a failed or cancelled task back into the queue.
+func (p *Processor) RetryTask(id uint64) error {
+	p.tasksMu.RLock()
+	task, ok := p.tasks[id]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+
+	// Concurrent retries (e.g. from the UI and the timer) can't both queue the task
+	status, ok := p.retry(task, func(status TaskStatus) bool {
+		return status == TaskStatusFailed || status == TaskStatusCancelled
+	})
+	if !ok {
+		return fmt.Errorf("task %d is %s, only failed and cancelled tasks can be retried", id, status)
+	}
+	p.logger.Info("retried task", "task_id", id, "status", status)
+	return nil
+}
+
+// retry resets a task and queues it again if allowed accepts its status.
+// The output of the previous attempt is discarded. It returns the status
+// before the retry and whether the task was retried.
+func (p *Processor) retry(task *task, allowed func(TaskStatus) bool) (TaskStatus, bool) {
+	status, ok := task.swapStatus(allowed, func(TaskStatus) {
+		if task.retryTimer != nil {
+			task.retryTimer.Stop()
+		}
+		if task.TempFile != "" {
+			os.RemoveAll(filepath.Dir(task.TempFile))
+		}
+		// Stops metric calculations still running on the discarded output
+		task.cancelCtx()
+
+		task.update(func() {
+			task.retryTimer = nil
+			task.RetryAt = time.Time{}
+			task.TempFile = ""
+			task.Error = nil
+			task.ctx, task.cancelCtx = context.WithCancel(context.Background())
+		})
+		task.resetOutput()
+		task.cancelled.Store(false)
+
+		task.MarkPending()
+	})
+	if ok {
+		p.queue.push(task)
+	}
+	return status, ok
+}
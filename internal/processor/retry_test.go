@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+// addFailedTask adds a task that failed its first attempt.
+func addFailedTask(p *Processor) *task {
+	t := addProcessingTask(p, "")
+	t.MarkFailed(errors.New("exit status 1"))
+	return t
+}
+
+func TestRetryTask(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{})
+
+	failed := addFailedTask(p)
+	output := filepath.Join(dir, "1", "movie.mkv")
+	writeFile(t, output, "partial")
+	failed.TempFile = output
+	cancelled := addProcessingTask(p, "")
+	if err := p.CancelTask(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	processing := addProcessingTask(p, "")
+
+	tests := []struct {
+		name    string
+		id      uint64
+		wantErr bool
+	}{
+		{"failed", failed.ID, false},
+		{"cancelled", cancelled.ID, false},
+		{"processing", processing.ID, true},
+		{"retried twice", failed.ID, true}, // Pending by now
+		{"unknown", 99, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.RetryTask(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RetryTask() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if state := p.GetTask(tt.id); state.Status != TaskStatusPending || state.Error != nil {
+				t.Errorf("task = %s (%v), want pending without an error", state.Status, state.Error)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Dir(output)); !os.IsNotExist(err) {
+		t.Errorf("temp dir of the failed attempt: %v", err)
+	}
+	if got, want := queueIDs(p.queue), []uint64{failed.ID, cancelled.ID}; !slices.Equal(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+}
+
+func TestScheduledRetry(t *testing.T) {
+	p := newTestProcessor(t, config.Config{})
+	task := addFailedTask(p)
+
+	at := time.Now().Add(50 * time.Millisecond)
+	p.scheduleRetry(task, at)
+	if state := p.GetTask(task.ID); state.Status != TaskStatusFailed || !state.RetryAt.Equal(at) {
+		t.Fatalf("task = %s retried at %v, want failed until %v", state.Status, state.RetryAt, at)
+	}
+
+	state := waitStatus(t, p, task.ID, TaskStatusFailed)
+	if state.Status != TaskStatusPending || !state.RetryAt.IsZero() {
+		t.Errorf("task = %s retried at %v, want pending", state.Status, state.RetryAt)
+	}
+	if pos := p.queue.positions(); len(pos) != 1 || pos[task.ID] != 1 {
+		t.Errorf("queue positions = %v, want the task once", pos)
+	}
+
+	// A scheduled retry is dropped once the task failed again and was rescheduled
+	p.queue.remove(task.ID)
+	task.MarkProcessing()
+	task.MarkFailed(errors.New("exit status 1"))
+	p.scheduleRetry(task, time.Now().Add(time.Hour))
+	stale := task.retryTimer
+	if _, ok := p.retry(task, func(status TaskStatus) bool {
+		return status == TaskStatusFailed && task.RetryAt.Equal(at)
+	}); ok {
+		t.Error("stale scheduled retry ran")
+	}
+	if task.retryTimer != stale || p.GetTask(task.ID).Status != TaskStatusFailed {
+		t.Error("stale scheduled retry reset the task")
+	}
+}
+
+func TestRetryTaskRace(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{})
+
+	for range 50 {
+		task := addFailedTask(p)
+		task.TempFile = filepath.Join(dir, strconv.FormatUint(task.ID, 10), "movie.mkv")
+		writeFile(t, task.TempFile, "partial")
+
+		// The timer and manual retries race for the same failed task
+		var retried atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if p.RetryTask(task.ID) == nil {
+					retried.Add(1)
+				}
+			}()
+		}
+		p.scheduleRetry(task, time.Now())
+		close(start)
+		wg.Wait()
+		waitStatus(t, p, task.ID, TaskStatusFailed)
+		// Let a late timer run, it must find the task pending
+		time.Sleep(10 * time.Millisecond)
+
+		if n := retried.Load(); n > 1 {
+			t.Fatalf("task %d retried manually %d times", task.ID, n)
+		}
+		// A double push queues the task twice, at the second position
+		if pos := p.queue.positions(); len(pos) != 1 || pos[task.ID] != 1 {
+			t.Fatalf("queue positions = %v, want task %d once", pos, task.ID)
+		}
+		p.queue.remove(task.ID)
+	}
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/load"
+)
+
+// waitSchedule blocks until the schedule rules allow the local worker to
+// start a new task. While it waits, the reason is exposed by ScheduleHold.
+// With load limits, one task starts per check interval, so the load is
+// sampled again with the started task running before the next one starts.
+func (p *Processor) waitSchedule() {
+	schedule := p.config.Schedule
+	interval := time.Duration(max(1, schedule.CheckInterval)) * time.Second
+	loadLimited := schedule.MaxLoad > 0 || schedule.MaxCPU > 0
+
+	for {
+		p.scheduleMu.Lock()
+		wait := time.Until(p.scheduleNext)
+		p.scheduleMu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		// Not under the lock, sampling the CPU usage takes a second
+		reason := p.checkSchedule(time.Now())
+		if reason == "" {
+			p.scheduleMu.Lock()
+			// Another slot started a task since the sample was taken
+			started := time.Now().Before(p.scheduleNext)
+			if !started && loadLimited {
+				p.scheduleNext = time.Now().Add(interval)
+			}
+			p.scheduleMu.Unlock()
+			if started {
+				continue
+			}
+
+			if p.scheduleHold.Swap(nil) != nil {
+				p.logger.Info("schedule allows processing again")
+				p.events.Publish(Event{Kind: EventQueueChanged})
+			}
+			return
+		}
+
+		if prev := p.scheduleHold.Swap(&reason); prev == nil || *prev != reason {
+			p.logger.Info("queue held by schedule", "reason", reason)
+			p.events.Publish(Event{Kind: EventQueueChanged})
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ScheduleHold returns why the local worker, or without one waiting the
+// remote workers, currently don't start new tasks, or an empty string when
+// they aren't held by the schedule.
+func (p *Processor) ScheduleHold() string {
+	if reason := p.scheduleHold.Load(); reason != nil {
+		return *reason
+	}
+	return p.RemoteScheduleHold()
+}
+
+// checkWindows returns why a new task may not start at the given time
+// according to the schedule windows, or an empty string if it may.
+func (p *Processor) checkWindows(now time.Time) string {
+	windows := p.config.Schedule.Windows
+	if len(windows) > 0 && !slices.ContainsFunc(windows, func(w config.ScheduleWindow) bool {
+		return w.Contains(now)
+	}) {
+		return "outside the allowed hours"
+	}
+	return ""
+}
+
+// RemoteScheduleHold returns why remote workers currently don't get new
+// tasks, or an empty string when they do. Only the time windows apply to
+// them, the load and CPU limits are those of this machine.
+func (p *Processor) RemoteScheduleHold() string {
+	return p.checkWindows(time.Now())
+}
+
+// checkSchedule evaluates the schedule rules at the given time and returns
+// the reason a new task may not start, or an empty string if it may.
+func (p *Processor) checkSchedule(now time.Time) string {
+	schedule := p.config.Schedule
+
+	if reason := p.checkWindows(now); reason != "" {
+		return reason
+	}
+
+	if schedule.MaxLoad > 0 {
+		avg, err := load.Avg()
+		if err != nil {
+			p.logger.Warn("failed to read system load, ignoring max_load", "error", err)
+		} else if avg.Load1 > schedule.MaxLoad {
+			return fmt.Sprintf("system load %.2f above %g", avg.Load1, schedule.MaxLoad)
+		}
+	}
+
+	if schedule.MaxCPU > 0 {
+		usage, err := cpu.Percent(time.Second, false)
+		if err != nil || len(usage) == 0 {
+			p.logger.Warn("failed to read cpu usage, ignoring max_cpu", "error", err)
+		} else if usage[0] > schedule.MaxCPU {
+			return fmt.Sprintf("CPU usage %.0f%% above %g%%", usage[0], schedule.MaxCPU)
+		}
+	}
+
+	return ""
+}
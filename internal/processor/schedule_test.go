@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+func TestWaitScheduleAdmission(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule config.ScheduleConfig
+		spaced   bool // The second start waits for the next check
+	}{
+		{"no load limit", config.ScheduleConfig{CheckInterval: 1}, false},
+		// Never exceeded, but the load of a started task must show first
+		{"load limit", config.ScheduleConfig{CheckInterval: 1, MaxLoad: 1e6}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProcessor(t, config.Config{Schedule: tt.schedule})
+
+			// Two slots wait for the schedule at the same time
+			start := time.Now()
+			var mu sync.Mutex
+			var waited []time.Duration
+			var wg sync.WaitGroup
+			for range 2 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.waitSchedule()
+					mu.Lock()
+					waited = append(waited, time.Since(start))
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			slices.Sort(waited)
+
+			if waited[0] > 500*time.Millisecond {
+				t.Errorf("first start waited %v", waited[0])
+			}
+			if spaced := waited[1] >= 900*time.Millisecond; spaced != tt.spaced {
+				t.Errorf("second start waited %v, want spaced by the check interval %v", waited[1], tt.spaced)
+			}
+		})
+	}
+}
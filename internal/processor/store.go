@@ -0,0 +1,407 @@
+package processor
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	tasksBucket   = []byte("tasks")
+	metaBucket    = []byte("meta")
+	queueOrderKey = []byte("queue_order")
+	queuePauseKey = []byte("queue_paused")
+)
+
+// taskRecord is the persisted representation of a task.
+type taskRecord struct {
+	ID        uint64     `json:"id"`
+	CreateAt  time.Time  `json:"create_at"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   time.Time  `json:"ended_at"`
+	Input     string     `json:"input"`
+	Preset    string     `json:"preset"`
+	TempFile  string     `json:"temp_file"`
+	Status    TaskStatus `json:"status"`
+	Priority  int        `json:"priority,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	WorkerID  string     `json:"worker_id,omitempty"`
+
+	Attempts []Attempt `json:"attempts,omitempty"`
+	RetryAt  time.Time `json:"retry_at,omitzero"`
+
+	CRFSearch *transcoding.CRFSearchResult `json:"crf_search,omitempty"`
+	Metrics   map[string]float64           `json:"metrics,omitempty"`
+
+	AutoResolution string   `json:"auto_resolution,omitempty"`
+	Output         string   `json:"output,omitempty"`
+	Backup         string   `json:"backup,omitempty"`
+	Restored       bool     `json:"restored,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+}
+
+// taskStore persists task state transitions into a bbolt database.
+// Writes are coalesced and flushed by a background goroutine so that
+// recording a transition never blocks on disk I/O.
+type taskStore struct {
+	db     *bolt.DB
+	logger *slog.Logger
+
+	pendingMu sync.Mutex
+	pending   map[uint64]taskRecord
+	order     []uint64 // pending queue order, nil when unchanged
+	closed    bool
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+// openTaskStore opens (or creates) the task database at the given path.
+func openTaskStore(path string, logger *slog.Logger) (*taskStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open task database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(tasksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize task database: %w", err)
+	}
+
+	s := &taskStore{
+		db:      db,
+		logger:  logger.With("component", "task-store"),
+		pending: map[uint64]taskRecord{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// load returns all persisted task records.
+func (s *taskStore) load() ([]taskRecord, error) {
+	var records []taskRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var rec taskRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				s.logger.Warn("skipping corrupted task record", "key", binary.BigEndian.Uint64(k), "error", err)
+				return nil
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// loadOrder returns the persisted order of the pending queue.
+func (s *taskStore) loadOrder() ([]uint64, error) {
+	var order []uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(queueOrderKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &order)
+	})
+	return order, err
+}
+
+// loadPaused returns whether the queue was paused.
+func (s *taskStore) loadPaused() (bool, error) {
+	var paused bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(queuePauseKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &paused)
+	})
+	return paused, err
+}
+
+// savePaused writes the queue pause state. Unlike task records it is written
+// immediately, it changes rarely and must not get lost.
+func (s *taskStore) savePaused(paused bool) error {
+	data, err := json.Marshal(paused)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(queuePauseKey, data)
+	})
+}
+
+// save schedules a record to be written to the database.
+func (s *taskStore) save(rec taskRecord) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.pending[rec.ID] = rec
+	s.notify()
+}
+
+// saveOrder schedules the pending queue order to be written to the database.
+func (s *taskStore) saveOrder(ids []uint64) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.order = ids
+	s.notify()
+}
+
+func (s *taskStore) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run flushes pending records until the store is closed.
+func (s *taskStore) run() {
+	defer close(s.done)
+	for range s.wake {
+		if err := s.flush(); err != nil {
+			s.logger.Error("failed to persist tasks", "error", err)
+		}
+	}
+}
+
+// flush writes all pending records in a single transaction.
+func (s *taskStore) flush() error {
+	s.pendingMu.Lock()
+	records := s.pending
+	order := s.order
+	s.pending = map[uint64]taskRecord{}
+	s.order = nil
+	s.pendingMu.Unlock()
+
+	if len(records) == 0 && order == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if order != nil {
+			data, err := json.Marshal(order)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(metaBucket).Put(queueOrderKey, data); err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket(tasksBucket)
+		for id, rec := range records {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, id)
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close flushes outstanding writes and closes the database.
+func (s *taskStore) Close() error {
+	s.pendingMu.Lock()
+	s.closed = true
+	close(s.wake)
+	s.pendingMu.Unlock()
+	<-s.done
+
+	err := s.flush()
+	return errors.Join(err, s.db.Close())
+}
+
+// record returns the persisted representation of the task.
+func (t *task) record() taskRecord {
+	metrics := t.Metrics()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rec := taskRecord{
+		ID:        t.ID,
+		CreateAt:  t.CreateAt,
+		StartedAt: t.startedAt,
+		EndedAt:   t.endedAt,
+		Input:     t.Input,
+		Preset:    t.Preset,
+		TempFile:  t.TempFile,
+		Status:    t.Status,
+		Priority:  t.Priority,
+		WorkerID:  t.WorkerID,
+		Attempts:  slices.Clone(t.Attempts),
+		RetryAt:   t.RetryAt,
+		CRFSearch: t.CRFSearch,
+		Metrics:   metrics,
+
+		AutoResolution: t.AutoResolution,
+		Output:         t.Output,
+		Backup:         t.Backup,
+		Restored:       t.Restored,
+		Warnings:       slices.Clone(t.Warnings),
+	}
+	if t.Error != nil {
+		rec.Error = t.Error.Error()
+	}
+	return rec
+}
+
+// taskFromRecord rebuilds a task from its persisted representation.
+func taskFromRecord(rec taskRecord) *task {
+	t := &task{
+		ID:        rec.ID,
+		CreateAt:  rec.CreateAt,
+		Input:     rec.Input,
+		Preset:    rec.Preset,
+		TempFile:  rec.TempFile,
+		Status:    rec.Status,
+		Priority:  rec.Priority,
+		WorkerID:  rec.WorkerID,
+		Attempts:  rec.Attempts,
+		RetryAt:   rec.RetryAt,
+		CRFSearch: rec.CRFSearch,
+
+		AutoResolution: rec.AutoResolution,
+		Output:         rec.Output,
+		Backup:         rec.Backup,
+		Restored:       rec.Restored,
+		Warnings:       rec.Warnings,
+
+		startedAt: rec.StartedAt,
+		endedAt:   rec.EndedAt,
+	}
+	t.ctx, t.cancelCtx = context.WithCancel(context.Background())
+	t.setMetrics(rec.Metrics)
+	if rec.Error != "" {
+		t.Error = errors.New(rec.Error)
+	}
+	if t.Status == TaskStatusCompleted {
+		t.Progress = 1
+	}
+	if t.Status == TaskStatusCancelled {
+		t.cancelled.Store(true)
+	}
+	return t
+}
+
+// restoreTasks loads persisted tasks and reconciles tasks that were
+// interrupted by a restart. Returns the tasks that must be put back
+// into the queue, in their persisted queue order.
+func (p *Processor) restoreTasks() ([]*task, error) {
+	records, err := p.store.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tasks: %w", err)
+	}
+
+	order, err := p.store.loadOrder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load queue order: %w", err)
+	}
+
+	var pending []*task
+	for _, rec := range records {
+		t := taskFromRecord(rec)
+		t.onChange = p.taskChanged
+		t.publishedStatus = t.Status
+		log := p.logger.With("task_id", t.ID, "input", t.Input, "status", t.Status)
+
+		switch t.Status {
+		case TaskStatusPending:
+			pending = append(pending, t)
+		case TaskStatusProcessing, TaskStatusPaused:
+			// The ffmpeg process (or the remote worker session) did not survive
+			// the restart, run the task again. The temp dir is left to
+			// recoverTempDirs, the output may have completed unpersisted.
+			log.Info("re-queueing task interrupted by restart")
+			t.TempFile = ""
+			t.MarkPending()
+			pending = append(pending, t)
+		case TaskStatusWaitingForResolution, TaskStatusReplacing:
+			// A replacement only removes the temp file after the rename succeeded,
+			// so a missing temp file means the interrupted replacement finished.
+			if _, err := os.Stat(t.TempFile); err == nil {
+				log.Info("re-attaching task to existing temp file", "temp_file", t.TempFile)
+				if t.Status == TaskStatusReplacing {
+					t.MarkWaitingForResolution()
+				}
+				p.afterTranscode(t)
+			} else if t.Status == TaskStatusReplacing {
+				log.Info("interrupted replacement already finished")
+				t.MarkCompleted()
+			} else {
+				log.Warn("temp file of task is gone", "temp_file", t.TempFile, "error", err)
+				t.MarkFailed(fmt.Errorf("temp file lost after restart: %w", err))
+			}
+		}
+
+		p.addTaskLocked(t)
+		if t.ID > p.taskAI.Load() {
+			p.taskAI.Store(t.ID)
+		}
+	}
+
+	// Tasks missing from the persisted order (e.g. interrupted ones)
+	// go first, then the rest of the queue keeps its previous order.
+	index := make(map[uint64]int, len(order))
+	for i, id := range order {
+		index[id] = i + 1
+	}
+	slices.SortFunc(pending, func(a, b *task) int {
+		return cmp.Or(
+			cmp.Compare(index[a.ID], index[b.ID]),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+
+	p.logger.Info("tasks restored from database", "total", len(records), "queued", len(pending))
+	return pending, nil
+}
+
+// taskChanged is called after every task state transition.
+func (p *Processor) taskChanged(t *task) {
+	if p.store != nil {
+		p.store.save(t.record())
+	}
+
+	state := t.State()
+	if state.Status.finished() {
+		p.evictTaskLog(t.ID)
+	}
+
+	t.mu.Lock()
+	prev := t.publishedStatus
+	t.publishedStatus = state.Status
+	t.mu.Unlock()
+	p.publishTask(Event{Kind: EventTaskChanged, TaskID: t.ID, Task: state, PrevStatus: prev})
+}
@@ -0,0 +1,205 @@
+package processor
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+// newTestProcessor creates a processor with the given config, writing its
+// temp dirs to a fresh directory unless the config names one.
+func newTestProcessor(t *testing.T, cfg config.Config) *Processor {
+	t.Helper()
+	if cfg.TempDir == "" {
+		cfg.TempDir = t.TempDir()
+	}
+	p, err := NewProcessor(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// writeFile creates a file with the given content, and its directory.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTaskDB writes task records and the queue order to a new task database.
+func writeTaskDB(t *testing.T, path string, records []taskRecord, order []uint64) {
+	t.Helper()
+	store, err := openTaskStore(path, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("openTaskStore() error = %v", err)
+	}
+	for _, rec := range records {
+		store.save(rec)
+	}
+	if order != nil {
+		store.saveOrder(order)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+// readTaskDB returns the task records by ID and the queue order of a task database.
+func readTaskDB(t *testing.T, path string) (map[uint64]taskRecord, []uint64) {
+	t.Helper()
+	store, err := openTaskStore(path, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("openTaskStore() error = %v", err)
+	}
+	defer store.Close()
+
+	records, err := store.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	order, err := store.loadOrder()
+	if err != nil {
+		t.Fatalf("loadOrder() error = %v", err)
+	}
+	byID := map[uint64]taskRecord{}
+	for _, rec := range records {
+		byID[rec.ID] = rec
+	}
+	return byID, order
+}
+
+func TestRestoreTasks(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "tasks.db")
+	tempDir := t.TempDir()
+	kept := filepath.Join(tempDir, "kept", "out.mkv")
+	writeFile(t, kept, "output")
+	replacing := filepath.Join(tempDir, "replacing", "out.mkv")
+	writeFile(t, replacing, "output")
+	lost := filepath.Join(tempDir, "lost", "out.mkv")
+
+	record := func(id uint64, status TaskStatus, tempFile string) taskRecord {
+		return taskRecord{ID: id, Input: "/media/input.mkv", Preset: "x265", Status: status, TempFile: tempFile}
+	}
+	writeTaskDB(t, dbPath, []taskRecord{
+		record(1, TaskStatusPending, ""),
+		record(2, TaskStatusProcessing, lost),
+		record(3, TaskStatusPaused, lost),
+		record(4, TaskStatusWaitingForResolution, kept),
+		record(5, TaskStatusWaitingForResolution, lost),
+		record(6, TaskStatusReplacing, replacing),
+		record(7, TaskStatusReplacing, lost),
+		record(8, TaskStatusCompleted, ""),
+		record(9, TaskStatusCancelled, ""),
+		record(10, TaskStatusPending, ""),
+		record(12, TaskStatusFailed, ""),
+	}, []uint64{10, 11, 1})
+
+	p := newTestProcessor(t, config.Config{DBPath: dbPath, TempDir: tempDir})
+
+	tests := []struct {
+		id       uint64
+		status   TaskStatus
+		tempFile string
+		failed   bool
+	}{
+		{1, TaskStatusPending, "", false},
+		{2, TaskStatusPending, "", false},
+		{3, TaskStatusPending, "", false},
+		{4, TaskStatusWaitingForResolution, kept, false},
+		{5, TaskStatusFailed, lost, true},
+		{6, TaskStatusWaitingForResolution, replacing, false},
+		{7, TaskStatusCompleted, lost, false},
+		{8, TaskStatusCompleted, "", false},
+		{9, TaskStatusCancelled, "", false},
+		{10, TaskStatusPending, "", false},
+		{12, TaskStatusFailed, "", false},
+	}
+	for _, tt := range tests {
+		state := p.GetTask(tt.id)
+		if state.Status != tt.status || state.TempFile != tt.tempFile {
+			t.Errorf("task %d = %s with temp file %q, want %s with %q", tt.id, state.Status, state.TempFile, tt.status, tt.tempFile)
+		}
+		if tt.failed && state.Error == nil {
+			t.Errorf("task %d has no error", tt.id)
+		}
+	}
+	if !p.IsCancelled(9) {
+		t.Error("cancelled task 9 is not flagged as cancelled")
+	}
+
+	// Interrupted tasks go first, then the persisted order; unknown IDs are ignored
+	if got, want := queueIDs(p.queue), []uint64{2, 3, 10, 1}; !slices.Equal(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+
+	// New IDs continue after the highest restored one
+	p.AddTask("/media/new.mkv", "x265", 0)
+	if state := p.GetTask(13); state.Input != "/media/new.mkv" {
+		t.Errorf("task 13 = %q, want the new task", state.Input)
+	}
+}
+
+func TestProcessorCloseFlushes(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "tasks.db")
+	p, err := NewProcessor(config.Config{DBPath: dbPath, TempDir: t.TempDir()}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+
+	for _, input := range []string{"/media/a.mkv", "/media/b.mkv", "/media/c.mkv"} {
+		p.AddTask(input, "x265", 0)
+	}
+	if err := p.CancelTask(2); err != nil {
+		t.Fatalf("CancelTask() error = %v", err)
+	}
+	if err := p.MoveTask(3, 0); err != nil {
+		t.Fatalf("MoveTask() error = %v", err)
+	}
+	// Closed right away, before the coalesced writes had a chance to run
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	records, order := readTaskDB(t, dbPath)
+	if len(records) != 3 {
+		t.Fatalf("%d records persisted, want 3", len(records))
+	}
+	if status := records[2].Status; status != TaskStatusCancelled {
+		t.Errorf("cancelled task persisted as %s", status)
+	}
+	if want := []uint64{3, 1}; !slices.Equal(order, want) {
+		t.Errorf("persisted order = %v, want %v", order, want)
+	}
+}
+
+func TestTaskRecordRoundTrip(t *testing.T) {
+	task := newTask(7, "/media/input.mkv", "x265", 2)
+	task.Status = TaskStatusFailed
+	task.Error = errors.New("exit status 1")
+	task.WorkerID = "worker"
+	task.startedAt, task.endedAt = time.Unix(100, 0), time.Unix(200, 0)
+
+	restored := taskFromRecord(task.record()).State()
+	state := task.State()
+	if restored.Error == nil || restored.Error.Error() != state.Error.Error() {
+		t.Errorf("error = %v, want %v", restored.Error, state.Error)
+	}
+	restored.Error, state.Error = nil, nil
+	if restored.ID != state.ID || restored.Input != state.Input || restored.Preset != state.Preset ||
+		restored.Priority != state.Priority || restored.Status != state.Status || restored.WorkerID != state.WorkerID ||
+		!restored.StartedAt.Equal(state.StartedAt) || !restored.EndedAt.Equal(state.EndedAt) {
+		t.Errorf("restored = %+v, want %+v", restored, state)
+	}
+}
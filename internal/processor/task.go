@@ -2,11 +2,16 @@
 package processor
 
 import (
-	"bytes"
+	"context"
+	"os"
 	"os/exec"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 // TaskStatus represents the current state of a transcoding task.
@@ -20,11 +25,15 @@ const (
 	// TaskStatusProcessing indicates the task is currently being processed.
 	TaskStatusProcessing TaskStatus = "processing"
 
+	// TaskStatusPaused indicates the task's ffmpeg process is stopped and can be resumed.
+	TaskStatusPaused TaskStatus = "paused"
+
 	// TaskStatusWaitingForResolution indicates the task has completed processing but
 	// requires user action to determine what to do with the output file.
 	TaskStatusWaitingForResolution TaskStatus = "waiting_for_resolution"
 
-	// TaskStatsuReplacing indicates the task is in the process of replacing the original file.
+	// TaskStatusReplacing indicates the task's resolution is running, e.g. the
+	// output is replacing the original file.
 	TaskStatusReplacing TaskStatus = "replacing"
 
 	// TaskStatusCompleted indicates the task has successfully completed.
@@ -37,6 +46,15 @@ const (
 	TaskStatusFailed TaskStatus = "failed"
 )
 
+// Attempt is one run of a task, from processing until it failed,
+// finished transcoding or was interrupted.
+type Attempt struct {
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	WorkerID  string    `json:"worker_id,omitempty"` // Empty for the local worker
+	Error     string    `json:"error,omitempty"`
+}
+
 // task represents a transcoding job with metadata about the process.
 type task struct {
 	// Core identification
@@ -48,32 +66,149 @@ type task struct {
 	Preset   string // Transcoding profile name
 	TempFile string // Temporary output file path
 
+	// Scheduling
+	Priority int // Higher priority tasks are queued ahead of lower ones
+
 	// Status information
-	Status   TaskStatus // Current state of the task
-	Progress float64    // Processing progress (0.0 to 1.0)
-	Error    error      // Error information if task failed
+	Status   TaskStatus           // Current state of the task
+	Progress float64              // Processing progress (0.0 to 1.0)
+	Stats    transcoding.Progress // Latest FFmpeg progress update of the running pass
+	ETA      time.Duration        // Estimated time until processing completes, 0 if unknown
+	Error    error                // Error information if task failed
 
 	// Worker assignment
 	WorkerID string // ID of the worker processing this task (empty means local)
 
+	// Retries
+	Attempts   []Attempt   // Every run of the task, the last one is the current
+	RetryAt    time.Time   // When a failed task is retried automatically, zero if it isn't
+	retryTimer *time.Timer // Fires the scheduled retry
+
+	// Quality targeting
+	CRFSearch *transcoding.CRFSearchResult // Outcome of the target VMAF CRF search, nil if none ran
+	metricsMu sync.Mutex
+	metrics   map[string]*metricResult // Quality metrics of the output by name
+
+	// AutoResolution tells which resolution rule resolved the task and why, empty if none did
+	AutoResolution string
+
+	// Output is where a task resolved with "keep both" or a renaming
+	// replacement saved its output, empty when it replaced the input as is
+	Output string
+
+	// Backup is where the replaced original was backed up, empty if it wasn't
+	// or once the backup was removed. Restored is set when the replacement was undone.
+	Backup   string
+	Restored bool
+
+	// Warnings are the attributes of the original the replacement could not take over
+	Warnings []string
+
 	// Runtime data
-	cancelled atomic.Bool // Indicates if the task was cancelled
-	cmd       *exec.Cmd   // FFmpeg command reference
-	startedAt time.Time   // When processing started
-	endedAt   time.Time   // When processing completed
-	stderr    bytes.Buffer
+	mu        sync.RWMutex       // Guards the fields changing while the task runs, see State and update
+	statusMu  sync.Mutex         // Serializes checked transitions, see swapStatus
+	cancelled atomic.Bool        // Indicates if the task was cancelled
+	ctx       context.Context    // Cancelled together with the task, for work not tied to cmd
+	cancelCtx context.CancelFunc // Cancels ctx
+	cmdMu     sync.Mutex         // Guards cmd and orders signals with its start
+	cmd       *exec.Cmd          // FFmpeg process of the running command, nil between commands
+	duration  float64            // Media duration of the input in seconds, for the ETA
+	passes    int                // Number of FFmpeg passes of the encode, for the ETA
+	estimate  int64              // Estimated output size in bytes, for the disk space guard
+	startedAt time.Time          // When processing started
+	endedAt   time.Time          // When processing completed
+
+	onChange        func(*task) // Called after every status transition
+	publishedStatus TaskStatus  // Status of the last EventTaskChanged, see taskChanged
 }
 
 // newTask creates a new transcoding task in pending state.
-func newTask(id uint64, inputPath, presetName string) *task {
-	return &task{
+func newTask(id uint64, inputPath, presetName string, priority int) *task {
+	t := &task{
 		ID:       id,
 		Input:    inputPath,
 		Preset:   presetName,
+		Priority: priority,
 		Status:   TaskStatusPending,
 		Progress: 0,
 		CreateAt: time.Now(),
 	}
+	t.ctx, t.cancelCtx = context.WithCancel(context.Background())
+	return t
+}
+
+// update runs set with the task's fields locked. The fields are read by the
+// API, the UI and the event hooks while the goroutines processing, resolving
+// or retrying the task change them: writes go through the Mark and Set
+// methods or update, reads from other goroutines through State or status.
+// mu is never held while changed runs, publishing reads the state again.
+func (t *task) update(set func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	set()
+}
+
+// status returns the current status of the task.
+func (t *task) status() TaskStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Status
+}
+
+// attemptCtx returns the context of the current attempt, cancelled together
+// with the task.
+func (t *task) attemptCtx() context.Context {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ctx
+}
+
+// changed notifies the owner of the task about a status transition.
+func (t *task) changed() {
+	if t.onChange != nil {
+		t.onChange(t)
+	}
+}
+
+// swapStatus runs mark if allowed accepts the current status. The check and
+// the transition happen under the status lock, so concurrent requests (e.g. a
+// resolve from the UI and one from the API) can't both pass the check.
+// It returns the status before the transition and whether mark ran.
+func (t *task) swapStatus(allowed func(TaskStatus) bool, mark func(prev TaskStatus)) (TaskStatus, bool) {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+
+	prev := t.status()
+	if !allowed(prev) {
+		return prev, false
+	}
+	mark(prev)
+	return prev, true
+}
+
+// endAttempt closes the current attempt, if it is still open. mu must be held.
+func (t *task) endAttempt(errMsg string) {
+	if len(t.Attempts) == 0 {
+		return
+	}
+	attempt := &t.Attempts[len(t.Attempts)-1]
+	if !attempt.EndedAt.IsZero() {
+		return
+	}
+	attempt.EndedAt = time.Now()
+	attempt.Error = errMsg
+}
+
+// MarkPending resets the task to pending state so it can be picked up again.
+func (t *task) MarkPending() {
+	t.mu.Lock()
+	t.endAttempt("interrupted")
+	t.Status = TaskStatusPending
+	t.WorkerID = ""
+	t.Progress = 0
+	t.Stats, t.ETA = transcoding.Progress{}, 0
+	t.mu.Unlock()
+	t.changed()
 }
 
 // MarkProcessing transitions the task to processing state.
@@ -83,57 +218,125 @@ func (t *task) MarkProcessing() {
 	if t.cancelled.Load() {
 		return
 	}
+	t.mu.Lock()
 	t.Status = TaskStatusProcessing
+	t.Stats, t.ETA = transcoding.Progress{}, 0
 	t.startedAt = time.Now()
+	t.Attempts = append(t.Attempts, Attempt{StartedAt: t.startedAt, WorkerID: t.WorkerID})
+	t.mu.Unlock()
+	t.changed()
 }
 
 // MarkWaitingForResolution transitions the task to waiting for resolution state.
 func (t *task) MarkWaitingForResolution() {
+	t.mu.Lock()
+	t.endAttempt("")
 	t.Status = TaskStatusWaitingForResolution
 	t.endedAt = time.Now()
+	t.mu.Unlock()
+	t.changed()
 }
 
-// MarkWaitingForResolution transitions the task to waiting for resolution state.
+// MarkStatusReplacing transitions the task to replacing state while its
+// resolution runs. Cancelling and resolving it again are refused until the
+// resolution marks the outcome.
 func (t *task) MarkStatusReplacing() {
+	t.mu.Lock()
 	t.Status = TaskStatusReplacing
 	t.endedAt = time.Now()
+	t.mu.Unlock()
+	t.changed()
+}
+
+// MarkReplaceRefused returns the task to waiting for resolution
+// with the reason why its output may not replace the original.
+func (t *task) MarkReplaceRefused(err error) {
+	t.mu.Lock()
+	t.Status = TaskStatusWaitingForResolution
+	t.Error = err
+	t.mu.Unlock()
+	t.changed()
 }
 
 // MarkCompleted transitions the task to completed state.
 func (t *task) MarkCompleted() {
+	t.mu.Lock()
 	t.Status = TaskStatusCompleted
 	t.Progress = 1.0
 	t.endedAt = time.Now()
+	t.mu.Unlock()
+	t.changed()
 }
 
 // MarkFailed transitions the task to failed state with an error.
 func (t *task) MarkFailed(err error) {
+	t.mu.Lock()
+	t.endAttempt(err.Error())
 	t.Status = TaskStatusFailed
 	t.Error = err
 	t.endedAt = time.Now()
+	t.mu.Unlock()
+	t.changed()
 }
 
 // MarkCancelled transitions the task to cancelled state.
 func (t *task) MarkCancelled() {
+	t.mu.Lock()
+	t.endAttempt("cancelled")
 	t.Status = TaskStatusCancelled
 	t.endedAt = time.Now()
+	t.mu.Unlock()
+	t.changed()
+}
+
+// markCancelled marks a task whose cancelled flag is set as cancelled,
+// unless CancelTask already did. Marking it again would end the attempt
+// and publish the change twice.
+func (t *task) markCancelled() {
+	t.swapStatus(func(status TaskStatus) bool {
+		return status != TaskStatusCancelled
+	}, func(TaskStatus) {
+		t.MarkCancelled()
+	})
+}
+
+// MarkPaused transitions the task to paused state.
+func (t *task) MarkPaused() {
+	t.mu.Lock()
+	t.Status = TaskStatusPaused
+	t.mu.Unlock()
+	t.changed()
+}
+
+// MarkResumed transitions a paused task back to processing state.
+func (t *task) MarkResumed() {
+	t.mu.Lock()
+	t.Status = TaskStatusProcessing
+	t.mu.Unlock()
+	t.changed()
 }
 
 // IsActive returns true if the task is currently processing.
 func (t *task) IsActive() bool {
-	return t.Status == TaskStatusProcessing
+	status := t.status()
+	return status == TaskStatusProcessing || status == TaskStatusPaused
 }
 
 // IsPending returns true if the task is waiting to start.
 func (t *task) IsPending() bool {
-	return t.Status == TaskStatusPending
+	return t.status() == TaskStatusPending
 }
 
 // IsFinished returns true if the task has reached a terminal state.
 func (t *task) IsFinished() bool {
-	return t.Status == TaskStatusCompleted ||
-		t.Status == TaskStatusFailed ||
-		t.Status == TaskStatusCancelled
+	return t.status().finished()
+}
+
+// finished returns true for the terminal statuses.
+func (s TaskStatus) finished() bool {
+	return s == TaskStatusCompleted ||
+		s == TaskStatusFailed ||
+		s == TaskStatusCancelled
 }
 
 // SetProgress updates the progress percentage (0.0 to 1.0).
@@ -144,21 +347,93 @@ func (t *task) SetProgress(progress float64) {
 	} else if progress > 1 {
 		progress = 1
 	}
+	t.mu.Lock()
 	t.Progress = progress
+	t.mu.Unlock()
+}
+
+// SetStats records the latest FFmpeg progress update and estimates the
+// remaining time from its speed. Call after SetProgress.
+func (t *task) SetStats(stats transcoding.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Stats = stats
+	t.ETA = stats.Remaining(t.duration, t.Progress, max(1, t.passes))
+}
+
+// SetCRFSearch records the outcome of the target VMAF CRF search.
+func (t *task) SetCRFSearch(result transcoding.CRFSearchResult) {
+	t.mu.Lock()
+	t.CRFSearch = &result
+	t.mu.Unlock()
+	t.changed()
 }
 
-// SetCommand assigns a command to the task.
-func (t *task) SetCommand(cmd *exec.Cmd) {
+// lastFailedWorker returns the worker the last attempt failed on.
+// Returns false if there is no failed attempt.
+func (t *task) lastFailedWorker() (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.Attempts) == 0 {
+		return "", false
+	}
+	attempt := t.Attempts[len(t.Attempts)-1]
+	return attempt.WorkerID, attempt.Error != ""
+}
+
+// startCommand starts the command as the task's current process. A task
+// cancelled or paused while the previous command was finishing stops it
+// right away.
+func (t *task) startCommand(cmd *exec.Cmd) error {
+	t.cmdMu.Lock()
+	defer t.cmdMu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 	t.cmd = cmd
+	if t.cancelled.Load() {
+		cmd.Process.Signal(syscall.SIGTERM)
+	} else if t.status() == TaskStatusPaused {
+		cmd.Process.Signal(syscall.SIGSTOP)
+	}
+	return nil
+}
+
+// endCommand forgets the process of the command, after it exited.
+func (t *task) endCommand() {
+	t.cmdMu.Lock()
+	t.cmd = nil
+	t.cmdMu.Unlock()
+}
+
+// signal sends the signals to the task's current process, in order.
+// Returns false if no command is running.
+func (t *task) signal(sigs ...os.Signal) bool {
+	t.cmdMu.Lock()
+	defer t.cmdMu.Unlock()
+
+	if t.cmd == nil {
+		return false
+	}
+	for _, sig := range sigs {
+		t.cmd.Process.Signal(sig)
+	}
+	return true
 }
 
 func (t *task) Cancel() error {
-	t.cmd.Process.Signal(syscall.SIGTERM)
+	t.signal(syscall.SIGTERM)
 	t.cancelled.Store(true)
 	return nil
 }
 
 func (t *task) State() TaskState {
+	// Taken first, metricsMu is held while the status is checked
+	metrics := t.Metrics()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return TaskState{
 		ID:        t.ID,
 		CreateAt:  t.CreateAt,
@@ -167,9 +442,22 @@ func (t *task) State() TaskState {
 		Input:     t.Input,
 		Preset:    t.Preset,
 		TempFile:  t.TempFile,
+		Priority:  t.Priority,
 		Status:    t.Status,
 		Progress:  t.Progress,
+		Stats:     t.Stats,
+		ETA:       t.ETA,
 		Error:     t.Error,
 		WorkerID:  t.WorkerID,
+		Attempts:  slices.Clone(t.Attempts),
+		RetryAt:   t.RetryAt,
+		CRFSearch: t.CRFSearch,
+		Metrics:   metrics,
+
+		AutoResolution: t.AutoResolution,
+		Output:         t.Output,
+		Backup:         t.Backup,
+		Restored:       t.Restored,
+		Warnings:       slices.Clone(t.Warnings),
 	}
 }
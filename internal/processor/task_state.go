@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"slices"
 	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
-// GetTask retrieves a task by ID.
+// GetTask retrieves a task by ID with its queue position.
 func (p *Processor) GetTask(id uint64) TaskState {
 	p.tasksMu.RLock()
-	defer p.tasksMu.RUnlock()
 	task, ok := p.tasks[id]
+	p.tasksMu.RUnlock()
 	if !ok {
 		return TaskState{}
 	}
-	return task.State()
+	state := task.State()
+	state.QueuePosition = p.queue.position(id)
+	return state
 }
 
 // FailTask marks a task as failed with the given error.
@@ -27,16 +31,22 @@ func (p *Processor) FailTask(taskID uint64, err error) error {
 	if !ok {
 		return fmt.Errorf("task %d not found", taskID)
 	}
-	task.MarkFailed(err)
+	p.failTask(task, err)
 	return nil
 }
 
-// GetTask retrieves a task by ID.
+// GetQueue returns the state of all tasks ordered by ID.
 func (p *Processor) GetQueue() []TaskState {
-	var tasks []TaskState
+	positions := p.queue.positions()
+
+	p.tasksMu.RLock()
+	tasks := make([]TaskState, 0, len(p.tasks))
 	for _, t := range p.tasks {
-		tasks = append(tasks, t.State())
+		state := t.State()
+		state.QueuePosition = positions[t.ID]
+		tasks = append(tasks, state)
 	}
+	p.tasksMu.RUnlock()
 
 	slices.SortFunc(tasks, func(a, b TaskState) int {
 		return cmp.Compare(a.ID, b.ID)
@@ -45,6 +55,18 @@ func (p *Processor) GetQueue() []TaskState {
 	return tasks
 }
 
+// GetPendingTasks returns the state of the queued tasks in queue order.
+func (p *Processor) GetPendingTasks() []TaskState {
+	queued := p.queue.snapshot()
+	tasks := make([]TaskState, 0, len(queued))
+	for i, t := range queued {
+		state := t.State()
+		state.QueuePosition = i + 1
+		tasks = append(tasks, state)
+	}
+	return tasks
+}
+
 type TaskState struct {
 	ID uint64 // Unique task identifier
 
@@ -57,12 +79,32 @@ type TaskState struct {
 	Preset   string // Transcoding profile name
 	TempFile string // Temporary output file path
 
+	// Scheduling
+	Priority      int // Higher priority tasks are queued ahead of lower ones
+	QueuePosition int // 1-based position in the pending queue, 0 if not queued
+
 	// Status information
-	Status   TaskStatus // Current state of the task
-	Progress float64    // Processing progress (0.0 to 1.0)
-	Error    error      // Error information if task failed
+	Status   TaskStatus           // Current state of the task
+	Progress float64              // Processing progress (0.0 to 1.0)
+	Stats    transcoding.Progress // Latest FFmpeg progress update of the running pass
+	ETA      time.Duration        // Estimated time until processing completes, 0 if unknown
+	Error    error                // Error information if task failed
 
 	// Worker assignment
 	WorkerID   string // ID of the worker processing this task
 	WorkerName string // Human-readable worker hostname (populated by caller)
+
+	// Retries
+	Attempts []Attempt // Every run of the task
+	RetryAt  time.Time // When a failed task is retried automatically, zero if it isn't
+
+	// Quality targeting
+	CRFSearch *transcoding.CRFSearchResult // Outcome of the target VMAF CRF search, nil if none ran
+	Metrics   map[string]float64           // Quality metrics of the output calculated so far, by name
+
+	AutoResolution string   // Resolution rule that resolved the task and why, empty if none did
+	Output         string   // Where a task resolved with "keep both" or a renaming replace saved its output
+	Backup         string   // Where the replaced original was backed up, empty if it isn't kept
+	Restored       bool     // The replacement was undone
+	Warnings       []string // Attributes of the original the replacement could not take over
 }
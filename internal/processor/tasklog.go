@@ -0,0 +1,262 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// taskLogPruneInterval is how often the retention of the task logs is applied.
+	taskLogPruneInterval = time.Hour
+
+	// outputTailSize is how much of the latest FFmpeg output is kept for error messages.
+	outputTailSize = 4 << 10
+)
+
+// taskLog is the bounded log of a task: the FFmpeg command lines and their
+// output, local or sent by a remote worker. It is written to <dir>/<id>.log
+// and rotated to <id>.log.1 once it grows past maxSize, so at most about
+// twice maxSize is kept per task. The file is opened per write, so idle
+// logs don't hold file descriptors.
+type taskLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	onWrite func() // Called after every successful write
+}
+
+func (l *taskLog) Write(data []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(data)) > l.maxSize {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return 0, fmt.Errorf("failed to rotate task log: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && l.onWrite != nil {
+		l.onWrite()
+	}
+	return n, err
+}
+
+// read returns the rotated and the current log.
+func (l *taskLog) read() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var content []byte
+	for _, path := range []string{l.path + ".1", l.path} {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		content = append(content, data...)
+	}
+	return string(content), nil
+}
+
+// taskLog returns the log of the given task, nil when task logs are disabled.
+func (p *Processor) taskLog(taskID uint64) *taskLog {
+	dir := p.config.TaskLogs.Dir
+	if dir == "" {
+		return nil
+	}
+
+	p.taskLogsMu.Lock()
+	defer p.taskLogsMu.Unlock()
+
+	if l, ok := p.taskLogs[taskID]; ok {
+		return l
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		p.logger.Error("failed to create task log directory", "dir", dir, "error", err)
+		return nil
+	}
+	l := &taskLog{
+		path:    filepath.Join(dir, strconv.FormatUint(taskID, 10)+".log"),
+		maxSize: int64(p.config.TaskLogs.MaxSize),
+		onWrite: func() {
+			p.events.Publish(Event{Kind: EventTaskLog, TaskID: taskID})
+		},
+	}
+	p.taskLogs[taskID] = l
+	return l
+}
+
+// evictTaskLog forgets the log of a finished task. A later write, e.g. when
+// the backup of the task is removed, opens it again.
+func (p *Processor) evictTaskLog(taskID uint64) {
+	p.taskLogsMu.Lock()
+	delete(p.taskLogs, taskID)
+	p.taskLogsMu.Unlock()
+}
+
+// pruneTaskLogsLoop applies the retention of the task logs periodically.
+func (p *Processor) pruneTaskLogsLoop() {
+	ticker := time.NewTicker(taskLogPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.pruneTaskLogs()
+		<-ticker.C
+	}
+}
+
+// pruneTaskLogs removes the logs, current and rotated, of the tasks that
+// aren't running or waiting and weren't written to for max_age days.
+func (p *Processor) pruneTaskLogs() {
+	cfg := p.config.TaskLogs
+	if cfg.Dir == "" || cfg.MaxAge == 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.Error("failed to read task log directory", "dir", cfg.Dir, "error", err)
+		}
+		return
+	}
+
+	// Last write of each task's log, the current log is newer than the rotated one
+	lastWrite := map[uint64]time.Time{}
+	for _, entry := range entries {
+		idS, _, ok := strings.Cut(entry.Name(), ".log")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		taskID, err := strconv.ParseUint(idS, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(lastWrite[taskID]) {
+			lastWrite[taskID] = info.ModTime()
+		}
+	}
+
+	maxAge := time.Duration(cfg.MaxAge) * 24 * time.Hour
+	for taskID, modTime := range lastWrite {
+		if time.Since(modTime) <= maxAge {
+			continue
+		}
+		p.tasksMu.RLock()
+		task, ok := p.tasks[taskID]
+		p.tasksMu.RUnlock()
+		if ok && !task.IsFinished() {
+			continue
+		}
+
+		p.logger.Info("removing task log", "task_id", taskID, "last_write", modTime)
+		path := filepath.Join(cfg.Dir, strconv.FormatUint(taskID, 10)+".log")
+		for _, path := range []string{path, path + ".1"} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				p.logger.Error("failed to remove task log", "path", path, "error", err)
+			}
+		}
+	}
+}
+
+// taskLogWriter returns a writer appending to the log of the given task.
+// Write errors are logged and not returned, so a broken task log never
+// fails the FFmpeg process writing to it.
+func (p *Processor) taskLogWriter(taskID uint64) io.Writer {
+	l := p.taskLog(taskID)
+	if l == nil {
+		return io.Discard
+	}
+	return writerFunc(func(data []byte) (int, error) {
+		if _, err := l.Write(data); err != nil {
+			p.logger.Warn("failed to write task log", "task_id", taskID, "error", err)
+		}
+		return len(data), nil
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(data []byte) (int, error) { return f(data) }
+
+// outputTail keeps the latest output of a command, whether or not task logs
+// are enabled, so a failure can be reported with FFmpeg's error.
+type outputTail struct {
+	tail []byte
+}
+
+func (t *outputTail) Write(data []byte) (int, error) {
+	t.tail = append(t.tail, data...)
+	if len(t.tail) > outputTailSize {
+		t.tail = t.tail[len(t.tail)-outputTailSize:]
+	}
+	return len(data), nil
+}
+
+// LastLine returns the last non-empty line of the output, e.g. FFmpeg's error.
+func (t *outputTail) LastLine() string {
+	lines := strings.FieldsFunc(string(t.tail), func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// logTask writes a timestamped line to the log of the given task.
+func (p *Processor) logTask(taskID uint64, format string, args ...any) {
+	line := fmt.Sprintf("[%s] %s\n", time.Now().Format(time.DateTime), fmt.Sprintf(format, args...))
+	p.taskLogWriter(taskID).Write([]byte(line))
+}
+
+// AppendTaskLog appends output sent by a remote worker to the log of a task.
+func (p *Processor) AppendTaskLog(taskID uint64, data []byte) error {
+	p.tasksMu.RLock()
+	_, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("task %d not found", taskID)
+	}
+
+	l := p.taskLog(taskID)
+	if l == nil {
+		return nil
+	}
+	_, err := l.Write(data)
+	return err
+}
+
+// TaskLog returns the log of a task, empty if nothing was logged yet.
+func (p *Processor) TaskLog(taskID uint64) (string, error) {
+	p.tasksMu.RLock()
+	_, ok := p.tasks[taskID]
+	p.tasksMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("task %d not found", taskID)
+	}
+
+	l := p.taskLog(taskID)
+	if l == nil {
+		return "", errors.New("task logs are disabled")
+	}
+	return l.read()
+}
@@ -0,0 +1,162 @@
+package processor
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/config"
+)
+
+func TestTaskLogRotation(t *testing.T) {
+	l := &taskLog{path: filepath.Join(t.TempDir(), "1.log"), maxSize: 10}
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// Every write past the size moved the log to .1, the oldest line is gone
+	rotated, err := os.ReadFile(l.path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) != "second\n" {
+		t.Errorf("rotated log = %q, want %q", rotated, "second\n")
+	}
+	content, err := l.read()
+	if err != nil {
+		t.Fatalf("read() error = %v", err)
+	}
+	if content != "second\nthird\n" {
+		t.Errorf("read() = %q, want %q", content, "second\nthird\n")
+	}
+}
+
+func TestTaskLogs(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{TaskLogs: config.TaskLogConfig{Dir: dir, MaxSize: 1 << 20}})
+	id := p.AddTask("/media/input.mkv", "x265", 0)
+
+	p.logTask(id, "hello %s", "log")
+	if err := p.AppendTaskLog(id, []byte("worker output\n")); err != nil {
+		t.Fatalf("AppendTaskLog() error = %v", err)
+	}
+	content, err := p.TaskLog(id)
+	if err != nil {
+		t.Fatalf("TaskLog() error = %v", err)
+	}
+	if !strings.Contains(content, "hello log\n") || !strings.HasSuffix(content, "worker output\n") {
+		t.Errorf("TaskLog() = %q", content)
+	}
+	if _, err := p.TaskLog(99); err == nil {
+		t.Error("TaskLog() of an unknown task succeeded")
+	}
+
+	// The log of a finished task is evicted, and opened again on the next write
+	if err := p.CancelTask(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.taskLogs[id]; ok {
+		t.Error("log of a cancelled task not evicted")
+	}
+	if content, err := p.TaskLog(id); err != nil || !strings.Contains(content, "hello log") {
+		t.Errorf("TaskLog() after eviction = %q, %v", content, err)
+	}
+}
+
+func TestPruneTaskLogs(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProcessor(t, config.Config{TaskLogs: config.TaskLogConfig{Dir: dir, MaxAge: 30}})
+	running := p.AddTask("/media/running.mkv", "x265", 0)
+	finished := p.AddTask("/media/finished.mkv", "x265", 0)
+	if err := p.CancelTask(finished); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-31 * 24 * time.Hour)
+	write := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, "log\n")
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	logName := func(id uint64) string { return strconv.FormatUint(id, 10) + ".log" }
+
+	tests := []struct {
+		path string
+		kept bool
+	}{
+		{write("99.log", old), false},          // Of a task that's gone
+		{write("99.log.1", old), false},        // Rotated
+		{write(logName(finished), old), false}, // Of a finished task
+		{write(logName(running), old), true},   // Of an unfinished task
+		{write("98.log", time.Now()), true},    // Recent
+		{write("98.log.1", old), true},         // The current log of the task is recent
+		{write("notes.txt", old), true},        // Not a task log
+	}
+
+	p.pruneTaskLogs()
+
+	for _, tt := range tests {
+		_, err := os.Stat(tt.path)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s kept = %v, want %v", filepath.Base(tt.path), kept, tt.kept)
+		}
+	}
+}
+
+func TestOutputTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"last line", []string{"frame=1\n", "Invalid argument\n"}, "Invalid argument"},
+		{"progress lines", []string{"frame=1\rframe=2\r", "Conversion failed!\r\n  \n"}, "Conversion failed!"},
+		{"split writes", []string{"Unknown enc", "oder 'x'\n"}, "Unknown encoder 'x'"},
+		{"past the size", []string{strings.Repeat("frame=1\n", outputTailSize), "No space left on device\n"}, "No space left on device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tail outputTail
+			for _, data := range tt.writes {
+				tail.Write([]byte(data))
+			}
+			if len(tail.tail) > outputTailSize {
+				t.Errorf("tail holds %d bytes, want at most %d", len(tail.tail), outputTailSize)
+			}
+			if got := tail.LastLine(); got != tt.want {
+				t.Errorf("LastLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFFmpegError(t *testing.T) {
+	// Without task logs the output is still kept for the error
+	p := newTestProcessor(t, config.Config{})
+	task := addProcessingTask(p, "")
+	log := slog.New(slog.DiscardHandler)
+
+	cmd := exec.Command("sh", "-c", "echo 'frame=1' >&2; echo 'Unknown encoder' >&2; exit 1")
+	err := p.runFFmpeg(task, cmd, log)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || !strings.HasSuffix(err.Error(), ": Unknown encoder") {
+		t.Errorf("runFFmpeg() error = %v, want the exit status and the last line", err)
+	}
+
+	if err := p.runFFmpeg(task, exec.Command("sh", "-c", "echo 'done' >&2"), log); err != nil {
+		t.Errorf("runFFmpeg() error = %v", err)
+	}
+}
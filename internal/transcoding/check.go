@@ -0,0 +1,62 @@
+package transcoding
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// CheckOutput compares the probe data of an input and its transcoded output
+// and describes everything the output lost: streams of any type, audio and
+// subtitle languages, and duration beyond the tolerance in seconds.
+// An empty result means the output can safely replace the input.
+func CheckOutput(input, output FFProbeData, durationTolerance float64) []string {
+	var problems []string
+
+	for _, codecType := range []string{"video", "audio", "subtitle"} {
+		in, out := input.StreamCount(codecType), output.StreamCount(codecType)
+		if out < in {
+			problems = append(problems, fmt.Sprintf("%s streams %d -> %d", codecType, in, out))
+		}
+	}
+
+	for _, codecType := range []string{"audio", "subtitle"} {
+		outLanguages := output.Languages(codecType)
+		for _, language := range input.Languages(codecType) {
+			if !slices.Contains(outLanguages, language) {
+				problems = append(problems, fmt.Sprintf("%s language %q missing", codecType, language))
+			}
+		}
+	}
+
+	inDuration, inErr := strconv.ParseFloat(input.Format.Duration, 64)
+	outDuration, outErr := strconv.ParseFloat(output.Format.Duration, 64)
+	switch {
+	case inErr != nil:
+		// Nothing to compare against
+	case outErr != nil:
+		problems = append(problems, "output duration unknown")
+	case math.Abs(inDuration-outDuration) > durationTolerance:
+		problems = append(problems, fmt.Sprintf("duration %.1fs -> %.1fs", inDuration, outDuration))
+	}
+
+	return problems
+}
+
+// Languages returns the distinct language tags of the streams of the given
+// codec type, ignoring untagged and undetermined streams.
+func (d FFProbeData) Languages(codecType string) []string {
+	var languages []string
+	for _, stream := range d.Streams {
+		if stream.CodecType != codecType {
+			continue
+		}
+		language := stream.Tags["language"]
+		if language == "" || language == "und" || slices.Contains(languages, language) {
+			continue
+		}
+		languages = append(languages, language)
+	}
+	return languages
+}
@@ -0,0 +1,78 @@
+package transcoding
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckOutput(t *testing.T) {
+	stream := func(codecType, language string) FFProbeStream {
+		s := FFProbeStream{CodecType: codecType}
+		if language != "" {
+			s.Tags = map[string]string{"language": language}
+		}
+		return s
+	}
+	probe := func(duration string, streams ...FFProbeStream) FFProbeData {
+		return FFProbeData{Format: FFProbeFormat{Duration: duration}, Streams: streams}
+	}
+
+	input := probe("600.0",
+		stream("video", ""),
+		stream("audio", "eng"),
+		stream("audio", "jpn"),
+		stream("subtitle", "eng"),
+	)
+
+	tests := []struct {
+		name   string
+		output FFProbeData
+		want   []string
+	}{
+		{
+			name:   "identical",
+			output: input,
+		},
+		{
+			name:   "duration within tolerance",
+			output: probe("600.8", input.Streams...),
+		},
+		{
+			name:   "duration beyond tolerance",
+			output: probe("590.0", input.Streams...),
+			want:   []string{"duration 600.0s -> 590.0s"},
+		},
+		{
+			name:   "duration unknown",
+			output: probe("N/A", input.Streams...),
+			want:   []string{"output duration unknown"},
+		},
+		{
+			name:   "audio stream and language dropped",
+			output: probe("600.0", stream("video", ""), stream("audio", "eng"), stream("subtitle", "eng")),
+			want:   []string{"audio streams 2 -> 1", `audio language "jpn" missing`},
+		},
+		{
+			name:   "subtitles dropped",
+			output: probe("600.0", stream("video", ""), stream("audio", "eng"), stream("audio", "jpn")),
+			want:   []string{"subtitle streams 1 -> 0", `subtitle language "eng" missing`},
+		},
+		{
+			name:   "language retagged",
+			output: probe("600.0", stream("video", ""), stream("audio", "eng"), stream("audio", "und"), stream("subtitle", "eng")),
+			want:   []string{`audio language "jpn" missing`},
+		},
+		{
+			name:   "video dropped",
+			output: probe("600.0", input.Streams[1:]...),
+			want:   []string{"video streams 1 -> 0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckOutput(input, tt.output, 1); !slices.Equal(got, tt.want) {
+				t.Errorf("CheckOutput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package transcoding
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// CRFSearch configures how a target VMAF encode searches for its CRF.
+type CRFSearch struct {
+	Param          string  `koanf:"param" json:"param"`                     // Name of the CRF param, "crf" by default
+	MinCRF         int     `koanf:"min_crf" json:"min_crf"`                 // Lowest (best quality) CRF tried
+	MaxCRF         int     `koanf:"max_crf" json:"max_crf"`                 // Highest (smallest output) CRF tried
+	Steps          int     `koanf:"steps" json:"steps"`                     // Number of CRF values sampled between min and max
+	Samples        int     `koanf:"samples" json:"samples"`                 // Number of sample segments taken from the input
+	SampleDuration float64 `koanf:"sample_duration" json:"sample_duration"` // Length of a sample segment in seconds
+}
+
+// withDefaults fills unset search options.
+func (s CRFSearch) withDefaults() CRFSearch {
+	if s.Param == "" {
+		s.Param = "crf"
+	}
+	if s.MinCRF == 0 && s.MaxCRF == 0 {
+		s.MinCRF, s.MaxCRF = 18, 38
+	}
+	if s.Steps < 2 {
+		s.Steps = 5
+	}
+	if s.Samples < 1 {
+		s.Samples = 3
+	}
+	if s.SampleDuration <= 0 {
+		s.SampleDuration = 10
+	}
+	return s
+}
+
+// candidates returns the CRF values sampled by the search in ascending order.
+func (s CRFSearch) candidates() []int {
+	crfs := make([]int, 0, s.Steps)
+	for i := range s.Steps {
+		crf := s.MinCRF + int(math.Round(float64(i)*float64(s.MaxCRF-s.MinCRF)/float64(s.Steps-1)))
+		if len(crfs) == 0 || crfs[len(crfs)-1] != crf {
+			crfs = append(crfs, crf)
+		}
+	}
+	return crfs
+}
+
+// CRFSearchResult is the outcome of a target VMAF CRF search.
+type CRFSearchResult struct {
+	TargetVMAF float64         `json:"target_vmaf"`
+	CRF        int             `json:"crf"`    // CRF chosen for the full encode
+	Scores     map[int]float64 `json:"scores"` // Mean VMAF of the samples per CRF tried
+}
+
+// SearchCRF encodes short sample segments of the input at several CRF values,
+// measures their VMAF and interpolates the highest CRF that still reaches the
+// profile's target VMAF. headers are passed to ffmpeg for HTTP inputs.
+// Intermediate files are written to workDir, which is removed afterwards.
+// progress, if not nil, is called after each of the steps (sample
+// extractions and sample encodes) with the number of steps done.
+func (p Profile) SearchCRF(ctx context.Context, ffmpegPath, input, headers string, duration float64, workDir string, progress func(done, steps int)) (CRFSearchResult, error) {
+	search := p.CRFSearch.withDefaults()
+	candidates := search.candidates()
+
+	steps, done := search.Samples*(1+len(candidates)), 0
+	stepDone := func() {
+		done++
+		if progress != nil {
+			progress(done, steps)
+		}
+	}
+
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		return CRFSearchResult{}, fmt.Errorf("failed to create work dir: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Take the samples evenly spread over the input
+	samples := make([]string, 0, search.Samples)
+	for i := range search.Samples {
+		start := duration * float64(i+1) / float64(search.Samples+1)
+		sample := filepath.Join(workDir, fmt.Sprintf("sample_%d.mkv", i))
+
+		args := []string{"-y"}
+		if headers != "" {
+			args = append(args, "-headers", headers)
+		}
+		args = append(args,
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-i", input,
+			"-t", strconv.FormatFloat(search.SampleDuration, 'f', 3, 64),
+			"-map", "0:v:0", "-c", "copy",
+			sample,
+		)
+		if err := runCommand(ctx, ffmpegPath, args); err != nil {
+			return CRFSearchResult{}, fmt.Errorf("failed to extract sample %d: %w", i, err)
+		}
+		samples = append(samples, sample)
+		stepDone()
+	}
+
+	result := CRFSearchResult{
+		TargetVMAF: p.TargetVMAF,
+		Scores:     map[int]float64{},
+	}
+	for _, crf := range candidates {
+		params := p.withParam(search.Param, strconv.Itoa(crf)).Params
+		// Samples only contain the video stream and are compared frame by frame
+		delete(params, "f")
+		params["map"] = "0:v:0"
+		params["an"] = ""
+		params["sn"] = ""
+
+		total := 0.0
+		for i, sample := range samples {
+			encoded := filepath.Join(workDir, fmt.Sprintf("sample_%d_crf%d.mkv", i, crf))
+
+			kwargs := ffmpeg.KwArgs{}
+			for k, v := range params {
+				kwargs[k] = v
+			}
+			cmd := ffmpeg.Input(sample).
+				Output(encoded, kwargs).
+				OverWriteOutput().
+				SetFfmpegPath(ffmpegPath).
+				Compile()
+			if err := runCommand(ctx, cmd.Args[0], cmd.Args[1:]); err != nil {
+				return CRFSearchResult{}, fmt.Errorf("failed to encode sample %d at crf %d: %w", i, crf, err)
+			}
+
+			score, err := CalculateVMAF(ctx, sample, encoded)
+			if err != nil {
+				return CRFSearchResult{}, fmt.Errorf("failed to measure sample %d at crf %d: %w", i, crf, err)
+			}
+			total += score
+			os.Remove(encoded)
+			stepDone()
+		}
+		result.Scores[crf] = total / float64(len(samples))
+	}
+
+	result.CRF = interpolateCRF(result.Scores, p.TargetVMAF)
+	return result, nil
+}
+
+// interpolateCRF returns the highest CRF whose interpolated VMAF reaches the
+// target. Scores are expected to decrease as the CRF increases.
+func interpolateCRF(scores map[int]float64, target float64) int {
+	crfs := slices.Sorted(maps.Keys(scores))
+
+	if scores[crfs[0]] < target {
+		// Even the best quality misses the target
+		return crfs[0]
+	}
+	for i := 1; i < len(crfs); i++ {
+		lo, hi := crfs[i-1], crfs[i]
+		if scores[hi] >= target {
+			continue
+		}
+		// Linear interpolation between the last CRF that meets the target and the
+		// first one that misses it, rounded down to stay on the safe side.
+		fraction := (scores[lo] - target) / (scores[lo] - scores[hi])
+		return lo + int(math.Floor(fraction*float64(hi-lo)))
+	}
+	return crfs[len(crfs)-1]
+}
+
+// WithCRF returns a copy of the profile with its CRF param set, as chosen by a CRF search.
+func (p Profile) WithCRF(crf int) Profile {
+	return p.withParam(p.CRFSearch.withDefaults().Param, strconv.Itoa(crf))
+}
+
+func (p Profile) withParam(key, value string) Profile {
+	params := make(map[string]string, len(p.Params)+1)
+	maps.Copy(params, p.Params)
+	params[key] = value
+	p.Params = params
+	return p
+}
+
+// runCommand runs a command and includes its output in the returned error.
+func runCommand(ctx context.Context, name string, args []string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nDetails: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package transcoding
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCRFSearchCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		search CRFSearch
+		want   []int
+	}{
+		{"defaults", CRFSearch{}, []int{18, 23, 28, 33, 38}},
+		{"two steps", CRFSearch{MinCRF: 20, MaxCRF: 30, Steps: 2}, []int{20, 30}},
+		{"rounded", CRFSearch{MinCRF: 20, MaxCRF: 30, Steps: 4}, []int{20, 23, 27, 30}},
+		{"duplicates dropped", CRFSearch{MinCRF: 20, MaxCRF: 22, Steps: 5}, []int{20, 21, 22}},
+		{"single value", CRFSearch{MinCRF: 25, MaxCRF: 25, Steps: 3}, []int{25}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.search.withDefaults().candidates(); !slices.Equal(got, tt.want) {
+				t.Errorf("candidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterpolateCRF(t *testing.T) {
+	scores := map[int]float64{18: 98, 23: 96, 28: 93, 33: 89, 38: 84}
+
+	tests := []struct {
+		name   string
+		scores map[int]float64
+		target float64
+		want   int
+	}{
+		{"exact candidate", scores, 93, 28},
+		{"between candidates", scores, 95, 24}, // 96 at 23, 93 at 28: a third of the way
+		{"rounded down", scores, 90, 31},       // 93 at 28, 89 at 33: 3.75 of 5 steps
+		{"best misses target", scores, 99, 18},
+		{"worst meets target", scores, 80, 38},
+		{"single candidate", map[int]float64{25: 90}, 95, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interpolateCRF(tt.scores, tt.target); got != tt.want {
+				t.Errorf("interpolateCRF() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package transcoding
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// EstimateSize estimates the size in bytes of the output of the profile for
+// an input. The bit rates set by the profile with b:v and b:a replace the
+// ones of the input's streams, everything else is assumed to keep the bit
+// rate of the input. Without a known bit rate and duration the size of the
+// input is returned.
+//
+// Containers like MKV often have no bit rate per stream, only the total.
+// When the rate of a replaced video stream is unknown, the total can't be
+// split, so only the known rates of the kept streams are added to the
+// targets. An unknown audio rate stays part of the total, overestimating
+// the output by at most the audio.
+func (p Profile) EstimateSize(probe FFProbeData) int64 {
+	data := NewParamData(probe)
+	if data.BitRate <= 0 || data.Duration <= 0 {
+		return data.Size
+	}
+
+	params := p.Params
+	if p.TwoPass {
+		// The second pass writes the output
+		params = maps.Clone(p.Params)
+		maps.Copy(params, p.SecondPassParams)
+	}
+
+	targets := map[string]int64{}
+	for codecType, param := range map[string]string{"video": "b:v", "audio": "b:a"} {
+		if rate, ok := parseBitRate(params[param]); ok {
+			targets[codecType] = rate
+		}
+	}
+
+	// The output rate is the input's total with the rates of the replaced
+	// streams swapped for the targets, or the targets and the known rates
+	// of the kept streams when a replaced video rate is unknown
+	bitRate, remainder := data.BitRate, int64(0)
+	videoUnknown := false
+	for _, stream := range probe.Streams {
+		streamRate, _ := strconv.ParseInt(stream.BitRate, 10, 64)
+		target, replaced := targets[stream.CodecType]
+		if !replaced {
+			remainder += streamRate
+			continue
+		}
+		bitRate += target - streamRate
+		remainder += target
+		if streamRate <= 0 && stream.CodecType == "video" {
+			videoUnknown = true
+		}
+	}
+	if videoUnknown {
+		bitRate = remainder
+	}
+
+	return max(0, int64(float64(bitRate)*data.Duration/8))
+}
+
+// parseBitRate parses an FFmpeg bit rate like "4M", "2500k" or "128000" to bit/s.
+func parseBitRate(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+
+	multiplier := 1.0
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		multiplier = 1e3
+	case 'M':
+		multiplier = 1e6
+	case 'G':
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	return int64(value * multiplier), true
+}
@@ -0,0 +1,110 @@
+package transcoding
+
+import "testing"
+
+func TestParseBitRate(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   int64
+		wantOK bool
+	}{
+		{"128000", 128000, true},
+		{"2500k", 2500000, true},
+		{"2500K", 2500000, true},
+		{"4M", 4000000, true},
+		{"1.5M", 1500000, true},
+		{"1G", 1000000000, true},
+		{" 192k ", 192000, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"fast", 0, false},
+		{"0", 0, false},
+		{"-1M", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseBitRate(tt.in)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseBitRate(%q) = %d, %v, want %d, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	// 100 seconds at 10 Mbit/s: a video at 9 Mbit/s and an audio at 1 Mbit/s
+	probe := func(videoRate, audioRate string) FFProbeData {
+		return FFProbeData{
+			Format: FFProbeFormat{Duration: "100", Size: "125000000", BitRate: "10000000"},
+			Streams: []FFProbeStream{
+				{CodecType: "video", BitRate: videoRate},
+				{CodecType: "audio", BitRate: audioRate},
+			},
+		}
+	}
+	withRates := probe("9000000", "1000000")
+	mkv := probe("", "") // Matroska has no bit rate per stream
+
+	tests := []struct {
+		name    string
+		profile Profile
+		probe   FFProbeData
+		want    int64
+	}{
+		{
+			name:    "no target keeps the input rate",
+			profile: Profile{Params: map[string]string{"c:v": "libx265"}},
+			probe:   withRates,
+			want:    125000000,
+		},
+		{
+			name:    "video target",
+			profile: Profile{Params: map[string]string{"b:v": "4M"}},
+			probe:   withRates,
+			want:    62500000, // 4 + 1 Mbit/s
+		},
+		{
+			name:    "video and audio targets",
+			profile: Profile{Params: map[string]string{"b:v": "4M", "b:a": "128k"}},
+			probe:   withRates,
+			want:    51600000, // 4 + 0.128 Mbit/s
+		},
+		{
+			name:    "second pass target",
+			profile: Profile{TwoPass: true, Params: map[string]string{"b:v": "8M"}, SecondPassParams: map[string]string{"b:v": "2M"}},
+			probe:   withRates,
+			want:    37500000, // 2 + 1 Mbit/s
+		},
+		{
+			name:    "video target without stream rates",
+			profile: Profile{Params: map[string]string{"b:v": "4M"}},
+			probe:   mkv,
+			want:    50000000, // Only the target, the audio rate is unknown
+		},
+		{
+			name:    "video and audio targets without stream rates",
+			profile: Profile{Params: map[string]string{"b:v": "4M", "b:a": "128k"}},
+			probe:   mkv,
+			want:    51600000,
+		},
+		{
+			name:    "audio target without stream rates",
+			profile: Profile{Params: map[string]string{"b:a": "128k"}},
+			probe:   mkv,
+			want:    126600000, // The unknown audio rate stays in the total
+		},
+		{
+			name:    "unknown duration",
+			profile: Profile{Params: map[string]string{"b:v": "4M"}},
+			probe:   FFProbeData{Format: FFProbeFormat{Size: "125000000", BitRate: "10000000"}},
+			want:    125000000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.EstimateSize(tt.probe); got != tt.want {
+				t.Errorf("EstimateSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -71,6 +71,27 @@ type FFProbeStream struct {
 	Tags           map[string]string `json:"tags"`
 }
 
+// FirstStream returns the first stream of the given codec type ("video", "audio", "subtitle").
+func (d FFProbeData) FirstStream(codecType string) (FFProbeStream, bool) {
+	for _, stream := range d.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return FFProbeStream{}, false
+}
+
+// StreamCount returns the number of streams of the given codec type.
+func (d FFProbeData) StreamCount(codecType string) int {
+	count := 0
+	for _, stream := range d.Streams {
+		if stream.CodecType == codecType {
+			count++
+		}
+	}
+	return count
+}
+
 func Probe(path string) (FFProbeData, error) {
 	probeJSON, err := ffmpeg.Probe(path)
 	if err != nil {
@@ -0,0 +1,146 @@
+package transcoding
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ParamData is the data available to templated profile parameters.
+// It embeds the probe data of the input, so .Format and .Streams are
+// accessible alongside the shortcuts below.
+type ParamData struct {
+	FFProbeData
+
+	Video FFProbeStream // First video stream of the input, zero if none
+	Audio FFProbeStream // First audio stream of the input, zero if none
+
+	BitRate  int64   // Overall bit rate of the input in bit/s
+	Duration float64 // Duration of the input in seconds
+	Size     int64   // Size of the input in bytes
+}
+
+// NewParamData builds the template data from the probe data of an input.
+func NewParamData(probe FFProbeData) ParamData {
+	data := ParamData{FFProbeData: probe}
+	data.Video, _ = probe.FirstStream("video")
+	data.Audio, _ = probe.FirstStream("audio")
+	data.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	data.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	data.Size, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+	return data
+}
+
+// sampleParamData is a typical input used to validate parameter templates.
+var sampleParamData = NewParamData(FFProbeData{
+	Format: FFProbeFormat{
+		FormatName: "matroska,webm",
+		Duration:   "3600.000000",
+		Size:       "4500000000",
+		BitRate:    "10000000",
+	},
+	Streams: []FFProbeStream{
+		{Index: 0, CodecName: "h264", CodecType: "video", Width: 1920, Height: 1080, BitRate: "9000000"},
+		{Index: 1, CodecName: "aac", CodecType: "audio", Channels: 2, SampleRate: "48000", BitRate: "192000"},
+	},
+})
+
+// paramFuncs are the functions available to parameter templates
+// in addition to the text/template builtins.
+var paramFuncs = template.FuncMap{
+	"add":   func(a, b any) (float64, error) { return numericOp(a, b, func(x, y float64) float64 { return x + y }) },
+	"sub":   func(a, b any) (float64, error) { return numericOp(a, b, func(x, y float64) float64 { return x - y }) },
+	"mul":   func(a, b any) (float64, error) { return numericOp(a, b, func(x, y float64) float64 { return x * y }) },
+	"div":   divide,
+	"int":   toInt,
+	"float": toFloat,
+}
+
+// isTemplate reports whether a parameter value must be evaluated as a template.
+func isTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// renderParams evaluates the templated values of params against the data.
+// Templated values that render to an empty string remove the parameter,
+// which allows conditional parameters.
+func renderParams(params map[string]string, data ParamData) (map[string]string, error) {
+	if params == nil {
+		return nil, nil
+	}
+
+	rendered := make(map[string]string, len(params))
+	for k, v := range params {
+		if !isTemplate(v) {
+			rendered[k] = v
+			continue
+		}
+
+		tmpl, err := template.New(k).Funcs(paramFuncs).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("param %q: %w", k, err)
+		}
+
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			return nil, fmt.Errorf("param %q: %w", k, err)
+		}
+
+		if value := strings.TrimSpace(sb.String()); value != "" {
+			rendered[k] = value
+		}
+	}
+	return rendered, nil
+}
+
+func numericOp(a, b any, op func(x, y float64) float64) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
+
+func divide(a, b any) (float64, error) {
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	if y == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	return x / y, nil
+}
+
+func toInt(v any) (int64, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(f)), nil
+}
+
+func toFloat(v any) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	default:
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+}
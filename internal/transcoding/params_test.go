@@ -0,0 +1,77 @@
+package transcoding
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestRenderParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "plain values kept",
+			params: map[string]string{"c:v": "libx265", "an": ""},
+			want:   map[string]string{"c:v": "libx265", "an": ""},
+		},
+		{
+			name:   "shortcuts",
+			params: map[string]string{"b:v": "{{ .Video.BitRate }}", "ac": "{{ .Audio.Channels }}"},
+			want:   map[string]string{"b:v": "9000000", "ac": "2"},
+		},
+		{
+			name:   "arithmetic",
+			params: map[string]string{"b:v": "{{ int (mul .BitRate 0.5) }}", "maxrate": "{{ int (div .Video.Width 2) }}"},
+			want:   map[string]string{"b:v": "5000000", "maxrate": "960"},
+		},
+		{
+			name:   "conditional removed",
+			params: map[string]string{"vf": "{{ if gt .Video.Height 1080 }}scale=-2:1080{{ end }}", "crf": "24"},
+			want:   map[string]string{"crf": "24"},
+		},
+		{
+			name:   "conditional kept",
+			params: map[string]string{"vf": "{{ if ge .Video.Height 1080 }}scale=-2:720{{ end }}"},
+			want:   map[string]string{"vf": "scale=-2:720"},
+		},
+		{
+			name:   "whitespace trimmed",
+			params: map[string]string{"b:a": "  {{ .Audio.BitRate }}\n"},
+			want:   map[string]string{"b:a": "192000"},
+		},
+		{
+			name:    "parse error",
+			params:  map[string]string{"b:v": "{{ .BitRate "},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			params:  map[string]string{"b:v": "{{ .NoSuchField }}"},
+			wantErr: true,
+		},
+		{
+			name:    "division by zero",
+			params:  map[string]string{"b:v": "{{ div .BitRate 0 }}"},
+			wantErr: true,
+		},
+		{
+			name:   "nil",
+			params: nil,
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderParams(tt.params, sampleParamData)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("renderParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
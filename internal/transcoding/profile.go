@@ -1,7 +1,13 @@
 package transcoding
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
@@ -12,9 +18,120 @@ type Profile struct {
 
 	Params map[string]string `koanf:"params"`
 
+	// Extension is the file extension of the output container, e.g. "mkv".
+	// When empty it follows the muxer forced with the "f" param, or else
+	// the extension of the input. Replacing an input with an output of
+	// another extension renames the file.
+	Extension string `koanf:"extension"`
+
+	// TwoPass enables two-pass encoding. The first pass only analyses the
+	// input and writes a passlog that the second pass uses for the output.
+	TwoPass bool `koanf:"two_pass"`
+	// FirstPassParams and SecondPassParams are merged over Params
+	// for the respective pass of a two-pass encode.
+	FirstPassParams  map[string]string `koanf:"first_pass_params"`
+	SecondPassParams map[string]string `koanf:"second_pass_params"`
+
+	// TargetVMAF enables quality-targeted encoding. Before the full encode,
+	// sample segments are encoded at several CRF values and the highest CRF
+	// reaching this VMAF score is used for the CRF param.
+	TargetVMAF float64   `koanf:"target_vmaf"`
+	CRFSearch  CRFSearch `koanf:"crf_search"`
+
+	// AutoMetrics are quality metrics (vmaf, psnr, ssim) calculated in the
+	// background once a task of this profile waits for resolution.
+	AutoMetrics []string `koanf:"auto_metrics"`
+
+	// ResolutionRules resolve tasks of this profile automatically,
+	// they are evaluated before the global rules.
+	ResolutionRules []ResolutionRule `koanf:"resolution_rules"`
+
 	BatchExcludeFilter *CodecFilter `koanf:"batch_exclude_filter"`
 }
 
+// Render returns a copy of the profile with all templated parameters
+// evaluated against the probe data of an input.
+func (p Profile) Render(probe FFProbeData) (Profile, error) {
+	data := NewParamData(probe)
+
+	var err error
+	if p.Params, err = renderParams(p.Params, data); err != nil {
+		return Profile{}, err
+	}
+	if p.FirstPassParams, err = renderParams(p.FirstPassParams, data); err != nil {
+		return Profile{}, fmt.Errorf("first pass: %w", err)
+	}
+	if p.SecondPassParams, err = renderParams(p.SecondPassParams, data); err != nil {
+		return Profile{}, fmt.Errorf("second pass: %w", err)
+	}
+	return p, nil
+}
+
+// Validate checks the profile options and that all templated parameters
+// of the profile parse and evaluate against a typical input.
+func (p Profile) Validate() error {
+	if ext := strings.TrimPrefix(p.Extension, "."); strings.ContainsAny(ext, `/\.`) {
+		return fmt.Errorf("extension %q is not a valid file extension", p.Extension)
+	}
+	if p.TargetVMAF < 0 || p.TargetVMAF > 100 {
+		return fmt.Errorf("target_vmaf must be between 0 and 100")
+	}
+	if p.TargetVMAF > 0 {
+		if p.TwoPass {
+			return fmt.Errorf("target_vmaf can't be combined with two_pass")
+		}
+		search := p.CRFSearch.withDefaults()
+		if search.MinCRF >= search.MaxCRF {
+			return fmt.Errorf("crf_search: min_crf must be lower than max_crf")
+		}
+	}
+
+	for _, metric := range p.AutoMetrics {
+		if !slices.Contains(Metrics, metric) {
+			return fmt.Errorf("auto_metrics: unknown metric %q", metric)
+		}
+	}
+
+	for _, rule := range p.ResolutionRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("resolution_rules: %w", err)
+		}
+	}
+
+	_, err := p.Render(sampleParamData.FFProbeData)
+	return err
+}
+
+// muxerExtensions are the file extensions of the containers written by
+// the FFmpeg muxers commonly forced with the "f" param.
+var muxerExtensions = map[string]string{
+	"matroska": ".mkv",
+	"webm":     ".webm",
+	"mp4":      ".mp4",
+	"mov":      ".mov",
+	"ipod":     ".m4a",
+	"avi":      ".avi",
+	"mpegts":   ".ts",
+	"flv":      ".flv",
+	"ogg":      ".ogg",
+	"opus":     ".opus",
+	"flac":     ".flac",
+	"mp3":      ".mp3",
+	"wav":      ".wav",
+}
+
+// OutputExt returns the extension, with the dot, of the output this
+// profile writes for an input.
+func (p Profile) OutputExt(input string) string {
+	if p.Extension != "" {
+		return "." + strings.TrimPrefix(p.Extension, ".")
+	}
+	if ext, ok := muxerExtensions[p.Params["f"]]; ok {
+		return ext
+	}
+	return filepath.Ext(input)
+}
+
 func (p *Profile) Compile(ffmpegPath, input, output, progressSock string) *exec.Cmd {
 	args := ffmpeg.KwArgs{
 		"map": "0",
@@ -33,6 +150,55 @@ func (p *Profile) Compile(ffmpegPath, input, output, progressSock string) *exec.
 	return cmd
 }
 
+// PassParams returns the parameters of the given pass (1 or 2) of a
+// two-pass encode, including the ffmpeg pass options.
+func (p *Profile) PassParams(pass int, passlog string) map[string]string {
+	passParams := p.FirstPassParams
+	if pass == 2 {
+		passParams = p.SecondPassParams
+	}
+
+	params := make(map[string]string, len(p.Params)+len(passParams)+3)
+	for k, v := range p.Params {
+		params[k] = v
+	}
+	for k, v := range passParams {
+		params[k] = v
+	}
+	params["pass"] = strconv.Itoa(pass)
+	params["passlogfile"] = passlog
+	if pass == 1 {
+		// The first pass output is discarded
+		params["f"] = "null"
+	}
+	return params
+}
+
+// CompilePass builds the ffmpeg command for one pass of a two-pass encode.
+// Both passes must share the same passlog file prefix. The first pass
+// writes no output, so output is only used by the second pass.
+func (p *Profile) CompilePass(pass int, ffmpegPath, input, output, passlog, progressSock string) *exec.Cmd {
+	args := ffmpeg.KwArgs{
+		"map": "0",
+	}
+	for k, v := range p.PassParams(pass, passlog) {
+		args[k] = v
+	}
+
+	if pass == 1 {
+		output = os.DevNull
+	}
+
+	cmd := ffmpeg.Input(input).
+		Output(output, args).
+		GlobalArgs("-progress", "unix://"+progressSock).
+		OverWriteOutput().
+		SetFfmpegPath(ffmpegPath).
+		Compile()
+
+	return cmd
+}
+
 // CompilePipe builds an exec.Cmd for pipe-based transcoding.
 // Input is read from stdin (pipe:0) and output is written to stdout (pipe:1).
 // No progress socket is used — progress must be tracked out-of-band.
@@ -0,0 +1,71 @@
+package transcoding
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is one update of FFmpeg's -progress output.
+type Progress struct {
+	Frame     int64   `json:"frame"`
+	FPS       float64 `json:"fps"`
+	Bitrate   float64 `json:"bitrate"`    // Output bitrate in kbit/s
+	TotalSize int64   `json:"total_size"` // Bytes written so far
+	Speed     float64 `json:"speed"`      // Encoding speed as a multiple of realtime
+	OutTime   float64 `json:"out_time"`   // Seconds of output encoded so far
+
+	// End is set on the last update, once FFmpeg is done.
+	End bool `json:"-"`
+}
+
+// ParseProgress reads FFmpeg's -progress output, a block of key=value lines
+// per update terminated by a "progress" key, and calls fn for every update.
+// Values FFmpeg reports as N/A are left zero. It returns when r is exhausted.
+func ParseProgress(r io.Reader, fn func(Progress)) error {
+	var progress Progress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "frame":
+			progress.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			progress.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			progress.Bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "total_size":
+			progress.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+		case "speed":
+			progress.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "out_time_us", "out_time_ms": // both in microseconds
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				progress.OutTime = float64(us) / 1e6
+			}
+		case "progress":
+			progress.End = value == "end"
+			fn(progress)
+			progress = Progress{}
+		}
+	}
+	return scanner.Err()
+}
+
+// Remaining estimates the time until an encode of the given total media
+// duration finishes at the current speed, given the overall progress
+// (0.0 to 1.0) across all of its passes. Returns 0 when the speed is unknown.
+func (p Progress) Remaining(totalDuration, progress float64, passes int) time.Duration {
+	if p.Speed <= 0 || totalDuration <= 0 {
+		return 0
+	}
+	remaining := (1 - progress) * float64(passes) * totalDuration / p.Speed
+	return time.Duration(max(0, remaining) * float64(time.Second))
+}
@@ -0,0 +1,92 @@
+package transcoding
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []Progress
+	}{
+		{
+			name: "single update",
+			output: "frame=240\nfps=48.00\nstream_0_0_q=28.0\nbitrate=2400.5kbits/s\ntotal_size=1048576\n" +
+				"out_time_us=10000000\nout_time_ms=10000000\nout_time=00:00:10.000000\ndup_frames=0\ndrop_frames=0\n" +
+				"speed=2.01x\nprogress=continue\n",
+			want: []Progress{{Frame: 240, FPS: 48, Bitrate: 2400.5, TotalSize: 1048576, Speed: 2.01, OutTime: 10}},
+		},
+		{
+			name:   "updates are independent",
+			output: "frame=24\nspeed=1x\nprogress=continue\nframe=48\nprogress=end\n",
+			want:   []Progress{{Frame: 24, Speed: 1}, {Frame: 48, End: true}},
+		},
+		{
+			name:   "not available values",
+			output: "frame=0\nfps=0.00\nbitrate=N/A\ntotal_size=N/A\nout_time_us=N/A\nspeed=N/A\nprogress=continue\n",
+			want:   []Progress{{}},
+		},
+		{
+			name:   "padded values",
+			output: "bitrate= 800.0kbits/s\nspeed=   4.5x\nprogress=end\n",
+			want:   []Progress{{Bitrate: 800, Speed: 4.5, End: true}},
+		},
+		{
+			name:   "out_time_ms is in microseconds",
+			output: "out_time_ms=1500000\nprogress=continue\n",
+			want:   []Progress{{OutTime: 1.5}},
+		},
+		{
+			name:   "incomplete update dropped",
+			output: "frame=24\nprogress=continue\nframe=48\n",
+			want:   []Progress{{Frame: 24}},
+		},
+		{
+			name:   "other lines ignored",
+			output: "garbage\n\nframe=1\nprogress=end\n",
+			want:   []Progress{{Frame: 1, End: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Progress
+			err := ParseProgress(strings.NewReader(tt.output), func(p Progress) {
+				got = append(got, p)
+			})
+			if err != nil {
+				t.Fatalf("ParseProgress() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseProgress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressRemaining(t *testing.T) {
+	tests := []struct {
+		name     string
+		speed    float64
+		duration float64
+		progress float64
+		passes   int
+		want     time.Duration
+	}{
+		{"half done", 2, 600, 0.5, 1, 150 * time.Second},
+		{"two passes", 2, 600, 0.5, 2, 300 * time.Second},
+		{"done", 2, 600, 1, 1, 0},
+		{"unknown speed", 0, 600, 0.5, 1, 0},
+		{"unknown duration", 2, 0, 0.5, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Progress{Speed: tt.speed}).Remaining(tt.duration, tt.progress, tt.passes); got != tt.want {
+				t.Errorf("Remaining() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -132,3 +132,27 @@ func CalculateSSIM(ctx context.Context, reference, distorted string) (float64, e
 
 	return 0, fmt.Errorf("SSIM score not found in output")
 }
+
+// Quality metric names, as used by the auto_metrics profile option.
+const (
+	MetricVMAF = "vmaf"
+	MetricPSNR = "psnr"
+	MetricSSIM = "ssim"
+)
+
+// Metrics lists the supported quality metrics in display order.
+var Metrics = []string{MetricVMAF, MetricPSNR, MetricSSIM}
+
+// CalculateMetric calculates the named quality metric of distorted against reference.
+func CalculateMetric(ctx context.Context, metric, reference, distorted string) (float64, error) {
+	switch metric {
+	case MetricVMAF:
+		return CalculateVMAF(ctx, reference, distorted)
+	case MetricPSNR:
+		return CalculatePSNR(ctx, reference, distorted)
+	case MetricSSIM:
+		return CalculateSSIM(ctx, reference, distorted)
+	default:
+		return 0, fmt.Errorf("unknown metric: %s", metric)
+	}
+}
@@ -0,0 +1,163 @@
+package transcoding
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Resolution rule actions.
+const (
+	RuleActionAccept   = "accept"    // Replace the original with the output
+	RuleActionReject   = "reject"    // Keep the original and discard the output
+	RuleActionKeepBoth = "keep_both" // Keep the original and save the output as a new file
+)
+
+// ResolutionRule resolves a task waiting for resolution automatically when
+// all of its conditions hold. Rules are evaluated in order and the first
+// matching one decides; when none matches, the task waits for a human.
+type ResolutionRule struct {
+	Name   string         `koanf:"name"`
+	Action string         `koanf:"action"`
+	When   RuleConditions `koanf:"when"`
+}
+
+// RuleConditions are the conditions of a resolution rule. Unset conditions are
+// ignored, so a rule without conditions always matches.
+type RuleConditions struct {
+	// Bounds of the size reduction of the output in percent of the input size,
+	// negative when the output is larger.
+	MinSizeReduction *float64 `koanf:"min_size_reduction"`
+	MaxSizeReduction *float64 `koanf:"max_size_reduction"`
+
+	// Bounds of quality metrics (vmaf, psnr, ssim) of the output by name.
+	MinMetrics map[string]float64 `koanf:"min_metrics"`
+	MaxMetrics map[string]float64 `koanf:"max_metrics"`
+
+	// StreamsDropped matches on whether the output has fewer audio or subtitle
+	// streams than the input.
+	StreamsDropped *bool `koanf:"streams_dropped"`
+}
+
+// ResolutionFacts describe a transcoded task for evaluating resolution rules.
+type ResolutionFacts struct {
+	InputSize  int64
+	OutputSize int64
+
+	Metrics map[string]float64
+
+	// DroppedStreams describes the audio and subtitle streams missing
+	// from the output, see DroppedStreams.
+	DroppedStreams []string
+}
+
+// SizeReduction returns by how many percent the output is smaller than the input.
+func (f ResolutionFacts) SizeReduction() float64 {
+	if f.InputSize == 0 {
+		return 0
+	}
+	return (1 - float64(f.OutputSize)/float64(f.InputSize)) * 100
+}
+
+// Validate checks the action and the metric names of the rule.
+func (r ResolutionRule) Validate() error {
+	if r.Action != RuleActionAccept && r.Action != RuleActionReject && r.Action != RuleActionKeepBoth {
+		return fmt.Errorf("rule %q: action must be %q, %q or %q", r.Name, RuleActionAccept, RuleActionReject, RuleActionKeepBoth)
+	}
+	for _, metric := range r.Metrics() {
+		if !slices.Contains(Metrics, metric) {
+			return fmt.Errorf("rule %q: unknown metric %q", r.Name, metric)
+		}
+	}
+	return nil
+}
+
+// Metrics returns the names of the quality metrics the rule's conditions refer to.
+func (r ResolutionRule) Metrics() []string {
+	var metrics []string
+	for metric := range r.When.MinMetrics {
+		metrics = append(metrics, metric)
+	}
+	for metric := range r.When.MaxMetrics {
+		if !slices.Contains(metrics, metric) {
+			metrics = append(metrics, metric)
+		}
+	}
+	slices.Sort(metrics)
+	return metrics
+}
+
+// NeedsStreams reports whether the rule compares the streams of the input and the output.
+func (r ResolutionRule) NeedsStreams() bool {
+	return r.When.StreamsDropped != nil
+}
+
+// Match evaluates the rule's conditions. When the rule matches, the returned
+// reasons explain every condition that held.
+func (r ResolutionRule) Match(facts ResolutionFacts) ([]string, bool) {
+	var reasons []string
+	when := r.When
+
+	reduction := facts.SizeReduction()
+	if when.MinSizeReduction != nil {
+		if reduction < *when.MinSizeReduction {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("size reduction %.1f%% >= %g%%", reduction, *when.MinSizeReduction))
+	}
+	if when.MaxSizeReduction != nil {
+		if reduction > *when.MaxSizeReduction {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("size reduction %.1f%% <= %g%%", reduction, *when.MaxSizeReduction))
+	}
+
+	for _, metric := range r.Metrics() {
+		score, ok := facts.Metrics[metric]
+		if !ok {
+			return nil, false
+		}
+		if bound, ok := when.MinMetrics[metric]; ok {
+			if score < bound {
+				return nil, false
+			}
+			reasons = append(reasons, fmt.Sprintf("%s %.2f >= %g", metric, score, bound))
+		}
+		if bound, ok := when.MaxMetrics[metric]; ok {
+			if score > bound {
+				return nil, false
+			}
+			reasons = append(reasons, fmt.Sprintf("%s %.2f <= %g", metric, score, bound))
+		}
+	}
+
+	if when.StreamsDropped != nil {
+		dropped := len(facts.DroppedStreams) > 0
+		if dropped != *when.StreamsDropped {
+			return nil, false
+		}
+		if dropped {
+			reasons = append(reasons, fmt.Sprintf("streams dropped: %v", facts.DroppedStreams))
+		} else {
+			reasons = append(reasons, "no streams dropped")
+		}
+	}
+
+	if len(reasons) == 0 {
+		reasons = append(reasons, "rule has no conditions")
+	}
+	return reasons, true
+}
+
+// DroppedStreams compares the audio and subtitle streams of an input and its
+// output and describes every stream type the output has fewer streams of,
+// e.g. "audio 2 -> 1".
+func DroppedStreams(input, output FFProbeData) []string {
+	var dropped []string
+	for _, codecType := range []string{"audio", "subtitle"} {
+		in, out := input.StreamCount(codecType), output.StreamCount(codecType)
+		if out < in {
+			dropped = append(dropped, fmt.Sprintf("%s %d -> %d", codecType, in, out))
+		}
+	}
+	return dropped
+}
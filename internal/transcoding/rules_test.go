@@ -0,0 +1,112 @@
+package transcoding
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolutionRuleMatch(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	yes, no := true, false
+
+	// Output at 40% of the input, a size reduction of 60%
+	facts := ResolutionFacts{
+		InputSize:  1000,
+		OutputSize: 400,
+		Metrics:    map[string]float64{"vmaf": 95.5},
+	}
+	dropped := facts
+	dropped.DroppedStreams = []string{"audio 2 -> 1"}
+
+	tests := []struct {
+		name        string
+		when        RuleConditions
+		facts       ResolutionFacts
+		wantMatch   bool
+		wantReasons []string
+	}{
+		{
+			name:        "no conditions",
+			facts:       facts,
+			wantMatch:   true,
+			wantReasons: []string{"rule has no conditions"},
+		},
+		{
+			name:        "min size reduction met",
+			when:        RuleConditions{MinSizeReduction: ptr(50)},
+			facts:       facts,
+			wantMatch:   true,
+			wantReasons: []string{"size reduction 60.0% >= 50%"},
+		},
+		{
+			name:  "min size reduction missed",
+			when:  RuleConditions{MinSizeReduction: ptr(70)},
+			facts: facts,
+		},
+		{
+			name:  "max size reduction missed",
+			when:  RuleConditions{MaxSizeReduction: ptr(10)},
+			facts: facts,
+		},
+		{
+			name:        "metric bounds met",
+			when:        RuleConditions{MinMetrics: map[string]float64{"vmaf": 93}, MaxMetrics: map[string]float64{"vmaf": 99}},
+			facts:       facts,
+			wantMatch:   true,
+			wantReasons: []string{"vmaf 95.50 >= 93", "vmaf 95.50 <= 99"},
+		},
+		{
+			name:  "metric below min",
+			when:  RuleConditions{MinMetrics: map[string]float64{"vmaf": 96}},
+			facts: facts,
+		},
+		{
+			name:  "metric missing",
+			when:  RuleConditions{MinMetrics: map[string]float64{"psnr": 40}},
+			facts: facts,
+		},
+		{
+			name:        "no streams dropped",
+			when:        RuleConditions{StreamsDropped: &no},
+			facts:       facts,
+			wantMatch:   true,
+			wantReasons: []string{"no streams dropped"},
+		},
+		{
+			name:  "streams dropped unexpectedly",
+			when:  RuleConditions{StreamsDropped: &no},
+			facts: dropped,
+		},
+		{
+			name:        "streams dropped",
+			when:        RuleConditions{StreamsDropped: &yes},
+			facts:       dropped,
+			wantMatch:   true,
+			wantReasons: []string{"streams dropped: [audio 2 -> 1]"},
+		},
+		{
+			name:  "all conditions must hold",
+			when:  RuleConditions{MinSizeReduction: ptr(50), MinMetrics: map[string]float64{"vmaf": 97}},
+			facts: facts,
+		},
+		{
+			name:        "larger output",
+			when:        RuleConditions{MaxSizeReduction: ptr(0)},
+			facts:       ResolutionFacts{InputSize: 1000, OutputSize: 1200},
+			wantMatch:   true,
+			wantReasons: []string{"size reduction -20.0% <= 0%"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := ResolutionRule{Name: tt.name, Action: RuleActionAccept, When: tt.when}
+			reasons, ok := rule.Match(tt.facts)
+			if ok != tt.wantMatch {
+				t.Fatalf("Match() = %v, want %v", ok, tt.wantMatch)
+			}
+			if !slices.Equal(reasons, tt.wantReasons) {
+				t.Errorf("Match() reasons = %q, want %q", reasons, tt.wantReasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/royalcat/easy-transcoder/internal/events"
+)
+
+// EventKind identifies what changed in an Event.
+type EventKind string
+
+const (
+	EventWorkerRegistered EventKind = "worker_registered"
+	EventWorkerHeartbeat  EventKind = "worker_heartbeat"
+	EventWorkerRemoved    EventKind = "worker_removed" // The worker missed its heartbeats
+)
+
+// Event is a state change of a remote worker.
+type Event struct {
+	Kind   EventKind
+	Worker WorkerState // State of the worker after the change
+}
+
+// Subscribe returns a subscription to the worker events.
+func (m *Manager) Subscribe(buffer int) *events.Subscription[Event] {
+	return m.events.Subscribe(buffer)
+}
+
+func (m *Manager) publish(kind EventKind, w *Worker) {
+	timeout := time.Duration(m.config.HeartbeatTimeout) * time.Second
+	m.events.Publish(Event{Kind: kind, Worker: w.State(timeout)})
+}
@@ -2,9 +2,12 @@ package worker
 
 import (
 	"encoding/json"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
+
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 // APIHandlers holds HTTP handlers for the worker API endpoints.
@@ -107,6 +110,12 @@ func (h *APIHandlers) HandleTaskProgress(w http.ResponseWriter, r *http.Request)
 		WorkerID string  `json:"worker_id"`
 		TaskID   uint64  `json:"task_id"`
 		Progress float64 `json:"progress"`
+
+		// Latest FFmpeg progress update, absent e.g. during the CRF search
+		Stats *transcoding.Progress `json:"stats,omitempty"`
+
+		// Outcome of a target VMAF CRF search, sent once before the encode
+		CRFSearch *transcoding.CRFSearchResult `json:"crf_search,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
@@ -121,7 +130,41 @@ func (h *APIHandlers) HandleTaskProgress(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := h.manager.ReportProgress(req.WorkerID, req.TaskID, req.Progress); err != nil {
+	if err := h.manager.ReportProgress(req.WorkerID, req.TaskID, req.Progress, req.Stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.CRFSearch != nil {
+		if err := h.manager.ReportCRFSearch(req.WorkerID, req.TaskID, *req.CRFSearch); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// maxTaskLogChunk bounds the size of a single task log upload.
+const maxTaskLogChunk = 1 << 20
+
+// HandleTaskLog handles POST /api/v1/worker/task/log
+// The request body is a chunk of the task's FFmpeg output, appended to its log.
+func (h *APIHandlers) HandleTaskLog(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.ParseUint(r.URL.Query().Get("task_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid task ID", http.StatusBadRequest)
+		return
+	}
+	workerID := r.URL.Query().Get("worker_id")
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxTaskLogChunk))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.manager.AppendTaskLog(workerID, taskID, data); err != nil {
+		h.logger.Error("failed to append task log", "task_id", taskID, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -9,7 +9,9 @@ import (
 	"time"
 
 	"github.com/royalcat/easy-transcoder/internal/config"
+	"github.com/royalcat/easy-transcoder/internal/events"
 	"github.com/royalcat/easy-transcoder/internal/processor"
+	"github.com/royalcat/easy-transcoder/internal/transcoding"
 )
 
 // Manager orchestrates remote worker lifecycles.
@@ -20,6 +22,9 @@ type Manager struct {
 	config    config.WorkerConfig
 	logger    *slog.Logger
 	processor *processor.Processor
+
+	// Worker state changes, see Subscribe
+	events events.Bus[Event]
 }
 
 // NewManager creates a new worker manager.
@@ -66,6 +71,7 @@ func (m *Manager) Register(req RegisterRequest) (*Worker, error) {
 	m.workers[id] = w
 
 	m.logger.Info("worker registered", "worker_id", id, "hostname", req.Hostname)
+	m.publish(EventWorkerRegistered, w)
 	return w, nil
 }
 
@@ -80,31 +86,68 @@ func (m *Manager) Heartbeat(workerID string, taskID *uint64) error {
 	}
 
 	w.UpdateHeartbeat(taskID)
+	m.publish(EventWorkerHeartbeat, w)
 	return nil
 }
 
 // AcquireTask attempts to dequeue a pending task and assign it to a worker.
-// Returns nil if no pending tasks are available.
+// Returns nil if no pending tasks are available or the schedule holds them.
 func (m *Manager) AcquireTask(workerID string) (*processor.AcquiredTask, error) {
 	m.workersMu.RLock()
 	_, ok := m.workers[workerID]
+	// A task can skip this worker if the local worker or another live worker can take it
+	canSkip := !m.config.DisableLocalProcessing
+	timeout := time.Duration(m.config.HeartbeatTimeout) * time.Second
+	for id, w := range m.workers {
+		if id != workerID && w.IsAlive(timeout) {
+			canSkip = true
+		}
+	}
 	m.workersMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("worker %s not registered", workerID)
 	}
 
-	return m.processor.DequeueForWorker(workerID)
+	// Outside the schedule windows no worker starts a new task
+	if m.processor.RemoteScheduleHold() != "" {
+		return nil, nil
+	}
+
+	return m.processor.DequeueForWorker(workerID, canSkip)
 }
 
 // ReportProgress updates a task's progress from a remote worker.
-func (m *Manager) ReportProgress(workerID string, taskID uint64, progress float64) error {
+// stats is the worker's latest FFmpeg progress update, nil if it sent none.
+func (m *Manager) ReportProgress(workerID string, taskID uint64, progress float64, stats *transcoding.Progress) error {
+	m.workersMu.RLock()
+	_, ok := m.workers[workerID]
+	m.workersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("worker %s not registered", workerID)
+	}
+	return m.processor.UpdateProgress(taskID, progress, stats)
+}
+
+// ReportCRFSearch records the outcome of a CRF search run by a remote worker.
+func (m *Manager) ReportCRFSearch(workerID string, taskID uint64, result transcoding.CRFSearchResult) error {
+	m.workersMu.RLock()
+	_, ok := m.workers[workerID]
+	m.workersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("worker %s not registered", workerID)
+	}
+	return m.processor.SetCRFSearchResult(taskID, result)
+}
+
+// AppendTaskLog appends FFmpeg output sent by a remote worker to the task's log.
+func (m *Manager) AppendTaskLog(workerID string, taskID uint64, data []byte) error {
 	m.workersMu.RLock()
 	_, ok := m.workers[workerID]
 	m.workersMu.RUnlock()
 	if !ok {
 		return fmt.Errorf("worker %s not registered", workerID)
 	}
-	return m.processor.UpdateProgress(taskID, progress)
+	return m.processor.AppendTaskLog(taskID, data)
 }
 
 // CompleteTask marks a remotely-processed task as completed or failed.
@@ -181,6 +224,7 @@ func (m *Manager) handleDeadWorkers() {
 				}
 			}
 			delete(m.workers, id)
+			m.publish(EventWorkerRemoved, w)
 		}
 	}
 }
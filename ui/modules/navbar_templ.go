@@ -35,7 +35,7 @@ func Navbar() templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		templ_7745c5c3_Err = elements.Status("").Render(ctx, templ_7745c5c3_Buffer)
+		templ_7745c5c3_Err = elements.Status("", 0, 0, nil).Render(ctx, templ_7745c5c3_Buffer)
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}